@@ -2,12 +2,55 @@ package odp
 
 import (
 	"fmt"
+	"strings"
 	"syscall"
 )
 
-type datapathInfo struct {
-	ifindex int32
+// The OVS_DP_ATTR_USER_FEATURES bits of a datapath.  Some of these
+// change the format of later messages: OVS_DP_F_UNALIGNED lets the
+// kernel send flow keys without aligning them, and
+// OVS_DP_F_VPORT_PIDS lets a vport have several upcall port ids.
+type DatapathFeatures uint32
+
+// The features that CreateDatapath asks for.  The rest of this
+// package assumes them, e.g. CreateVport with several upcall port ids
+// requires OVS_DP_F_VPORT_PIDS.
+const DefaultDatapathFeatures DatapathFeatures = OVS_DP_F_UNALIGNED | OVS_DP_F_VPORT_PIDS
+
+var datapathFeatureNames = []struct {
 	name    string
+	feature DatapathFeatures
+}{
+	{"unaligned", OVS_DP_F_UNALIGNED},
+	{"vport_pids", OVS_DP_F_VPORT_PIDS},
+	{"tc_recirc_sharing", OVS_DP_F_TC_RECIRC_SHARING},
+	{"dispatch_upcall_per_cpu", OVS_DP_F_DISPATCH_UPCALL_PER_CPU},
+}
+
+func (f DatapathFeatures) Has(features DatapathFeatures) bool {
+	return f&features == features
+}
+
+func (f DatapathFeatures) String() string {
+	var names []string
+	for _, n := range datapathFeatureNames {
+		if f&n.feature != 0 {
+			names = append(names, n.name)
+			f &^= n.feature
+		}
+	}
+
+	if f != 0 || len(names) == 0 {
+		names = append(names, fmt.Sprintf("%#x", uint32(f)))
+	}
+
+	return strings.Join(names, "|")
+}
+
+type datapathInfo struct {
+	ifindex  int32
+	name     string
+	features DatapathFeatures
 }
 
 func (dpif *Dpif) parseDatapathInfo(msg *NlMsgParser) (res datapathInfo, err error) {
@@ -23,6 +66,12 @@ func (dpif *Dpif) parseDatapathInfo(msg *NlMsgParser) (res datapathInfo, err err
 	}
 
 	res.name, err = attrs.GetString(OVS_DP_ATTR_NAME)
+	if err != nil {
+		return
+	}
+
+	features, _, err := attrs.GetOptionalUint32(OVS_DP_ATTR_USER_FEATURES)
+	res.features = DatapathFeatures(features)
 	return
 }
 
@@ -41,14 +90,18 @@ func (dp DatapathHandle) Reopen() (DatapathHandle, error) {
 }
 
 func (dpif *Dpif) CreateDatapath(name string) (DatapathHandle, error) {
-	var features uint32 = OVS_DP_F_UNALIGNED | OVS_DP_F_VPORT_PIDS
+	return dpif.CreateDatapathWithFeatures(name, DefaultDatapathFeatures)
+}
 
+// Like CreateDatapath, but with the given user features rather than
+// DefaultDatapathFeatures.
+func (dpif *Dpif) CreateDatapathWithFeatures(name string, features DatapathFeatures) (DatapathHandle, error) {
 	req := NewNlMsgBuilder(RequestFlags, dpif.families[DATAPATH].id)
 	req.PutGenlMsghdr(OVS_DP_CMD_NEW, OVS_DATAPATH_VERSION)
-	req.putOvsHeader(0)
+	req.PutOvsHeader(0)
 	req.PutStringAttr(OVS_DP_ATTR_NAME, name)
 	req.PutUint32Attr(OVS_DP_ATTR_UPCALL_PID, 0)
-	req.PutUint32Attr(OVS_DP_ATTR_USER_FEATURES, features)
+	req.PutUint32Attr(OVS_DP_ATTR_USER_FEATURES, uint32(features))
 
 	resp, err := dpif.sock.Request(req)
 	if err != nil {
@@ -64,13 +117,13 @@ func (dpif *Dpif) CreateDatapath(name string) (DatapathHandle, error) {
 }
 
 func IsDatapathNameAlreadyExistsError(err error) bool {
-	return err == NetlinkError(syscall.EEXIST)
+	return isNetlinkError(err, syscall.EEXIST)
 }
 
 func (dpif *Dpif) LookupDatapath(name string) (DatapathHandle, error) {
 	req := NewNlMsgBuilder(RequestFlags, dpif.families[DATAPATH].id)
 	req.PutGenlMsghdr(OVS_DP_CMD_GET, OVS_DATAPATH_VERSION)
-	req.putOvsHeader(0)
+	req.PutOvsHeader(0)
 	req.PutStringAttr(OVS_DP_ATTR_NAME, name)
 
 	resp, err := dpif.sock.Request(req)
@@ -87,14 +140,15 @@ func (dpif *Dpif) LookupDatapath(name string) (DatapathHandle, error) {
 }
 
 type Datapath struct {
-	Handle DatapathHandle
-	Name   string
+	Handle   DatapathHandle
+	Name     string
+	Features DatapathFeatures
 }
 
 func (dpif *Dpif) LookupDatapathByIndex(ifindex int32) (Datapath, error) {
 	req := NewNlMsgBuilder(RequestFlags, dpif.families[DATAPATH].id)
 	req.PutGenlMsghdr(OVS_DP_CMD_GET, OVS_DATAPATH_VERSION)
-	req.putOvsHeader(ifindex)
+	req.PutOvsHeader(ifindex)
 
 	resp, err := dpif.sock.Request(req)
 	if err != nil {
@@ -107,28 +161,48 @@ func (dpif *Dpif) LookupDatapathByIndex(ifindex int32) (Datapath, error) {
 	}
 
 	return Datapath{
-		Handle: DatapathHandle{dpif: dpif, ifindex: ifindex},
-		Name:   dpi.name,
+		Handle:   DatapathHandle{dpif: dpif, ifindex: ifindex},
+		Name:     dpi.name,
+		Features: dpi.features,
 	}, nil
 }
 
 func IsNoSuchDatapathError(err error) bool {
-	return err == NetlinkError(syscall.ENODEV)
+	return isNetlinkError(err, syscall.ENODEV)
 }
 
 func (dpif *Dpif) EnumerateDatapaths() (map[string]DatapathHandle, error) {
+	dps, err := dpif.ListDatapaths()
+	if err != nil {
+		return nil, err
+	}
+
 	res := make(map[string]DatapathHandle)
+	for _, dp := range dps {
+		res[dp.Name] = dp.Handle
+	}
+
+	return res, nil
+}
+
+// Like EnumerateDatapaths, but also giving the datapaths' features.
+func (dpif *Dpif) ListDatapaths() ([]Datapath, error) {
+	var res []Datapath
 
 	req := NewNlMsgBuilder(DumpFlags, dpif.families[DATAPATH].id)
 	req.PutGenlMsghdr(OVS_DP_CMD_GET, OVS_DATAPATH_VERSION)
-	req.putOvsHeader(0)
+	req.PutOvsHeader(0)
 
 	consumer := func(resp *NlMsgParser) error {
 		dpi, err := dpif.parseDatapathInfo(resp)
 		if err != nil {
 			return err
 		}
-		res[dpi.name] = DatapathHandle{dpif: dpif, ifindex: dpi.ifindex}
+		res = append(res, Datapath{
+			Handle:   DatapathHandle{dpif: dpif, ifindex: dpi.ifindex},
+			Name:     dpi.name,
+			Features: dpi.features,
+		})
 		return nil
 	}
 
@@ -141,11 +215,11 @@ func (dpif *Dpif) EnumerateDatapaths() (map[string]DatapathHandle, error) {
 }
 
 func (dp DatapathHandle) Delete() error {
-	req := NewNlMsgBuilder(RequestFlags, dp.dpif.families[DATAPATH].id)
+	req := NewNlMsgBuilder(AckFlags, dp.dpif.families[DATAPATH].id)
 	req.PutGenlMsghdr(OVS_DP_CMD_DEL, OVS_DATAPATH_VERSION)
-	req.putOvsHeader(dp.ifindex)
+	req.PutOvsHeader(dp.ifindex)
 
-	_, err := dp.dpif.sock.Request(req)
+	err := dp.dpif.sock.RequestAck(req)
 	if err != nil {
 		return err
 	}
@@ -155,6 +229,93 @@ func (dp DatapathHandle) Delete() error {
 	return nil
 }
 
+// Delete a datapath by name, without needing to look it up first.
+// Deletion by ifindex is DatapathHandle.Delete.
+func (dpif *Dpif) DeleteDatapath(name string) error {
+	req := NewNlMsgBuilder(AckFlags, dpif.families[DATAPATH].id)
+	req.PutGenlMsghdr(OVS_DP_CMD_DEL, OVS_DATAPATH_VERSION)
+	req.PutOvsHeader(0)
+	req.PutStringAttr(OVS_DP_ATTR_NAME, name)
+
+	return dpif.sock.RequestAck(req)
+}
+
+type DatapathStats struct {
+	Hit    uint64
+	Missed uint64
+	Lost   uint64
+	Flows  uint64
+
+	// Megaflow stats
+	MaskHit  uint64
+	Masks    uint32
+	CacheHit uint64
+}
+
+// Get a stats struct attribute.  Kernels have extended these structs
+// over time, so a blob shorter than expected is zero-filled.
+func getStatsBytes(attrs Attrs, typ uint16, size int) ([]byte, error) {
+	val, err := attrs.Get(typ, true)
+	if err != nil || val == nil {
+		return nil, err
+	}
+
+	res := MakeAlignedByteSlice(size)
+	copy(res, val)
+	return res, nil
+}
+
+func parseDatapathStats(attrs Attrs) (res DatapathStats, err error) {
+	statsBytes, err := getStatsBytes(attrs, OVS_DP_ATTR_STATS, SizeofOvsDpStats)
+	if err != nil {
+		return
+	}
+
+	if statsBytes != nil {
+		stats := ovsDpStatsAt(statsBytes, 0)
+		res.Hit = stats.NHit
+		res.Missed = stats.NMissed
+		res.Lost = stats.NLost
+		res.Flows = stats.NFlows
+	}
+
+	mfStatsBytes, err := getStatsBytes(attrs, OVS_DP_ATTR_MEGAFLOW_STATS, SizeofOvsDpMegaflowStats)
+	if err != nil {
+		return
+	}
+
+	if mfStatsBytes != nil {
+		mfStats := ovsDpMegaflowStatsAt(mfStatsBytes, 0)
+		res.MaskHit = mfStats.NMaskHit
+		res.Masks = mfStats.NMasks
+		res.CacheHit = mfStats.NCacheHit
+	}
+
+	return
+}
+
+func (dp DatapathHandle) Stats() (DatapathStats, error) {
+	req := NewNlMsgBuilder(RequestFlags, dp.dpif.families[DATAPATH].id)
+	req.PutGenlMsghdr(OVS_DP_CMD_GET, OVS_DATAPATH_VERSION)
+	req.PutOvsHeader(dp.ifindex)
+
+	resp, err := dp.dpif.sock.Request(req)
+	if err != nil {
+		return DatapathStats{}, err
+	}
+
+	if err := dp.checkNlMsgHeaders(resp, DATAPATH, OVS_DP_CMD_NEW); err != nil {
+		return DatapathStats{}, err
+	}
+
+	attrs, err := resp.TakeAttrs()
+	if err != nil {
+		return DatapathStats{}, err
+	}
+
+	return parseDatapathStats(attrs)
+}
+
 func (dp DatapathHandle) checkNlMsgHeaders(msg *NlMsgParser, family int, cmd int) error {
 	_, ovshdr, err := dp.dpif.checkNlMsgHeaders(msg, family, cmd)
 	if err != nil {
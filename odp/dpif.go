@@ -39,13 +39,28 @@ func IsKernelLacksODPError(err error) bool {
 	return ok
 }
 
+type familyVersionError struct {
+	family   string
+	version  uint32
+	required uint32
+}
+
+func (fve familyVersionError) Error() string {
+	return fmt.Sprintf("Generic netlink family '%s' has version %d, but version %d is required; the Open vSwitch kernel module is too old", fve.family, fve.version, fve.required)
+}
+
+func IsFamilyVersionError(err error) bool {
+	_, ok := err.(familyVersionError)
+	return ok
+}
+
 func lookupFamily(sock *NetlinkSocket, name string) (GenlFamily, error) {
 	family, err := sock.LookupGenlFamily(name)
 	if err == nil {
 		return family, nil
 	}
 
-	if err == NetlinkError(syscall.ENOENT) {
+	if isNetlinkError(err, syscall.ENOENT) {
 		loadOpenvswitchModule()
 
 		// The module might be loaded now, so try again
@@ -54,7 +69,7 @@ func lookupFamily(sock *NetlinkSocket, name string) (GenlFamily, error) {
 			return family, nil
 		}
 
-		if err == NetlinkError(syscall.ENOENT) {
+		if isNetlinkError(err, syscall.ENOENT) {
 			err = familyUnavailableError{name}
 		}
 	}
@@ -127,18 +142,57 @@ func (dpif *Dpif) getMCGroup(family int, name string) (uint32, error) {
 	return mcGroup, nil
 }
 
+// The netlink port id of the Dpif's socket.  Notifications about
+// changes made through the Dpif carry this port id.
+func (dpif *Dpif) PortId() uint32 {
+	return dpif.sock.PortId()
+}
+
+// The counters of the Dpif's netlink socket.  Upcalls are received
+// on a separate socket; see MissConsumerHandle for its counters.
+func (dpif *Dpif) SocketStats() SocketStats {
+	return dpif.sock.Stats()
+}
+
+// The kernel's version of one of the OVS genl families (DATAPATH,
+// VPORT, FLOW or PACKET).  0 if the kernel didn't report it.
+func (dpif *Dpif) FamilyVersion(family int) (uint32, error) {
+	if family < 0 || family >= FAMILY_COUNT {
+		return 0, fmt.Errorf("unknown OVS genl family %d", family)
+	}
+
+	return dpif.families[family].version, nil
+}
+
+// Check that the kernel's version of an OVS genl family is at least
+// min, e.g. before using a feature that arrived in that version.
+func (dpif *Dpif) RequireFamilyVersion(family int, min uint32) error {
+	version, err := dpif.FamilyVersion(family)
+	if err != nil {
+		return err
+	}
+
+	if version < min {
+		return familyVersionError{familyNames[family], version, min}
+	}
+
+	return nil
+}
+
 func (dpif *Dpif) Close() error {
 	return dpif.sock.Close()
 }
 
-func (nlmsg *NlMsgBuilder) putOvsHeader(ifindex int32) {
-	pos := nlmsg.AlignGrow(syscall.NLMSG_ALIGNTO, SizeofOvsHeader)
+// Every message to and from the OVS genl families carries an
+// ovs_header, holding the datapath's ifindex, after the genlmsghdr.
+func (nlmsg *NlMsgBuilder) PutOvsHeader(ifindex int32) {
+	pos := nlmsg.nlmsgAlignGrow(SizeofOvsHeader)
 	h := ovsHeaderAt(nlmsg.buf, pos)
 	h.DpIfIndex = ifindex
 }
 
 func (nlmsg *NlMsgParser) takeOvsHeader() (*OvsHeader, error) {
-	pos, err := nlmsg.AlignAdvance(syscall.NLMSG_ALIGNTO, SizeofOvsHeader)
+	pos, err := nlmsg.nlmsgAlignAdvance(SizeofOvsHeader)
 	if err != nil {
 		return nil, err
 	}
@@ -146,12 +200,18 @@ func (nlmsg *NlMsgParser) takeOvsHeader() (*OvsHeader, error) {
 	return ovsHeaderAt(nlmsg.data, pos), nil
 }
 
-func (dpif *Dpif) checkNlMsgHeaders(msg *NlMsgParser, family int, cmd int) (*GenlMsghdr, *OvsHeader, error) {
-	if _, err := msg.ExpectNlMsghdr(dpif.families[family].id); err != nil {
-		return nil, nil, err
+// Take the ovs_header, returning the datapath ifindex from it.
+func (nlmsg *NlMsgParser) TakeOvsHeader() (int32, error) {
+	h, err := nlmsg.takeOvsHeader()
+	if err != nil {
+		return 0, err
 	}
 
-	genlhdr, err := msg.CheckGenlMsghdr(cmd)
+	return h.DpIfIndex, nil
+}
+
+func (dpif *Dpif) checkNlMsgHeaders(msg *NlMsgParser, family int, cmd int) (*GenlMsghdr, *OvsHeader, error) {
+	genlhdr, err := msg.ExpectGenlResponse(dpif.families[family].id, cmd)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -168,6 +228,15 @@ type Cancelable interface {
 	Cancel() error
 }
 
+// The handle returned by ConsumeMisses.  Cancel stops consuming
+// upcalls.  SocketStats gives the counters of the socket the upcalls
+// arrive on; its Overruns counts the times the kernel dropped upcalls
+// because the socket's receive buffer was full.
+type MissConsumerHandle interface {
+	Cancelable
+	SocketStats() SocketStats
+}
+
 type cancelableDpif struct {
 	*Dpif
 }
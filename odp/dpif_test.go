@@ -33,12 +33,126 @@ func TestCreateDatapath(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	stats, err := dp.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Flows != 0 {
+		t.Fatal("new datapath has flows", stats)
+	}
+
 	err = dp.Delete()
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
+func TestOvsHeader(t *testing.T) {
+	req := NewNlMsgBuilder(RequestFlags, 0)
+	req.PutGenlMsghdr(OVS_DP_CMD_GET, OVS_DATAPATH_VERSION)
+	req.PutOvsHeader(42)
+	data, _ := req.Finish()
+
+	msg := &NlMsgParser{data: data, pos: syscall.NLMSG_HDRLEN}
+	if _, err := msg.CheckGenlMsghdr(OVS_DP_CMD_GET); err != nil {
+		t.Fatal(err)
+	}
+
+	ifindex, err := msg.TakeOvsHeader()
+	if err != nil || ifindex != 42 {
+		t.Fatal(ifindex, err)
+	}
+
+	if _, err := msg.TakeOvsHeader(); !IsTruncationError(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestParseDatapathInfo(t *testing.T) {
+	req := NewNlMsgBuilder(RequestFlags, 0)
+	req.PutGenlMsghdr(OVS_DP_CMD_NEW, OVS_DATAPATH_VERSION)
+	req.PutOvsHeader(7)
+	req.PutStringAttr(OVS_DP_ATTR_NAME, "dp")
+	req.PutUint32Attr(OVS_DP_ATTR_USER_FEATURES, OVS_DP_F_UNALIGNED|OVS_DP_F_TC_RECIRC_SHARING)
+	data, _ := req.Finish()
+
+	dpi, err := (&Dpif{}).parseDatapathInfo(&NlMsgParser{data: data, pos: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dpi.ifindex != 7 || dpi.name != "dp" || !dpi.features.Has(OVS_DP_F_UNALIGNED) || dpi.features.Has(OVS_DP_F_VPORT_PIDS) {
+		t.Fatal(dpi)
+	}
+
+	if s := dpi.features.String(); s != "unaligned|tc_recirc_sharing" {
+		t.Fatal(s)
+	}
+
+	if s := (DefaultDatapathFeatures | 0x100).String(); s != "unaligned|vport_pids|0x100" {
+		t.Fatal(s)
+	}
+}
+
+func TestParseDatapathStats(t *testing.T) {
+	req := NewNlMsgBuilder(RequestFlags, 0)
+	req.PutSliceAttr(OVS_DP_ATTR_STATS, []byte{1, 0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0})
+	// A megaflow stats struct from a kernel lacking n_cache_hit
+	req.PutSliceAttr(OVS_DP_ATTR_MEGAFLOW_STATS, []byte{5, 0, 0, 0, 0, 0, 0, 0, 6, 0, 0, 0, 0, 0, 0, 0})
+	data, _ := req.Finish()
+
+	attrs, err := ParseNestedAttrs(data[syscall.NLMSG_HDRLEN:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := parseDatapathStats(attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := DatapathStats{Hit: 1, Missed: 2, Lost: 3, Flows: 4, MaskHit: 5, Masks: 6}
+	if stats != expect {
+		t.Fatal(stats)
+	}
+}
+
+func TestCreateDatapathWithFeatures(t *testing.T) {
+	dpif, err := NewDpif()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedCloseDpif(dpif, t)
+
+	name := fmt.Sprintf("test%d", rand.Intn(100000))
+
+	dp, err := dpif.CreateDatapathWithFeatures(name, OVS_DP_F_UNALIGNED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dp.Delete()
+
+	dps, err := dpif.ListDatapaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, d := range dps {
+		if d.Name == name {
+			found = true
+			if !d.Features.Has(OVS_DP_F_UNALIGNED) || d.Features.Has(OVS_DP_F_VPORT_PIDS) {
+				t.Fatal(d.Features)
+			}
+		}
+	}
+
+	if !found {
+		t.Fatal("datapath not listed", dps)
+	}
+}
+
 func TestLookupDatapath(t *testing.T) {
 	dpif, err := NewDpif()
 	if err != nil {
@@ -75,6 +189,50 @@ func TestLookupDatapath(t *testing.T) {
 	}
 }
 
+func TestDeleteDatapath(t *testing.T) {
+	dpif, err := NewDpif()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedCloseDpif(dpif, t)
+
+	name := fmt.Sprintf("test%d", rand.Intn(100000))
+	_, err = dpif.CreateDatapath(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dpif.DeleteDatapath(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = dpif.LookupDatapath(name)
+	if !IsNoSuchDatapathError(err) {
+		t.Fatal(err)
+	}
+
+	err = dpif.DeleteDatapath(name)
+	if !IsNoSuchDatapathError(err) {
+		t.Fatal(err)
+	}
+
+	dp, err := dpif.CreateDatapath(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dp.Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dp.Delete()
+	if !IsNoSuchDatapathError(err) {
+		t.Fatal(err)
+	}
+}
+
 func TestEnumerateDatapaths(t *testing.T) {
 	dpif, err := NewDpif()
 	if err != nil {
@@ -160,6 +318,178 @@ func TestCreateVport(t *testing.T) {
 	}
 }
 
+func TestUpcallPortIdsAttr(t *testing.T) {
+	req := NewNlMsgBuilder(RequestFlags, 0)
+	putUpcallPortIds(req, []uint32{1, 2, 3})
+	data, _ := req.Finish()
+
+	attrs, err := ParseNestedAttrs(data[syscall.NLMSG_HDRLEN:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	val := attrs[OVS_VPORT_ATTR_UPCALL_PID]
+	if len(val) != 12 {
+		t.Fatal(val)
+	}
+
+	for i := 0; i < 3; i++ {
+		if *uint32At(val, i*4) != uint32(i+1) {
+			t.Fatal(val)
+		}
+	}
+}
+
+func TestVportType(t *testing.T) {
+	for _, name := range []string{"netdev", "internal", "gre", "vxlan", "geneve", "lisp", "stt"} {
+		typ, err := ParseVportType(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if typ.String() != name {
+			t.Fatal(typ, name)
+		}
+	}
+
+	if typ, _ := ParseVportType("vxlan"); typ != OVS_VPORT_TYPE_VXLAN {
+		t.Fatal(typ)
+	}
+
+	if _, err := ParseVportType("bogus"); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if s := VportType(42).String(); s != "VportType(42)" {
+		t.Fatal(s)
+	}
+
+	for _, spec := range []VportSpec{
+		NewNetdevVportSpec("a"),
+		NewInternalVportSpec("a"),
+		NewGreVportSpec("a"),
+		NewVxlanVportSpec("a", 4789),
+		NewGeneveVportSpec("a", 6081),
+	} {
+		if spec.TypeName() != VportType(spec.typeId()).String() {
+			t.Fatal(spec.TypeName())
+		}
+	}
+}
+
+func TestTunnelVportOptions(t *testing.T) {
+	for _, spec := range []VportSpec{
+		NewVxlanVportSpec("vx", 4789),
+		NewGeneveVportSpec("gnv", 6081),
+	} {
+		req := NewNlMsgBuilder(RequestFlags, 0)
+		req.PutUint32Attr(OVS_VPORT_ATTR_PORT_NO, 3)
+		req.PutUint32Attr(OVS_VPORT_ATTR_TYPE, spec.typeId())
+		req.PutStringAttr(OVS_VPORT_ATTR_NAME, spec.Name())
+		req.PutNestedAttrs(OVS_VPORT_ATTR_OPTIONS, func() {
+			spec.optionNlAttrs(req)
+		})
+		data, _ := req.Finish()
+
+		vport, err := parseVport(&NlMsgParser{data: data, pos: syscall.NLMSG_HDRLEN})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if vport.ID != 3 || vport.Spec != spec {
+			t.Fatal(vport)
+		}
+	}
+}
+
+func TestSentByPortId(t *testing.T) {
+	req := NewNlMsgBuilder(RequestFlags, 0)
+	nlMsghdrAt(req.buf, 0).Pid = 42
+	data, _ := req.Finish()
+	msg := &NlMsgParser{data: data, pos: 0}
+
+	if sentByPortId(msg, nil) || sentByPortId(msg, []uint32{1, 2}) {
+		t.Fatal("unexpected match")
+	}
+
+	if !sentByPortId(msg, []uint32{1, 42}) {
+		t.Fatal("expected match")
+	}
+}
+
+func TestDeleteVport(t *testing.T) {
+	dpif, err := NewDpif()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedCloseDpif(dpif, t)
+
+	dp, err := dpif.CreateDatapath(fmt.Sprintf("test%d", rand.Intn(100000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedDeleteDatapath(dp, t)
+
+	name := fmt.Sprintf("test%d", rand.Intn(100000))
+	id, err := dp.CreateVport(NewInternalVportSpec(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dp.DeleteVportByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vports, err := dp.EnumerateVports()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, vport := range vports {
+		if vport.ID == id || vport.Spec.Name() == name {
+			t.Fatal("deleted vport still present", vport)
+		}
+	}
+
+	err = dp.DeleteVportByName(name)
+	if !IsNoSuchVportError(err) {
+		t.Fatal(err)
+	}
+
+	err = dp.DeleteVport(id)
+	if !IsNoSuchVportError(err) {
+		t.Fatal(err)
+	}
+
+	// Vports from the datapath can delete themselves
+	if _, err := dp.CreateVport(NewInternalVportSpec(name)); err != nil {
+		t.Fatal(err)
+	}
+
+	vport, err := dp.LookupVportByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vport.Delete(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := dp.LookupVportByName(name); !IsNoSuchVportError(err) {
+		t.Fatal(err)
+	}
+
+	if err := vport.Delete(); !IsNoSuchVportError(err) {
+		t.Fatal(err)
+	}
+
+	orphan := Vport{Spec: NewInternalVportSpec(name)}
+	if err := orphan.Delete(); err == nil {
+		t.Fatal("vport without a datapath deleted")
+	}
+}
+
 func TestLookupVport(t *testing.T) {
 	dpif, err := NewDpif()
 	if err != nil {
@@ -304,22 +634,101 @@ func TestCreateFlow(t *testing.T) {
 	f.AddKey(fk)
 	f.AddAction(NewOutputAction(vport))
 
-	err = dp.CreateFlow(f)
+	echo, err := dp.CreateFlowEcho(f)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	if !echo.FlowSpec.Equals(f) {
+		t.Fatal("echoed flow differs", echo.FlowSpec, f)
+	}
+
+	f.Actions = nil
+	f.AddAction(NewOutputAction(vport + 1))
+	echo, err = dp.SetFlow(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !echo.FlowSpec.Equals(f) {
+		t.Fatal("echoed flow differs", echo.FlowSpec, f)
+	}
+
 	err = dp.DeleteFlow(f.FlowKeys)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	flows, err := dp.EnumerateFlows()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, flow := range flows {
+		if flow.FlowKeys.Equals(f.FlowKeys) {
+			t.Fatal("deleted flow still present", flow)
+		}
+	}
+
 	err = dp.DeleteFlow(f.FlowKeys)
 	if !IsNoSuchFlowError(err) {
 		t.Fatal()
 	}
 }
 
+func TestGetFlowStats(t *testing.T) {
+	dpif, err := NewDpif()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedCloseDpif(dpif, t)
+
+	dp, err := dpif.CreateDatapath(fmt.Sprintf("test%d", rand.Intn(100000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedDeleteDatapath(dp, t)
+
+	vpname := fmt.Sprintf("test%d", rand.Intn(100000))
+	vport, err := dp.CreateVport(NewInternalVportSpec(vpname))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewFlowSpec()
+	fk := NewEthernetFlowKey()
+	fk.SetEthSrc([...]byte{1, 2, 3, 4, 5, 6})
+	fk.SetEthDst([...]byte{6, 5, 4, 3, 2, 1})
+	f.AddKey(fk)
+	f.AddAction(NewOutputAction(vport))
+
+	err = dp.CreateFlow(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, clear := range []bool{false, true} {
+		fi, err := dp.GetFlowStats(f.FlowKeys, clear)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !fi.FlowKeys.Equals(f.FlowKeys) || fi.Packets != 0 {
+			t.Fatal(fi)
+		}
+	}
+
+	err = dp.DeleteFlow(f.FlowKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = dp.GetFlowStats(f.FlowKeys, false)
+	if !IsNoSuchFlowError(err) {
+		t.Fatal(err)
+	}
+}
+
 func TestEnumerateFlows(t *testing.T) {
 	dpif, err := NewDpif()
 	if err != nil {
@@ -380,7 +789,7 @@ func TestEnumerateFlows(t *testing.T) {
 		}
 	}
 
-	for _, eflow := range eflows {
+	for _, eflow := range eflows[:n/2] {
 		err = dp.DeleteFlow(eflow.FlowKeys)
 		if err != nil {
 			t.Fatal(err)
@@ -392,6 +801,20 @@ func TestEnumerateFlows(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	if len(eflows) != n-n/2 {
+		t.Fatal()
+	}
+
+	err = dp.FlushFlows()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eflows, err = dp.EnumerateFlows()
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	if len(eflows) != 0 {
 		t.Fatal()
 	}
@@ -420,6 +843,43 @@ func TestConsumeVportEvents(t *testing.T) {
 	}
 }
 
+func TestConsumeFlowEvents(t *testing.T) {
+	dpif, err := NewDpif()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan error)
+	cancel, err := dpif.ConsumeFlowEvents(flowTestConsumer{ch}, dpif.PortId())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cancel.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+
+	if <-ch != syscall.EBADF {
+		t.Fatal()
+	}
+}
+
+type flowTestConsumer struct {
+	ch chan error
+}
+
+func (flowTestConsumer) FlowChanged(ifindex int32, flow FlowInfo) error {
+	return nil
+}
+
+func (flowTestConsumer) FlowDeleted(ifindex int32, flow FlowInfo) error {
+	return nil
+}
+
+func (consumer flowTestConsumer) Error(err error, stopped bool) {
+	consumer.ch <- err
+}
+
 type vportTestConsumer struct {
 	ch chan error
 }
@@ -435,3 +895,87 @@ func (vportTestConsumer) VportDeleted(ifindex int32, vport Vport) error {
 func (consumer vportTestConsumer) Error(err error, stopped bool) {
 	consumer.ch <- err
 }
+
+func benchmarkFlows(n int, vport VportID) []FlowSpec {
+	flows := make([]FlowSpec, n)
+	for i := range flows {
+		flow := NewFlowSpec()
+		fk := NewEthernetFlowKey()
+		fk.SetEthSrc([...]byte{1, 2, 3, 4, byte(i >> 8), byte(i)})
+		fk.SetEthDst([...]byte{6, 5, 4, 3, 2, 1})
+		flow.AddKey(fk)
+		flow.AddAction(NewOutputAction(vport))
+		flows[i] = flow
+	}
+	return flows
+}
+
+func benchmarkCreateFlows(b *testing.B, create func(DatapathHandle, []FlowSpec) error) {
+	dpif, err := NewDpif()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer dpif.Close()
+
+	dp, err := dpif.CreateDatapath(fmt.Sprintf("test%d", rand.Intn(100000)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer dp.Delete()
+
+	vport, err := dp.CreateVport(NewInternalVportSpec(fmt.Sprintf("test%d", rand.Intn(100000))))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	flows := benchmarkFlows(10000, vport)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := create(dp, flows); err != nil {
+			b.Fatal(err)
+		}
+
+		b.StopTimer()
+		if err := dp.FlushFlows(); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+	}
+}
+
+func BenchmarkCreateFlow(b *testing.B) {
+	benchmarkCreateFlows(b, func(dp DatapathHandle, flows []FlowSpec) error {
+		for _, flow := range flows {
+			if err := dp.CreateFlow(flow); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func BenchmarkCreateFlows(b *testing.B) {
+	benchmarkCreateFlows(b, DatapathHandle.CreateFlows)
+}
+
+func TestRequireFamilyVersion(t *testing.T) {
+	dpif := &Dpif{}
+	dpif.families[FLOW].version = OVS_FLOW_VERSION
+
+	if err := dpif.RequireFamilyVersion(FLOW, OVS_FLOW_VERSION); err != nil {
+		t.Fatal(err)
+	}
+
+	err := dpif.RequireFamilyVersion(FLOW, OVS_FLOW_VERSION+1)
+	if !IsFamilyVersionError(err) {
+		t.Fatal(err)
+	}
+
+	if _, err := dpif.FamilyVersion(FAMILY_COUNT); err == nil {
+		t.Fatal("out of range family accepted")
+	}
+
+	if err := dpif.RequireFamilyVersion(-1, 0); err == nil || IsFamilyVersionError(err) {
+		t.Fatal(err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"syscall"
+	"time"
 )
 
 func AllBytes(data []byte, x byte) bool {
@@ -177,6 +178,12 @@ func NewBlobFlowKey(typ uint16, size int) BlobFlowKey {
 	return BlobFlowKey{typ: typ, keyMask: km}
 }
 
+// Unlike NewBlobFlowKey, the mask starts out as all zeros, so the
+// flow key is Ignored until some of it is set.
+func newWildcardBlobFlowKey(typ uint16, size int) BlobFlowKey {
+	return BlobFlowKey{typ: typ, keyMask: MakeAlignedByteSlice(size * 2)}
+}
+
 func (key BlobFlowKey) String() string {
 	return fmt.Sprintf("BlobFlowKey{type: %d, key: %s, mask: %s}", key.typ,
 		hex.EncodeToString(key.key()), hex.EncodeToString(key.mask()))
@@ -206,6 +213,28 @@ func (key BlobFlowKey) Ignored() bool {
 	return AllBytes(key.mask(), 0)
 }
 
+// The mask of a flow key says which bits of the key are matched (the
+// 1 bits).  Individual fields can be wildcarded with the SetMasked
+// methods of the flow key types; these apply to the whole flow key.
+
+func (key BlobFlowKey) ExactMatch() bool {
+	return AllBytes(key.mask(), 0xff)
+}
+
+func (key *BlobFlowKey) SetExactMatch() {
+	mask := key.mask()
+	for i := range mask {
+		mask[i] = 0xff
+	}
+}
+
+// Wildcard the whole flow key, so that it is Ignored.
+func (key *BlobFlowKey) SetWildcard() {
+	for i := range key.keyMask {
+		key.keyMask[i] = 0
+	}
+}
+
 // Go's anonymous struct fields are not quite a replacement for
 // inheritance.  We want to have an Equals method for BlobFlowKeys,
 // that works even when BlobFlowKeys are embedded as anonymous struct
@@ -422,621 +451,2271 @@ func printMaskedBytes(buf *bytes.Buffer, sep *string, n string, k, m []byte,
 	}
 }
 
+func printMaskedUint8(buf *bytes.Buffer, sep *string, n string, k, m uint8) {
+	if m != 0 {
+		fmt.Fprintf(buf, "%s%s: %d", *sep, n, k)
+		if m != 0xff {
+			fmt.Fprintf(buf, "&%x", m)
+		}
+		*sep = ", "
+	}
+}
+
+func printMaskedUint16(buf *bytes.Buffer, sep *string, n string, k, m uint16) {
+	if m != 0 {
+		fmt.Fprintf(buf, "%s%s: %d", *sep, n, k)
+		if m != 0xffff {
+			fmt.Fprintf(buf, "&%x", m)
+		}
+		*sep = ", "
+	}
+}
+
 var ethernetFlowKeyParser = blobFlowKeyParser(SizeofOvsKeyEthernet,
 	func(fk BlobFlowKey) FlowKey { return EthernetFlowKey{fk} })
 
-// OVS_KEY_ATTR_TUNNEL: Tunnel flow key.  This is more elaborate than
-// other flow keys because it consists of a set of attributes.
+// OVS_KEY_ATTR_ETHERTYPE: Ethernet type flow key.  This is in
+// network byte order.
 
-type TunnelAttrs struct {
-	TunnelId [8]byte
-	Ipv4Src  [4]byte
-	Ipv4Dst  [4]byte
-	Tos      uint8
-	Ttl      uint8
-	Df       bool
-	Csum     bool
-	TpSrc    uint16
-	TpDst    uint16
+type EtherTypeFlowKey struct {
+	BlobFlowKey
 }
 
-type TunnelAttrsPresence struct {
-	TunnelId bool
-	Ipv4Src  bool
-	Ipv4Dst  bool
-	Tos      bool
-	Ttl      bool
-	Df       bool
-	Csum     bool
-	TpSrc    bool
-	TpDst    bool
+func NewEtherTypeFlowKey() EtherTypeFlowKey {
+	return EtherTypeFlowKey{newWildcardBlobFlowKey(OVS_KEY_ATTR_ETHERTYPE, 2)}
 }
 
-// Extract presence information from a TunnelAttrs mask
-func (ta TunnelAttrs) present() TunnelAttrsPresence {
-	// The kernel requires Ipv4Dst and Ttl to be present, so we
-	// always mark those as present, even if we end up wildcarding
-	// them.
-	return TunnelAttrsPresence{
-		TunnelId: !AllBytes(ta.TunnelId[:], 0),
-		Ipv4Src:  !AllBytes(ta.Ipv4Src[:], 0),
-		Ipv4Dst:  true,
-		Tos:      ta.Tos != 0,
-		Ttl:      true,
-		Df:       ta.Df,
-		Csum:     ta.Csum,
-		TpSrc:    ta.TpSrc != 0,
-		TpDst:    ta.TpDst != 0,
-	}
+func (fk EtherTypeFlowKey) EtherType() uint16 {
+	return uint16FromBE(*uint16At(fk.key(), 0))
 }
 
-// Convert a TunnelAttrsPresence to a mask
-func (tap TunnelAttrsPresence) mask() (res TunnelAttrs) {
-	if tap.TunnelId {
-		res.TunnelId = [8]byte{
-			0xff, 0xff, 0xff, 0xff,
-			0xff, 0xff, 0xff, 0xff,
-		}
-	}
+func (fk EtherTypeFlowKey) EtherTypeMask() uint16 {
+	return uint16FromBE(*uint16At(fk.mask(), 0))
+}
 
-	if tap.Ipv4Src {
-		res.Ipv4Src = [4]byte{0xff, 0xff, 0xff, 0xff}
-	}
+func (fk *EtherTypeFlowKey) SetMaskedEtherType(ethType uint16, mask uint16) {
+	*uint16At(fk.key(), 0) = uint16ToBE(ethType)
+	*uint16At(fk.mask(), 0) = uint16ToBE(mask)
+}
 
-	if tap.Ipv4Dst {
-		res.Ipv4Dst = [4]byte{0xff, 0xff, 0xff, 0xff}
-	}
+func (fk *EtherTypeFlowKey) SetEtherType(ethType uint16) {
+	fk.SetMaskedEtherType(ethType, 0xffff)
+}
 
-	if tap.Tos {
-		res.Tos = 0xff
-	}
+func (fk EtherTypeFlowKey) String() string {
+	var buf bytes.Buffer
+	var sep string
+	fmt.Fprint(&buf, "EtherTypeFlowKey{")
+	printMaskedUint16(&buf, &sep, "type", fk.EtherType(), fk.EtherTypeMask())
+	fmt.Fprint(&buf, "}")
+	return buf.String()
+}
 
-	if tap.Ttl {
-		res.Ttl = 0xff
-	}
+var etherTypeFlowKeyParser = blobFlowKeyParser(2,
+	func(fk BlobFlowKey) FlowKey { return EtherTypeFlowKey{fk} })
 
-	res.Df = tap.Df
-	res.Csum = tap.Csum
+// OVS_KEY_ATTR_IPV4: IPv4 header flow key.  The kernel requires an
+// exact match of the ethertype key to 0x0800 alongside this.
 
-	if tap.TpSrc {
-		res.TpSrc = 0xffff
-	}
+type IPv4FlowKey struct {
+	BlobFlowKey
+}
 
-	if tap.TpDst {
-		res.TpDst = 0xffff
-	}
+// The fields of a new IPv4FlowKey are wildcarded until they are set.
+func NewIPv4FlowKey() IPv4FlowKey {
+	return IPv4FlowKey{newWildcardBlobFlowKey(OVS_KEY_ATTR_IPV4, SizeofOvsKeyIPv4)}
+}
 
-	return
+func (fk *IPv4FlowKey) key() *OvsKeyIPv4 {
+	return ovsKeyIPv4At(fk.BlobFlowKey.key(), 0)
 }
 
-func (ta TunnelAttrs) toNlAttrs(msg *NlMsgBuilder, present TunnelAttrsPresence) {
-	if present.TunnelId {
-		msg.PutSliceAttr(OVS_TUNNEL_KEY_ATTR_ID, ta.TunnelId[:])
-	}
+func (fk *IPv4FlowKey) mask() *OvsKeyIPv4 {
+	return ovsKeyIPv4At(fk.BlobFlowKey.mask(), 0)
+}
 
-	if present.Ipv4Src {
-		msg.PutSliceAttr(OVS_TUNNEL_KEY_ATTR_IPV4_SRC, ta.Ipv4Src[:])
-	}
+func (fk IPv4FlowKey) Key() OvsKeyIPv4 {
+	return *fk.key()
+}
 
-	if present.Ipv4Dst {
-		msg.PutSliceAttr(OVS_TUNNEL_KEY_ATTR_IPV4_DST, ta.Ipv4Dst[:])
-	}
+func (fk IPv4FlowKey) Mask() OvsKeyIPv4 {
+	return *fk.mask()
+}
 
-	if present.Tos {
-		msg.PutUint8Attr(OVS_TUNNEL_KEY_ATTR_TOS, ta.Tos)
-	}
+func (fk *IPv4FlowKey) SetMaskedSrc(addr [4]byte, mask [4]byte) {
+	fk.key().Src = addr
+	fk.mask().Src = mask
+}
 
-	if present.Ttl {
-		msg.PutUint8Attr(OVS_TUNNEL_KEY_ATTR_TTL, ta.Ttl)
-	}
+func (fk *IPv4FlowKey) SetSrc(addr [4]byte) {
+	fk.SetMaskedSrc(addr, [...]byte{0xff, 0xff, 0xff, 0xff})
+}
 
-	if present.Df && ta.Df {
-		msg.PutEmptyAttr(OVS_TUNNEL_KEY_ATTR_DONT_FRAGMENT)
-	}
+func (fk *IPv4FlowKey) SetMaskedDst(addr [4]byte, mask [4]byte) {
+	fk.key().Dst = addr
+	fk.mask().Dst = mask
+}
 
-	if present.Csum && ta.Csum {
-		msg.PutEmptyAttr(OVS_TUNNEL_KEY_ATTR_CSUM)
-	}
+func (fk *IPv4FlowKey) SetDst(addr [4]byte) {
+	fk.SetMaskedDst(addr, [...]byte{0xff, 0xff, 0xff, 0xff})
+}
 
-	if present.TpSrc {
-		msg.PutUint16Attr(OVS_TUNNEL_KEY_ATTR_TP_SRC,
-			uint16ToBE(ta.TpSrc))
-	}
+func (fk *IPv4FlowKey) SetProto(proto uint8) {
+	fk.key().Proto = proto
+	fk.mask().Proto = 0xff
+}
 
-	if present.TpDst {
-		msg.PutUint16Attr(OVS_TUNNEL_KEY_ATTR_TP_DST,
-			uint16ToBE(ta.TpDst))
-	}
+func (fk *IPv4FlowKey) SetTos(tos uint8) {
+	fk.key().Tos = tos
+	fk.mask().Tos = 0xff
 }
 
-func parseTunnelAttrs(data []byte) (ta TunnelAttrs, present TunnelAttrsPresence, err error) {
-	attrs, err := ParseNestedAttrs(data)
-	if err != nil {
-		return
-	}
+func (fk *IPv4FlowKey) SetTtl(ttl uint8) {
+	fk.key().Ttl = ttl
+	fk.mask().Ttl = 0xff
+}
 
-	present.TunnelId, err = attrs.GetOptionalBytes(OVS_TUNNEL_KEY_ATTR_ID, ta.TunnelId[:])
-	if err != nil {
-		return
-	}
+func (fk IPv4FlowKey) String() string {
+	var buf bytes.Buffer
+	var sep string
+	fmt.Fprint(&buf, "IPv4FlowKey{")
+	k := fk.Key()
+	m := fk.Mask()
+	printMaskedBytes(&buf, &sep, "src", k.Src[:], m.Src[:], ipv4ToString)
+	printMaskedBytes(&buf, &sep, "dst", k.Dst[:], m.Dst[:], ipv4ToString)
+	printMaskedUint8(&buf, &sep, "proto", k.Proto, m.Proto)
+	printMaskedUint8(&buf, &sep, "tos", k.Tos, m.Tos)
+	printMaskedUint8(&buf, &sep, "ttl", k.Ttl, m.Ttl)
+	printMaskedUint8(&buf, &sep, "frag", k.Frag, m.Frag)
+	fmt.Fprint(&buf, "}")
+	return buf.String()
+}
 
-	present.Ipv4Src, err = attrs.GetOptionalBytes(OVS_TUNNEL_KEY_ATTR_IPV4_SRC, ta.Ipv4Src[:])
-	if err != nil {
-		return
-	}
+var ipv4FlowKeyParser = blobFlowKeyParser(SizeofOvsKeyIPv4,
+	func(fk BlobFlowKey) FlowKey { return IPv4FlowKey{fk} })
 
-	present.Ipv4Dst, err = attrs.GetOptionalBytes(OVS_TUNNEL_KEY_ATTR_IPV4_DST, ta.Ipv4Dst[:])
+// OVS_KEY_ATTR_TCP, OVS_KEY_ATTR_UDP and OVS_KEY_ATTR_SCTP: Transport
+// port flow keys.  These share a layout of source and destination
+// ports, in network byte order.  The kernel requires an exact match
+// of the IP protocol alongside them.
 
-	ta.Tos, present.Tos, err = attrs.GetOptionalUint8(OVS_TUNNEL_KEY_ATTR_TOS)
-	if err != nil {
-		return
-	}
+type TransportFlowKey struct {
+	BlobFlowKey
+}
 
-	ta.Ttl, present.Ttl, err = attrs.GetOptionalUint8(OVS_TUNNEL_KEY_ATTR_TTL)
-	if err != nil {
-		return
-	}
+// The ports of a new TransportFlowKey are wildcarded until they are
+// set.
+func NewTcpFlowKey() TransportFlowKey {
+	return TransportFlowKey{newWildcardBlobFlowKey(OVS_KEY_ATTR_TCP, 4)}
+}
 
-	ta.Df, err = attrs.GetEmpty(OVS_TUNNEL_KEY_ATTR_DONT_FRAGMENT)
-	present.Df = ta.Df
-	if err != nil {
-		return
-	}
+func NewUdpFlowKey() TransportFlowKey {
+	return TransportFlowKey{newWildcardBlobFlowKey(OVS_KEY_ATTR_UDP, 4)}
+}
 
-	ta.Csum, err = attrs.GetEmpty(OVS_TUNNEL_KEY_ATTR_CSUM)
-	present.Csum = ta.Csum
-	if err != nil {
-		return
-	}
+func NewSctpFlowKey() TransportFlowKey {
+	return TransportFlowKey{newWildcardBlobFlowKey(OVS_KEY_ATTR_SCTP, 4)}
+}
 
-	ta.TpSrc, present.TpSrc, err = attrs.GetOptionalUint16(OVS_TUNNEL_KEY_ATTR_TP_SRC)
-	if err != nil {
-		return
-	}
-	ta.TpSrc = uint16FromBE(ta.TpSrc)
+func (fk TransportFlowKey) Src() uint16 {
+	return uint16FromBE(*uint16At(fk.key(), 0))
+}
 
-	ta.TpDst, present.TpDst, err = attrs.GetOptionalUint16(OVS_TUNNEL_KEY_ATTR_TP_DST)
-	if err != nil {
-		return
-	}
-	ta.TpDst = uint16FromBE(ta.TpDst)
+func (fk TransportFlowKey) SrcMask() uint16 {
+	return uint16FromBE(*uint16At(fk.mask(), 0))
+}
 
-	return
+func (fk TransportFlowKey) Dst() uint16 {
+	return uint16FromBE(*uint16At(fk.key(), 2))
 }
 
-type TunnelFlowKey struct {
-	key  TunnelAttrs
-	mask TunnelAttrs
+func (fk TransportFlowKey) DstMask() uint16 {
+	return uint16FromBE(*uint16At(fk.mask(), 2))
 }
 
-func (fk TunnelFlowKey) String() string {
-	var buf bytes.Buffer
-	var sep string
-	fmt.Fprint(&buf, "TunnelFlowKey(")
+func (fk *TransportFlowKey) SetMaskedSrc(port uint16, mask uint16) {
+	*uint16At(fk.key(), 0) = uint16ToBE(port)
+	*uint16At(fk.mask(), 0) = uint16ToBE(mask)
+}
 
-	printMaskedBytes(&buf, &sep, "id", fk.key.TunnelId[:],
-		fk.mask.TunnelId[:], hex.EncodeToString)
-	printMaskedBytes(&buf, &sep, "ipv4src", fk.key.Ipv4Src[:],
-		fk.mask.Ipv4Src[:], ipv4ToString)
-	printMaskedBytes(&buf, &sep, "ipv4dst", fk.key.Ipv4Dst[:],
-		fk.mask.Ipv4Dst[:], ipv4ToString)
+func (fk *TransportFlowKey) SetSrc(port uint16) {
+	fk.SetMaskedSrc(port, 0xffff)
+}
 
-	printByte := func(n string, k, m byte) {
-		if m != 0 {
-			fmt.Fprintf(&buf, "%s%s: %d", sep, n, k)
-			if m != 0xff {
-				fmt.Fprintf(&buf, "&%x", m)
-			}
-			sep = ", "
-		}
-	}
+func (fk *TransportFlowKey) SetMaskedDst(port uint16, mask uint16) {
+	*uint16At(fk.key(), 2) = uint16ToBE(port)
+	*uint16At(fk.mask(), 2) = uint16ToBE(mask)
+}
 
-	printByte("tos", fk.key.Tos, fk.mask.Tos)
-	printByte("ttl", fk.key.Ttl, fk.mask.Ttl)
+func (fk *TransportFlowKey) SetDst(port uint16) {
+	fk.SetMaskedDst(port, 0xffff)
+}
 
-	if fk.mask.Df {
-		fmt.Fprintf(&buf, "%sdf: %t", sep, fk.key.Df)
-		sep = ", "
-	}
+func (fk TransportFlowKey) String() string {
+	var buf bytes.Buffer
+	var sep string
 
-	if fk.mask.Csum {
-		fmt.Fprintf(&buf, "%ssum: %t", sep, fk.key.Csum)
+	switch fk.typ {
+	case OVS_KEY_ATTR_TCP:
+		fmt.Fprint(&buf, "TcpFlowKey{")
+	case OVS_KEY_ATTR_UDP:
+		fmt.Fprint(&buf, "UdpFlowKey{")
+	case OVS_KEY_ATTR_SCTP:
+		fmt.Fprint(&buf, "SctpFlowKey{")
+	default:
+		fmt.Fprintf(&buf, "TransportFlowKey{type: %d", fk.typ)
 		sep = ", "
 	}
 
-	printUint16 := func(n string, k, m uint16) {
-		if m != 0 {
-			fmt.Fprintf(&buf, "%s%s: %d", sep, n, k)
-			if m != 0xffff {
-				fmt.Fprintf(&buf, "&%x", m)
-			}
-			sep = ", "
-		}
-	}
-
-	printUint16("tpsrc", fk.key.TpSrc, fk.mask.TpSrc)
-	printUint16("tpdst", fk.key.TpDst, fk.mask.TpDst)
-
+	printMaskedUint16(&buf, &sep, "src", fk.Src(), fk.SrcMask())
+	printMaskedUint16(&buf, &sep, "dst", fk.Dst(), fk.DstMask())
 	fmt.Fprint(&buf, "}")
 	return buf.String()
 }
 
-func ipv4ToString(ip []byte) string {
-	return net.IP(ip).To4().String()
-}
+var transportFlowKeyParser = blobFlowKeyParser(4,
+	func(fk BlobFlowKey) FlowKey { return TransportFlowKey{fk} })
 
-func (fk TunnelFlowKey) Key() TunnelAttrs {
-	return fk.key
-}
+// OVS_KEY_ATTR_TCP_FLAGS: TCP flags flow key, in network byte order.
 
-func (fk TunnelFlowKey) Mask() TunnelAttrs {
-	return fk.mask
+type TcpFlagsFlowKey struct {
+	BlobFlowKey
 }
 
-func (TunnelFlowKey) TypeId() uint16 {
-	return OVS_KEY_ATTR_TUNNEL
+func NewTcpFlagsFlowKey() TcpFlagsFlowKey {
+	return TcpFlagsFlowKey{newWildcardBlobFlowKey(OVS_KEY_ATTR_TCP_FLAGS, 2)}
 }
 
-func (fk *TunnelFlowKey) SetTunnelId(id [8]byte) {
-	fk.key.TunnelId = id
-	fk.mask.TunnelId = [...]byte{
-		0xff, 0xff, 0xff, 0xff,
-		0xff, 0xff, 0xff, 0xff,
-	}
+func (fk TcpFlagsFlowKey) Flags() uint16 {
+	return uint16FromBE(*uint16At(fk.key(), 0))
 }
 
-func (fk *TunnelFlowKey) SetIpv4Src(addr [4]byte) {
-	fk.key.Ipv4Src = addr
-	fk.mask.Ipv4Src = [...]byte{0xff, 0xff, 0xff, 0xff}
+func (fk TcpFlagsFlowKey) FlagsMask() uint16 {
+	return uint16FromBE(*uint16At(fk.mask(), 0))
 }
 
-func (fk *TunnelFlowKey) SetIpv4Dst(addr [4]byte) {
-	fk.key.Ipv4Dst = addr
-	fk.mask.Ipv4Dst = [...]byte{0xff, 0xff, 0xff, 0xff}
+func (fk *TcpFlagsFlowKey) SetMaskedFlags(flags uint16, mask uint16) {
+	*uint16At(fk.key(), 0) = uint16ToBE(flags)
+	*uint16At(fk.mask(), 0) = uint16ToBE(mask)
 }
 
-func (fk *TunnelFlowKey) SetTos(tos uint8) {
-	fk.key.Tos = tos
-	fk.mask.Tos = 0xff
+func (fk *TcpFlagsFlowKey) SetFlags(flags uint16) {
+	fk.SetMaskedFlags(flags, 0xffff)
 }
 
-func (fk *TunnelFlowKey) SetTtl(ttl uint8) {
-	fk.key.Ttl = ttl
-	fk.mask.Ttl = 0xff
+func (fk TcpFlagsFlowKey) String() string {
+	var buf bytes.Buffer
+	fmt.Fprint(&buf, "TcpFlagsFlowKey{")
+	if m := fk.FlagsMask(); m != 0 {
+		fmt.Fprintf(&buf, "flags: %#x", fk.Flags())
+		if m != 0xffff {
+			fmt.Fprintf(&buf, "&%x", m)
+		}
+	}
+	fmt.Fprint(&buf, "}")
+	return buf.String()
 }
 
-func (fk *TunnelFlowKey) SetDf(df bool) {
-	fk.key.Df = df
-	fk.mask.Df = true
+var tcpFlagsFlowKeyParser = blobFlowKeyParser(2,
+	func(fk BlobFlowKey) FlowKey { return TcpFlagsFlowKey{fk} })
+
+// OVS_KEY_ATTR_CT_STATE: Connection tracking state flow key, a
+// uint32 of OVS_CS_F_* bits in host byte order.  Matches on ct_state
+// are usually partial, e.g. tracked and established but not new, so
+// SetStateFlag matches on individual bits.
+
+type CtStateFlowKey struct {
+	BlobFlowKey
 }
 
-func (fk *TunnelFlowKey) SetCsum(csum bool) {
-	fk.key.Csum = csum
-	fk.mask.Csum = true
+func NewCtStateFlowKey() CtStateFlowKey {
+	return CtStateFlowKey{newWildcardBlobFlowKey(OVS_KEY_ATTR_CT_STATE, 4)}
 }
 
-func (fk *TunnelFlowKey) SetTpSrc(port uint16) {
-	fk.key.TpSrc = port
-	fk.mask.TpSrc = 0xffff
+func (fk CtStateFlowKey) State() uint32 {
+	return *uint32At(fk.key(), 0)
 }
 
-func (fk *TunnelFlowKey) SetTpDst(port uint16) {
-	fk.key.TpDst = port
-	fk.mask.TpDst = 0xffff
+func (fk CtStateFlowKey) StateMask() uint32 {
+	return *uint32At(fk.mask(), 0)
 }
 
-func (key TunnelFlowKey) putKeyNlAttr(msg *NlMsgBuilder) {
-	msg.PutNestedAttrs(OVS_KEY_ATTR_TUNNEL, func() {
-		key.key.toNlAttrs(msg, key.mask.present())
-	})
+func (fk *CtStateFlowKey) SetMaskedState(state uint32, mask uint32) {
+	*uint32At(fk.key(), 0) = state
+	*uint32At(fk.mask(), 0) = mask
 }
 
-func (key TunnelFlowKey) putMaskNlAttr(msg *NlMsgBuilder) {
-	msg.PutNestedAttrs(OVS_KEY_ATTR_TUNNEL, func() {
-		key.mask.toNlAttrs(msg, key.mask.present())
-	})
+func (fk *CtStateFlowKey) SetState(state uint32) {
+	fk.SetMaskedState(state, 0xffffffff)
 }
 
-func (a TunnelFlowKey) Equals(gb FlowKey) bool {
-	b, ok := gb.(TunnelFlowKey)
-	if !ok {
-		return false
+// Match on the given OVS_CS_F_* bits being set or clear, leaving the
+// match on other bits unchanged.
+func (fk *CtStateFlowKey) SetStateFlag(flag uint32, set bool) {
+	state := fk.State() &^ flag
+	if set {
+		state |= flag
 	}
-	return a.key == b.key && a.mask == b.mask
+	fk.SetMaskedState(state, fk.StateMask()|flag)
 }
 
-func (key TunnelFlowKey) Ignored() bool {
-	m := key.mask
-	return AllBytes(m.TunnelId[:], 0) &&
-		AllBytes(m.Ipv4Src[:], 0) &&
-		AllBytes(m.Ipv4Dst[:], 0) &&
-		m.Tos == 0 &&
-		m.Ttl == 0 &&
-		!m.Csum && !m.Csum &&
-		m.TpSrc == 0 && m.TpDst == 0
+func (fk CtStateFlowKey) String() string {
+	var buf bytes.Buffer
+	fmt.Fprint(&buf, "CtStateFlowKey{")
+	if m := fk.StateMask(); m != 0 {
+		fmt.Fprintf(&buf, "state: %#x", fk.State())
+		if m != 0xffffffff {
+			fmt.Fprintf(&buf, "&%x", m)
+		}
+	}
+	fmt.Fprint(&buf, "}")
+	return buf.String()
 }
 
-func parseTunnelFlowKey(typ uint16, key []byte, mask []byte) (FlowKey, error) {
-	var k, m TunnelAttrs
-	var kp TunnelAttrsPresence
-	var err error
+var ctStateFlowKeyParser = blobFlowKeyParser(4,
+	func(fk BlobFlowKey) FlowKey { return CtStateFlowKey{fk} })
 
-	if key != nil {
-		k, kp, err = parseTunnelAttrs(key)
-		if err != nil {
-			return nil, err
-		}
-	}
+// OVS_KEY_ATTR_CT_ZONE: Connection tracking zone flow key, in host
+// byte order.
 
-	if mask != nil {
-		// We don't care about mask presence information, because a
-		// missing mask attribute means the field is
-		// wildcarded
-		m, _, err = parseTunnelAttrs(mask)
-		if err != nil {
-			return nil, err
+type CtZoneFlowKey struct {
+	BlobFlowKey
+}
+
+func NewCtZoneFlowKey() CtZoneFlowKey {
+	return CtZoneFlowKey{newWildcardBlobFlowKey(OVS_KEY_ATTR_CT_ZONE, 2)}
+}
+
+func (fk CtZoneFlowKey) Zone() uint16 {
+	return *uint16At(fk.key(), 0)
+}
+
+func (fk CtZoneFlowKey) ZoneMask() uint16 {
+	return *uint16At(fk.mask(), 0)
+}
+
+func (fk *CtZoneFlowKey) SetMaskedZone(zone uint16, mask uint16) {
+	*uint16At(fk.key(), 0) = zone
+	*uint16At(fk.mask(), 0) = mask
+}
+
+func (fk *CtZoneFlowKey) SetZone(zone uint16) {
+	fk.SetMaskedZone(zone, 0xffff)
+}
+
+func (fk CtZoneFlowKey) String() string {
+	var buf bytes.Buffer
+	var sep string
+	fmt.Fprint(&buf, "CtZoneFlowKey{")
+	printMaskedUint16(&buf, &sep, "zone", fk.Zone(), fk.ZoneMask())
+	fmt.Fprint(&buf, "}")
+	return buf.String()
+}
+
+var ctZoneFlowKeyParser = blobFlowKeyParser(2,
+	func(fk BlobFlowKey) FlowKey { return CtZoneFlowKey{fk} })
+
+// OVS_KEY_ATTR_CT_MARK: Connection tracking mark flow key, in host
+// byte order.
+
+type CtMarkFlowKey struct {
+	BlobFlowKey
+}
+
+func NewCtMarkFlowKey() CtMarkFlowKey {
+	return CtMarkFlowKey{newWildcardBlobFlowKey(OVS_KEY_ATTR_CT_MARK, 4)}
+}
+
+func (fk CtMarkFlowKey) Mark() uint32 {
+	return *uint32At(fk.key(), 0)
+}
+
+func (fk CtMarkFlowKey) MarkMask() uint32 {
+	return *uint32At(fk.mask(), 0)
+}
+
+func (fk *CtMarkFlowKey) SetMaskedMark(mark uint32, mask uint32) {
+	*uint32At(fk.key(), 0) = mark
+	*uint32At(fk.mask(), 0) = mask
+}
+
+func (fk *CtMarkFlowKey) SetMark(mark uint32) {
+	fk.SetMaskedMark(mark, 0xffffffff)
+}
+
+func (fk CtMarkFlowKey) String() string {
+	var buf bytes.Buffer
+	fmt.Fprint(&buf, "CtMarkFlowKey{")
+	if m := fk.MarkMask(); m != 0 {
+		fmt.Fprintf(&buf, "mark: %#x", fk.Mark())
+		if m != 0xffffffff {
+			fmt.Fprintf(&buf, "&%x", m)
 		}
-	} else {
-		// mask being nil means that no mask attributes were
-		// provided, which means the mask is implicit in the
-		// key attributes provides
-		m = kp.mask()
 	}
+	fmt.Fprint(&buf, "}")
+	return buf.String()
+}
 
-	return TunnelFlowKey{key: k, mask: m}, err
+var ctMarkFlowKeyParser = blobFlowKeyParser(4,
+	func(fk BlobFlowKey) FlowKey { return CtMarkFlowKey{fk} })
+
+// OVS_KEY_ATTR_CT_LABELS: Connection tracking labels flow key, 128
+// bits.  OVS treats the labels as a 128-bit integer in host byte
+// order, so label bit 0 is in the first byte on little-endian hosts.
+
+type CtLabelsFlowKey struct {
+	BlobFlowKey
 }
 
-var flowKeyParsers = FlowKeyParsers{
-	// Packet QoS priority flow key
-	OVS_KEY_ATTR_PRIORITY: blobFlowKeyParser(4, nil),
+func NewCtLabelsFlowKey() CtLabelsFlowKey {
+	return CtLabelsFlowKey{newWildcardBlobFlowKey(OVS_KEY_ATTR_CT_LABELS,
+		OVS_CT_LABELS_LEN)}
+}
 
-	OVS_KEY_ATTR_IN_PORT: FlowKeyParser{
-		parse:      parseInPortFlowKey,
-		exactMask:  []byte{0xff, 0xff, 0xff, 0xff},
-		ignoreMask: []byte{0, 0, 0, 0},
-	},
+func (fk CtLabelsFlowKey) Labels() (labels [OVS_CT_LABELS_LEN]byte) {
+	copy(labels[:], fk.key())
+	return
+}
 
-	OVS_KEY_ATTR_ETHERNET:  ethernetFlowKeyParser,
-	OVS_KEY_ATTR_ETHERTYPE: blobFlowKeyParser(2, nil),
-	OVS_KEY_ATTR_IPV4:      blobFlowKeyParser(12, nil),
-	OVS_KEY_ATTR_IPV6:      blobFlowKeyParser(40, nil),
-	OVS_KEY_ATTR_TCP:       blobFlowKeyParser(4, nil),
-	OVS_KEY_ATTR_UDP:       blobFlowKeyParser(4, nil),
-	OVS_KEY_ATTR_ICMP:      blobFlowKeyParser(2, nil),
-	OVS_KEY_ATTR_ICMPV6:    blobFlowKeyParser(2, nil),
-	OVS_KEY_ATTR_ARP:       blobFlowKeyParser(24, nil),
-	OVS_KEY_ATTR_ND:        blobFlowKeyParser(28, nil),
-	OVS_KEY_ATTR_SKB_MARK:  blobFlowKeyParser(4, nil),
-	OVS_KEY_ATTR_DP_HASH:   blobFlowKeyParser(4, nil),
-	OVS_KEY_ATTR_TCP_FLAGS: blobFlowKeyParser(2, nil),
-	OVS_KEY_ATTR_RECIRC_ID: blobFlowKeyParser(4, nil),
+func (fk CtLabelsFlowKey) LabelsMask() (mask [OVS_CT_LABELS_LEN]byte) {
+	copy(mask[:], fk.mask())
+	return
+}
 
-	OVS_KEY_ATTR_TUNNEL: FlowKeyParser{
-		parse:      parseTunnelFlowKey,
-		exactMask:  nil,
-		ignoreMask: []byte{},
-	},
+func (fk *CtLabelsFlowKey) SetMaskedLabels(labels [OVS_CT_LABELS_LEN]byte,
+	mask [OVS_CT_LABELS_LEN]byte) {
+	copy(fk.key(), labels[:])
+	copy(fk.mask(), mask[:])
 }
 
-func MakeFlowKeys() FlowKeys {
-	return make(FlowKeys)
+func (fk *CtLabelsFlowKey) SetLabels(labels [OVS_CT_LABELS_LEN]byte) {
+	copy(fk.key(), labels[:])
+	for i := range fk.mask() {
+		fk.mask()[i] = 0xff
+	}
 }
 
-func (keys FlowKeys) Add(k FlowKey) {
-	// TODO check for collisions
-	keys[k.TypeId()] = k
+func (fk CtLabelsFlowKey) String() string {
+	var buf bytes.Buffer
+	var sep string
+	fmt.Fprint(&buf, "CtLabelsFlowKey{")
+	printMaskedBytes(&buf, &sep, "labels", fk.key(), fk.mask(), hex.EncodeToString)
+	fmt.Fprint(&buf, "}")
+	return buf.String()
 }
 
-// Actions
+var ctLabelsFlowKeyParser = blobFlowKeyParser(OVS_CT_LABELS_LEN,
+	func(fk BlobFlowKey) FlowKey { return CtLabelsFlowKey{fk} })
 
-type Action interface {
-	TypeId() uint16
-	toNlAttr(*NlMsgBuilder)
-	Equals(Action) bool
+// OVS_KEY_ATTR_VLAN: VLAN tag flow key.  This is the TCI in network
+// byte order, with the CFI bit meaning that a tag is present.  A
+// tagged packet has an ethertype key of 0x8100, and its inner
+// ethertype and headers go in an EncapFlowKey.
+
+type VlanFlowKey struct {
+	BlobFlowKey
 }
 
-type OutputAction VportID
+// The TCI of a new VlanFlowKey is wildcarded until it is set.
+func NewVlanFlowKey() VlanFlowKey {
+	return VlanFlowKey{newWildcardBlobFlowKey(OVS_KEY_ATTR_VLAN, 2)}
+}
 
-func NewOutputAction(vport VportID) OutputAction {
-	return OutputAction(vport)
+func (fk VlanFlowKey) TCI() uint16 {
+	return uint16FromBE(*uint16At(fk.key(), 0))
 }
 
-func (oa OutputAction) String() string {
-	return fmt.Sprintf("OutputAction{vport: %d}", oa)
+func (fk VlanFlowKey) TCIMask() uint16 {
+	return uint16FromBE(*uint16At(fk.mask(), 0))
 }
 
-func (oa OutputAction) VportID() VportID {
-	return VportID(oa)
+func (fk VlanFlowKey) Vid() uint16 {
+	return fk.TCI() & VLAN_VID_MASK
 }
 
-func (OutputAction) TypeId() uint16 {
-	return OVS_ACTION_ATTR_OUTPUT
+func (fk VlanFlowKey) Pcp() uint8 {
+	return uint8(fk.TCI() >> VLAN_PRIO_SHIFT)
 }
 
-func (oa OutputAction) toNlAttr(msg *NlMsgBuilder) {
-	msg.PutUint32Attr(OVS_ACTION_ATTR_OUTPUT, uint32(oa))
+func (fk *VlanFlowKey) SetMaskedTCI(tci uint16, mask uint16) {
+	*uint16At(fk.key(), 0) = uint16ToBE(tci)
+	*uint16At(fk.mask(), 0) = uint16ToBE(mask)
 }
 
-func (a OutputAction) Equals(bx Action) bool {
-	b, ok := bx.(OutputAction)
-	if !ok {
-		return false
+// Set bits of the TCI under mask, leaving the other bits alone.
+// Matching any part of the TCI implies that a tag is present.
+func (fk *VlanFlowKey) setTCIBits(bits uint16, mask uint16) {
+	mask |= VLAN_CFI_MASK
+	bits |= VLAN_CFI_MASK
+	fk.SetMaskedTCI(fk.TCI()&^mask|bits, fk.TCIMask()|mask)
+}
+
+func (fk *VlanFlowKey) SetVid(vid uint16) {
+	fk.setTCIBits(vid&VLAN_VID_MASK, VLAN_VID_MASK)
+}
+
+func (fk *VlanFlowKey) SetPcp(pcp uint8) {
+	fk.setTCIBits(uint16(pcp)<<VLAN_PRIO_SHIFT&VLAN_PRIO_MASK, VLAN_PRIO_MASK)
+}
+
+func (fk VlanFlowKey) String() string {
+	var buf bytes.Buffer
+	var sep string
+	fmt.Fprint(&buf, "VlanFlowKey{")
+	k := fk.TCI()
+	m := fk.TCIMask()
+	printMaskedUint16(&buf, &sep, "vid", k&VLAN_VID_MASK, m&VLAN_VID_MASK)
+	printMaskedUint8(&buf, &sep, "pcp", uint8(k>>VLAN_PRIO_SHIFT), uint8(m>>VLAN_PRIO_SHIFT))
+	if m&VLAN_CFI_MASK != 0 {
+		fmt.Fprintf(&buf, "%scfi: %t", sep, k&VLAN_CFI_MASK != 0)
 	}
-	return a == b
+	fmt.Fprint(&buf, "}")
+	return buf.String()
 }
 
-func parseOutputAction(typ uint16, data []byte) (Action, error) {
-	if len(data) < 4 {
-		return nil, fmt.Errorf("flow action type %d has wrong length (expects 4 bytes, got %d)", typ, len(data))
+var vlanFlowKeyParser = blobFlowKeyParser(2,
+	func(fk BlobFlowKey) FlowKey { return VlanFlowKey{fk} })
+
+// OVS_KEY_ATTR_MPLS: MPLS flow key.  This is the outermost label
+// stack entries in network byte order: one by default, and up to
+// MPLS_LABEL_DEPTH on kernels that match on more (see LSEs).  The
+// single-LSE methods (LSE, Label etc.) refer to the outermost one.  A
+// packet with an MPLS key has an ethertype key of 0x8847 or 0x8848.
+
+type MplsFlowKey struct {
+	BlobFlowKey
+}
+
+func NewMplsFlowKey() MplsFlowKey {
+	return MplsFlowKey{newWildcardBlobFlowKey(OVS_KEY_ATTR_MPLS, 4)}
+}
+
+func (fk MplsFlowKey) LSE() uint32 {
+	return uint32FromBE(*uint32At(fk.key(), 0))
+}
+
+func (fk MplsFlowKey) LSEMask() uint32 {
+	return uint32FromBE(*uint32At(fk.mask(), 0))
+}
+
+func (fk MplsFlowKey) Label() uint32 {
+	return fk.LSE() >> MPLS_LS_LABEL_SHIFT
+}
+
+func (fk MplsFlowKey) TC() uint8 {
+	return uint8(fk.LSE() & MPLS_LS_TC_MASK >> MPLS_LS_TC_SHIFT)
+}
+
+func (fk MplsFlowKey) BoS() bool {
+	return fk.LSE()&MPLS_LS_S_MASK != 0
+}
+
+func (fk MplsFlowKey) TTL() uint8 {
+	return uint8(fk.LSE() & MPLS_LS_TTL_MASK)
+}
+
+func (fk *MplsFlowKey) SetMaskedLSE(lse uint32, mask uint32) {
+	*uint32At(fk.key(), 0) = uint32ToBE(lse)
+	*uint32At(fk.mask(), 0) = uint32ToBE(mask)
+}
+
+// Set bits of the LSE under mask, leaving the other bits alone.
+func (fk *MplsFlowKey) setLSEBits(bits uint32, mask uint32) {
+	fk.SetMaskedLSE(fk.LSE()&^mask|bits&mask, fk.LSEMask()|mask)
+}
+
+func (fk *MplsFlowKey) SetLabel(label uint32) {
+	fk.setLSEBits(label<<MPLS_LS_LABEL_SHIFT, MPLS_LS_LABEL_MASK)
+}
+
+func (fk *MplsFlowKey) SetTC(tc uint8) {
+	fk.setLSEBits(uint32(tc)<<MPLS_LS_TC_SHIFT, MPLS_LS_TC_MASK)
+}
+
+func (fk *MplsFlowKey) SetBoS(bos bool) {
+	var bits uint32
+	if bos {
+		bits = MPLS_LS_S_MASK
 	}
+	fk.setLSEBits(bits, MPLS_LS_S_MASK)
+}
 
-	return OutputAction(*uint32At(data, 0)), nil
+func (fk *MplsFlowKey) SetTTL(ttl uint8) {
+	fk.setLSEBits(uint32(ttl), MPLS_LS_TTL_MASK)
 }
 
-type SetTunnelAction struct {
-	TunnelAttrs
-	Present TunnelAttrsPresence
+// All the label stack entries in the key, outermost first, and their
+// masks.
+func (fk MplsFlowKey) LSEs() (lses []uint32, masks []uint32) {
+	key, mask := fk.key(), fk.mask()
+	for pos := 0; pos < len(key); pos += 4 {
+		lses = append(lses, uint32FromBE(*uint32At(key, pos)))
+		masks = append(masks, uint32FromBE(*uint32At(mask, pos)))
+	}
+	return
 }
 
-func (ta SetTunnelAction) String() string {
+// Set the label stack entries, outermost first, with their masks.
+// This changes the depth of the key to len(lses).
+func (fk *MplsFlowKey) SetMaskedLSEs(lses []uint32, masks []uint32) error {
+	if len(lses) == 0 || len(lses) > MPLS_LABEL_DEPTH || len(masks) != len(lses) {
+		return fmt.Errorf("bad MPLS label stack depth (%d entries, %d masks)", len(lses), len(masks))
+	}
+
+	fk.BlobFlowKey = newWildcardBlobFlowKey(OVS_KEY_ATTR_MPLS, 4*len(lses))
+	key, mask := fk.key(), fk.mask()
+	for i := range lses {
+		*uint32At(key, 4*i) = uint32ToBE(lses[i])
+		*uint32At(mask, 4*i) = uint32ToBE(masks[i])
+	}
+	return nil
+}
+
+func (fk MplsFlowKey) String() string {
 	var buf bytes.Buffer
 	var sep string
-	fmt.Fprint(&buf, "SetTunnelAction{")
+	fmt.Fprint(&buf, "MplsFlowKey{")
+	lses, masks := fk.LSEs()
+	for i := range lses {
+		if masks[i] == 0 {
+			continue
+		}
 
-	if ta.Present.TunnelId {
-		fmt.Fprintf(&buf, "%sid: %s", sep,
-			hex.EncodeToString(ta.TunnelId[:]))
+		name := "lse"
+		if len(lses) > 1 {
+			name = fmt.Sprint("lse", i)
+		}
+
+		fmt.Fprintf(&buf, "%s%s: %#x", sep, name, lses[i])
+		if masks[i] != 0xffffffff {
+			fmt.Fprintf(&buf, "&%x", masks[i])
+		}
 		sep = ", "
 	}
+	fmt.Fprint(&buf, "}")
+	return buf.String()
+}
+
+var mplsFlowKeyParser = FlowKeyParser{
+	parse: func(typ uint16, key []byte, mask []byte) (FlowKey, error) {
+		size := len(mask)
+		if key != nil {
+			size = len(key)
+		}
+
+		if size == 0 || size%4 != 0 || size > 4*MPLS_LABEL_DEPTH {
+			return nil, fmt.Errorf("flow key type %d has wrong length (expected a multiple of 4 bytes, up to %d, got %d)", typ, 4*MPLS_LABEL_DEPTH, size)
+		}
+
+		// ParseFlowKeys supplies the single-LSE exact or
+		// ignore mask when the kernel gave none, so stretch
+		// it to the depth of the key.
+		if len(mask) == 4 && size > 4 && (AllBytes(mask, 0) || AllBytes(mask, 0xff)) {
+			mask = bytes.Repeat(mask, size/4)
+		}
+
+		bfk, err := parseBlobFlowKey(typ, key, mask, size)
+		if err != nil {
+			return nil, err
+		}
+
+		return MplsFlowKey{bfk}, nil
+	},
+	ignoreMask: make([]byte, 4),
+	exactMask:  []byte{0xff, 0xff, 0xff, 0xff},
+}
+
+// OVS_KEY_ATTR_RECIRC_ID: Recirculation id flow key, in host byte
+// order.  Packets arrive with a recirc id of 0, and a RecircAction
+// sends a packet back through the datapath with a new one, so flows
+// for later stages of a pipeline match on their recirc id.
+
+type RecircIdFlowKey struct {
+	BlobFlowKey
+}
+
+func NewRecircIdFlowKey(id uint32) RecircIdFlowKey {
+	fk := RecircIdFlowKey{NewBlobFlowKey(OVS_KEY_ATTR_RECIRC_ID, 4)}
+	*uint32At(fk.key(), 0) = id
+	return fk
+}
+
+func (fk RecircIdFlowKey) RecircId() uint32 {
+	return *uint32At(fk.key(), 0)
+}
+
+func (fk RecircIdFlowKey) String() string {
+	return fmt.Sprintf("RecircIdFlowKey{id: %d}", fk.RecircId())
+}
+
+var recircIdFlowKeyParser = blobFlowKeyParser(4,
+	func(fk BlobFlowKey) FlowKey { return RecircIdFlowKey{fk} })
+
+// OVS_KEY_ATTR_ENCAP: The flow keys for the packet inside a VLAN
+// tag, as nested attributes.
+
+type EncapFlowKey struct {
+	keys FlowKeys
+}
+
+func NewEncapFlowKey() EncapFlowKey {
+	return EncapFlowKey{keys: MakeFlowKeys()}
+}
+
+func (EncapFlowKey) TypeId() uint16 {
+	return OVS_KEY_ATTR_ENCAP
+}
+
+// The inner flow keys.  These can be modified in place with Add.
+func (fk EncapFlowKey) FlowKeys() FlowKeys {
+	return fk.keys
+}
+
+// Add works on a zero EncapFlowKey too, creating its key set.
+func (fk *EncapFlowKey) Add(k FlowKey) {
+	if fk.keys == nil {
+		fk.keys = MakeFlowKeys()
+	}
+	fk.keys.Add(k)
+}
+
+func (fk EncapFlowKey) putKeyNlAttr(msg *NlMsgBuilder) {
+	msg.PutNestedAttrs(OVS_KEY_ATTR_ENCAP, func() {
+		for _, k := range fk.keys {
+			if !k.Ignored() {
+				k.putKeyNlAttr(msg)
+			}
+		}
+	})
+}
+
+func (fk EncapFlowKey) putMaskNlAttr(msg *NlMsgBuilder) {
+	msg.PutNestedAttrs(OVS_KEY_ATTR_ENCAP, func() {
+		for _, k := range fk.keys {
+			if !k.Ignored() {
+				k.putMaskNlAttr(msg)
+			}
+		}
+	})
+}
+
+func (fk EncapFlowKey) Ignored() bool {
+	// The kernel requires the encap key alongside the VLAN
+	// ethertype, even if it is empty
+	return false
+}
+
+func (a EncapFlowKey) Equals(gb FlowKey) bool {
+	b, ok := gb.(EncapFlowKey)
+	if !ok {
+		return false
+	}
+	return a.keys.Equals(b.keys)
+}
+
+func (fk EncapFlowKey) String() string {
+	var keys []FlowKey
+	for _, k := range fk.keys {
+		keys = append(keys, k)
+	}
+	return fmt.Sprintf("EncapFlowKey{%v}", keys)
+}
+
+func parseEncapFlowKey(typ uint16, key []byte, mask []byte) (FlowKey, error) {
+	keys, err := ParseNestedAttrs(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// As for the top-level flow keys, no mask means an exact
+	// match
+	var masks Attrs
+	if mask != nil {
+		masks, err = ParseNestedAttrs(mask)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fks, err := ParseFlowKeys(keys, masks)
+	if err != nil {
+		return nil, err
+	}
+
+	return EncapFlowKey{keys: fks}, nil
+}
+
+// OVS_KEY_ATTR_TUNNEL: Tunnel flow key.  This is more elaborate than
+// other flow keys because it consists of a set of attributes.
+
+type TunnelAttrs struct {
+	TunnelId [8]byte
+	Ipv4Src  [4]byte
+	Ipv4Dst  [4]byte
+	Tos      uint8
+	Ttl      uint8
+	Df       bool
+	Csum     bool
+	TpSrc    uint16
+	TpDst    uint16
+}
+
+type TunnelAttrsPresence struct {
+	TunnelId bool
+	Ipv4Src  bool
+	Ipv4Dst  bool
+	Tos      bool
+	Ttl      bool
+	Df       bool
+	Csum     bool
+	TpSrc    bool
+	TpDst    bool
+}
+
+// Extract presence information from a TunnelAttrs mask
+func (ta TunnelAttrs) present() TunnelAttrsPresence {
+	// The kernel requires Ipv4Dst and Ttl to be present, so we
+	// always mark those as present, even if we end up wildcarding
+	// them.
+	return TunnelAttrsPresence{
+		TunnelId: !AllBytes(ta.TunnelId[:], 0),
+		Ipv4Src:  !AllBytes(ta.Ipv4Src[:], 0),
+		Ipv4Dst:  true,
+		Tos:      ta.Tos != 0,
+		Ttl:      true,
+		Df:       ta.Df,
+		Csum:     ta.Csum,
+		TpSrc:    ta.TpSrc != 0,
+		TpDst:    ta.TpDst != 0,
+	}
+}
+
+// Convert a TunnelAttrsPresence to a mask
+func (tap TunnelAttrsPresence) mask() (res TunnelAttrs) {
+	if tap.TunnelId {
+		res.TunnelId = [8]byte{
+			0xff, 0xff, 0xff, 0xff,
+			0xff, 0xff, 0xff, 0xff,
+		}
+	}
+
+	if tap.Ipv4Src {
+		res.Ipv4Src = [4]byte{0xff, 0xff, 0xff, 0xff}
+	}
+
+	if tap.Ipv4Dst {
+		res.Ipv4Dst = [4]byte{0xff, 0xff, 0xff, 0xff}
+	}
+
+	if tap.Tos {
+		res.Tos = 0xff
+	}
+
+	if tap.Ttl {
+		res.Ttl = 0xff
+	}
+
+	res.Df = tap.Df
+	res.Csum = tap.Csum
+
+	if tap.TpSrc {
+		res.TpSrc = 0xffff
+	}
+
+	if tap.TpDst {
+		res.TpDst = 0xffff
+	}
+
+	return
+}
+
+func (ta TunnelAttrs) toNlAttrs(msg *NlMsgBuilder, present TunnelAttrsPresence) {
+	if present.TunnelId {
+		msg.PutSliceAttr(OVS_TUNNEL_KEY_ATTR_ID, ta.TunnelId[:])
+	}
+
+	if present.Ipv4Src {
+		msg.PutSliceAttr(OVS_TUNNEL_KEY_ATTR_IPV4_SRC, ta.Ipv4Src[:])
+	}
+
+	if present.Ipv4Dst {
+		msg.PutSliceAttr(OVS_TUNNEL_KEY_ATTR_IPV4_DST, ta.Ipv4Dst[:])
+	}
+
+	if present.Tos {
+		msg.PutUint8Attr(OVS_TUNNEL_KEY_ATTR_TOS, ta.Tos)
+	}
+
+	if present.Ttl {
+		msg.PutUint8Attr(OVS_TUNNEL_KEY_ATTR_TTL, ta.Ttl)
+	}
+
+	if present.Df && ta.Df {
+		msg.PutEmptyAttr(OVS_TUNNEL_KEY_ATTR_DONT_FRAGMENT)
+	}
+
+	if present.Csum && ta.Csum {
+		msg.PutEmptyAttr(OVS_TUNNEL_KEY_ATTR_CSUM)
+	}
+
+	if present.TpSrc {
+		msg.PutUint16Attr(OVS_TUNNEL_KEY_ATTR_TP_SRC,
+			uint16ToBE(ta.TpSrc))
+	}
+
+	if present.TpDst {
+		msg.PutUint16Attr(OVS_TUNNEL_KEY_ATTR_TP_DST,
+			uint16ToBE(ta.TpDst))
+	}
+}
+
+func parseTunnelAttrs(data []byte) (ta TunnelAttrs, present TunnelAttrsPresence, err error) {
+	attrs, err := ParseNestedAttrs(data)
+	if err != nil {
+		return
+	}
+
+	present.TunnelId, err = attrs.GetOptionalBytes(OVS_TUNNEL_KEY_ATTR_ID, ta.TunnelId[:])
+	if err != nil {
+		return
+	}
+
+	present.Ipv4Src, err = attrs.GetOptionalBytes(OVS_TUNNEL_KEY_ATTR_IPV4_SRC, ta.Ipv4Src[:])
+	if err != nil {
+		return
+	}
+
+	present.Ipv4Dst, err = attrs.GetOptionalBytes(OVS_TUNNEL_KEY_ATTR_IPV4_DST, ta.Ipv4Dst[:])
+	if err != nil {
+		return
+	}
+
+	ta.Tos, present.Tos, err = attrs.GetOptionalUint8(OVS_TUNNEL_KEY_ATTR_TOS)
+	if err != nil {
+		return
+	}
+
+	ta.Ttl, present.Ttl, err = attrs.GetOptionalUint8(OVS_TUNNEL_KEY_ATTR_TTL)
+	if err != nil {
+		return
+	}
+
+	ta.Df, err = attrs.GetEmpty(OVS_TUNNEL_KEY_ATTR_DONT_FRAGMENT)
+	present.Df = ta.Df
+	if err != nil {
+		return
+	}
+
+	ta.Csum, err = attrs.GetEmpty(OVS_TUNNEL_KEY_ATTR_CSUM)
+	present.Csum = ta.Csum
+	if err != nil {
+		return
+	}
+
+	ta.TpSrc, present.TpSrc, err = attrs.GetOptionalUint16BE(OVS_TUNNEL_KEY_ATTR_TP_SRC)
+	if err != nil {
+		return
+	}
+
+	ta.TpDst, present.TpDst, err = attrs.GetOptionalUint16BE(OVS_TUNNEL_KEY_ATTR_TP_DST)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+type TunnelFlowKey struct {
+	key  TunnelAttrs
+	mask TunnelAttrs
+}
+
+func (fk TunnelFlowKey) String() string {
+	var buf bytes.Buffer
+	var sep string
+	fmt.Fprint(&buf, "TunnelFlowKey(")
+
+	printMaskedBytes(&buf, &sep, "id", fk.key.TunnelId[:],
+		fk.mask.TunnelId[:], hex.EncodeToString)
+	printMaskedBytes(&buf, &sep, "ipv4src", fk.key.Ipv4Src[:],
+		fk.mask.Ipv4Src[:], ipv4ToString)
+	printMaskedBytes(&buf, &sep, "ipv4dst", fk.key.Ipv4Dst[:],
+		fk.mask.Ipv4Dst[:], ipv4ToString)
+
+	printMaskedUint8(&buf, &sep, "tos", fk.key.Tos, fk.mask.Tos)
+	printMaskedUint8(&buf, &sep, "ttl", fk.key.Ttl, fk.mask.Ttl)
+
+	if fk.mask.Df {
+		fmt.Fprintf(&buf, "%sdf: %t", sep, fk.key.Df)
+		sep = ", "
+	}
+
+	if fk.mask.Csum {
+		fmt.Fprintf(&buf, "%ssum: %t", sep, fk.key.Csum)
+		sep = ", "
+	}
+
+	printMaskedUint16(&buf, &sep, "tpsrc", fk.key.TpSrc, fk.mask.TpSrc)
+	printMaskedUint16(&buf, &sep, "tpdst", fk.key.TpDst, fk.mask.TpDst)
+
+	fmt.Fprint(&buf, "}")
+	return buf.String()
+}
+
+func ipv4ToString(ip []byte) string {
+	return net.IP(ip).To4().String()
+}
+
+func (fk TunnelFlowKey) Key() TunnelAttrs {
+	return fk.key
+}
+
+func (fk TunnelFlowKey) Mask() TunnelAttrs {
+	return fk.mask
+}
+
+func (TunnelFlowKey) TypeId() uint16 {
+	return OVS_KEY_ATTR_TUNNEL
+}
+
+func (fk *TunnelFlowKey) SetTunnelId(id [8]byte) {
+	fk.key.TunnelId = id
+	fk.mask.TunnelId = [...]byte{
+		0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff,
+	}
+}
+
+func (fk *TunnelFlowKey) SetIpv4Src(addr [4]byte) {
+	fk.key.Ipv4Src = addr
+	fk.mask.Ipv4Src = [...]byte{0xff, 0xff, 0xff, 0xff}
+}
+
+func (fk *TunnelFlowKey) SetIpv4Dst(addr [4]byte) {
+	fk.key.Ipv4Dst = addr
+	fk.mask.Ipv4Dst = [...]byte{0xff, 0xff, 0xff, 0xff}
+}
+
+func (fk *TunnelFlowKey) SetTos(tos uint8) {
+	fk.key.Tos = tos
+	fk.mask.Tos = 0xff
+}
+
+func (fk *TunnelFlowKey) SetTtl(ttl uint8) {
+	fk.key.Ttl = ttl
+	fk.mask.Ttl = 0xff
+}
+
+func (fk *TunnelFlowKey) SetDf(df bool) {
+	fk.key.Df = df
+	fk.mask.Df = true
+}
+
+func (fk *TunnelFlowKey) SetCsum(csum bool) {
+	fk.key.Csum = csum
+	fk.mask.Csum = true
+}
+
+func (fk *TunnelFlowKey) SetTpSrc(port uint16) {
+	fk.key.TpSrc = port
+	fk.mask.TpSrc = 0xffff
+}
+
+func (fk *TunnelFlowKey) SetTpDst(port uint16) {
+	fk.key.TpDst = port
+	fk.mask.TpDst = 0xffff
+}
+
+func (key TunnelFlowKey) putKeyNlAttr(msg *NlMsgBuilder) {
+	msg.PutNestedAttrs(OVS_KEY_ATTR_TUNNEL, func() {
+		key.key.toNlAttrs(msg, key.mask.present())
+	})
+}
+
+func (key TunnelFlowKey) putMaskNlAttr(msg *NlMsgBuilder) {
+	msg.PutNestedAttrs(OVS_KEY_ATTR_TUNNEL, func() {
+		key.mask.toNlAttrs(msg, key.mask.present())
+	})
+}
+
+func (a TunnelFlowKey) Equals(gb FlowKey) bool {
+	b, ok := gb.(TunnelFlowKey)
+	if !ok {
+		return false
+	}
+	return a.key == b.key && a.mask == b.mask
+}
+
+func (key TunnelFlowKey) Ignored() bool {
+	m := key.mask
+	return AllBytes(m.TunnelId[:], 0) &&
+		AllBytes(m.Ipv4Src[:], 0) &&
+		AllBytes(m.Ipv4Dst[:], 0) &&
+		m.Tos == 0 &&
+		m.Ttl == 0 &&
+		!m.Df && !m.Csum &&
+		m.TpSrc == 0 && m.TpDst == 0
+}
+
+func parseTunnelFlowKey(typ uint16, key []byte, mask []byte) (FlowKey, error) {
+	var k, m TunnelAttrs
+	var kp TunnelAttrsPresence
+	var err error
+
+	if key != nil {
+		k, kp, err = parseTunnelAttrs(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if mask != nil {
+		// We don't care about mask presence information, because a
+		// missing mask attribute means the field is
+		// wildcarded
+		m, _, err = parseTunnelAttrs(mask)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// mask being nil means that no mask attributes were
+		// provided, which means the mask is implicit in the
+		// key attributes provides
+		m = kp.mask()
+	}
+
+	return TunnelFlowKey{key: k, mask: m}, err
+}
+
+var flowKeyParsers = FlowKeyParsers{
+	// Packet QoS priority flow key
+	OVS_KEY_ATTR_PRIORITY: blobFlowKeyParser(4, nil),
+
+	OVS_KEY_ATTR_IN_PORT: FlowKeyParser{
+		parse:      parseInPortFlowKey,
+		exactMask:  []byte{0xff, 0xff, 0xff, 0xff},
+		ignoreMask: []byte{0, 0, 0, 0},
+	},
+
+	OVS_KEY_ATTR_ETHERNET:  ethernetFlowKeyParser,
+	OVS_KEY_ATTR_VLAN:      vlanFlowKeyParser,
+	OVS_KEY_ATTR_ETHERTYPE: etherTypeFlowKeyParser,
+	OVS_KEY_ATTR_IPV4:      ipv4FlowKeyParser,
+	OVS_KEY_ATTR_IPV6:      blobFlowKeyParser(40, nil),
+	OVS_KEY_ATTR_TCP:       transportFlowKeyParser,
+	OVS_KEY_ATTR_UDP:       transportFlowKeyParser,
+	OVS_KEY_ATTR_ICMP:      blobFlowKeyParser(2, nil),
+	OVS_KEY_ATTR_ICMPV6:    blobFlowKeyParser(2, nil),
+	OVS_KEY_ATTR_ARP:       blobFlowKeyParser(24, nil),
+	OVS_KEY_ATTR_ND:        blobFlowKeyParser(28, nil),
+	OVS_KEY_ATTR_SKB_MARK:  blobFlowKeyParser(4, nil),
+	OVS_KEY_ATTR_DP_HASH:   blobFlowKeyParser(4, nil),
+	OVS_KEY_ATTR_SCTP:      transportFlowKeyParser,
+	OVS_KEY_ATTR_TCP_FLAGS: tcpFlagsFlowKeyParser,
+	OVS_KEY_ATTR_RECIRC_ID: recircIdFlowKeyParser,
+	OVS_KEY_ATTR_MPLS:      mplsFlowKeyParser,
+	OVS_KEY_ATTR_CT_STATE:  ctStateFlowKeyParser,
+	OVS_KEY_ATTR_CT_ZONE:   ctZoneFlowKeyParser,
+	OVS_KEY_ATTR_CT_MARK:   ctMarkFlowKeyParser,
+	OVS_KEY_ATTR_CT_LABELS: ctLabelsFlowKeyParser,
+
+	OVS_KEY_ATTR_TUNNEL: FlowKeyParser{
+		parse:      parseTunnelFlowKey,
+		exactMask:  nil,
+		ignoreMask: []byte{},
+	},
+}
+
+// The encap flow key parser refers to flowKeyParsers, so it has to be
+// added here to avoid an initialization loop.
+func init() {
+	flowKeyParsers[OVS_KEY_ATTR_ENCAP] = FlowKeyParser{
+		parse:      parseEncapFlowKey,
+		exactMask:  nil,
+		ignoreMask: []byte{},
+	}
+}
+
+func MakeFlowKeys() FlowKeys {
+	return make(FlowKeys)
+}
+
+func (keys FlowKeys) Add(k FlowKey) {
+	// TODO check for collisions
+	keys[k.TypeId()] = k
+}
+
+// Actions
+
+type Action interface {
+	TypeId() uint16
+	toNlAttr(*NlMsgBuilder)
+	Equals(Action) bool
+}
+
+type OutputAction VportID
+
+func NewOutputAction(vport VportID) OutputAction {
+	return OutputAction(vport)
+}
+
+func (oa OutputAction) String() string {
+	return fmt.Sprintf("OutputAction{vport: %d}", oa)
+}
+
+func (oa OutputAction) VportID() VportID {
+	return VportID(oa)
+}
+
+func (OutputAction) TypeId() uint16 {
+	return OVS_ACTION_ATTR_OUTPUT
+}
+
+func (oa OutputAction) toNlAttr(msg *NlMsgBuilder) {
+	msg.PutUint32Attr(OVS_ACTION_ATTR_OUTPUT, uint32(oa))
+}
+
+func (a OutputAction) Equals(bx Action) bool {
+	b, ok := bx.(OutputAction)
+	if !ok {
+		return false
+	}
+	return a == b
+}
+
+func parseOutputAction(typ uint16, data []byte) (Action, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("flow action type %d has wrong length (expects 4 bytes, got %d)", typ, len(data))
+	}
+
+	return OutputAction(*uint32At(data, 0)), nil
+}
+
+// OVS_ACTION_ATTR_USERSPACE: Send the packet to userspace, to the
+// netlink socket with port id Pid, as an OVS_PACKET_CMD_ACTION
+// upcall carrying Userdata.
+
+type UserspaceAction struct {
+	Pid      uint32
+	Userdata []byte
+}
+
+func NewUserspaceAction(pid uint32, userdata []byte) UserspaceAction {
+	return UserspaceAction{Pid: pid, Userdata: userdata}
+}
+
+func (ua UserspaceAction) String() string {
+	if ua.Userdata == nil {
+		return fmt.Sprintf("UserspaceAction{pid: %d}", ua.Pid)
+	}
+
+	return fmt.Sprintf("UserspaceAction{pid: %d, userdata: %s}", ua.Pid,
+		hex.EncodeToString(ua.Userdata))
+}
+
+func (UserspaceAction) TypeId() uint16 {
+	return OVS_ACTION_ATTR_USERSPACE
+}
+
+func (ua UserspaceAction) toNlAttr(msg *NlMsgBuilder) {
+	msg.PutNestedAttrs(OVS_ACTION_ATTR_USERSPACE, func() {
+		msg.PutUint32Attr(OVS_USERSPACE_ATTR_PID, ua.Pid)
+		if ua.Userdata != nil {
+			msg.PutSliceAttr(OVS_USERSPACE_ATTR_USERDATA, ua.Userdata)
+		}
+	})
+}
+
+func (a UserspaceAction) Equals(bx Action) bool {
+	b, ok := bx.(UserspaceAction)
+	if !ok {
+		return false
+	}
+	return a.Pid == b.Pid && bytes.Equal(a.Userdata, b.Userdata)
+}
+
+func parseUserspaceAction(typ uint16, data []byte) (Action, error) {
+	attrs, err := ParseNestedAttrs(data)
+	if err != nil {
+		return nil, err
+	}
+
+	pid, err := attrs.GetUint32(OVS_USERSPACE_ATTR_PID)
+	if err != nil {
+		return nil, err
+	}
+
+	userdata, err := attrs.Get(OVS_USERSPACE_ATTR_USERDATA, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return UserspaceAction{Pid: pid, Userdata: userdata}, nil
+}
+
+// OVS_ACTION_ATTR_PUSH_VLAN: Push a VLAN tag.  The kernel requires
+// the CFI bit of the TCI to be set.
+
+type PushVlanAction struct {
+	TPID uint16
+	TCI  uint16
+}
+
+func NewPushVlanAction(vid uint16, pcp uint8) PushVlanAction {
+	return PushVlanAction{
+		TPID: ETH_P_8021Q,
+		TCI:  uint16(pcp)<<VLAN_PRIO_SHIFT&VLAN_PRIO_MASK | VLAN_CFI_MASK | vid&VLAN_VID_MASK,
+	}
+}
+
+func (pa PushVlanAction) String() string {
+	return fmt.Sprintf("PushVlanAction{tpid: %#x, vid: %d, pcp: %d}", pa.TPID,
+		pa.TCI&VLAN_VID_MASK, pa.TCI>>VLAN_PRIO_SHIFT)
+}
+
+func (PushVlanAction) TypeId() uint16 {
+	return OVS_ACTION_ATTR_PUSH_VLAN
+}
+
+func (pa PushVlanAction) toNlAttr(msg *NlMsgBuilder) {
+	msg.PutAttr(OVS_ACTION_ATTR_PUSH_VLAN, func() {
+		pos := msg.Grow(4)
+		*uint16At(msg.buf, pos) = uint16ToBE(pa.TPID)
+		*uint16At(msg.buf, pos+2) = uint16ToBE(pa.TCI)
+	})
+}
+
+func (a PushVlanAction) Equals(bx Action) bool {
+	b, ok := bx.(PushVlanAction)
+	if !ok {
+		return false
+	}
+	return a == b
+}
+
+func parsePushVlanAction(typ uint16, data []byte) (Action, error) {
+	if len(data) != 4 {
+		return nil, fmt.Errorf("flow action type %d has wrong length (expects 4 bytes, got %d)", typ, len(data))
+	}
+
+	return PushVlanAction{
+		TPID: uint16FromBE(*uint16At(data, 0)),
+		TCI:  uint16FromBE(*uint16At(data, 2)),
+	}, nil
+}
+
+// OVS_ACTION_ATTR_POP_VLAN: Pop the outermost VLAN tag.
+
+type PopVlanAction struct{}
+
+func NewPopVlanAction() PopVlanAction {
+	return PopVlanAction{}
+}
+
+func (PopVlanAction) String() string {
+	return "PopVlanAction{}"
+}
+
+func (PopVlanAction) TypeId() uint16 {
+	return OVS_ACTION_ATTR_POP_VLAN
+}
+
+func (PopVlanAction) toNlAttr(msg *NlMsgBuilder) {
+	msg.PutEmptyAttr(OVS_ACTION_ATTR_POP_VLAN)
+}
+
+func (PopVlanAction) Equals(bx Action) bool {
+	_, ok := bx.(PopVlanAction)
+	return ok
+}
+
+func parsePopVlanAction(typ uint16, data []byte) (Action, error) {
+	if len(data) != 0 {
+		return nil, fmt.Errorf("flow action type %d has wrong length (expects 0 bytes, got %d)", typ, len(data))
+	}
+
+	return PopVlanAction{}, nil
+}
+
+// OVS_ACTION_ATTR_RECIRC: Send the packet back through the datapath,
+// to be matched again with the given recirc id (see
+// RecircIdFlowKey).  Actions following it apply to the original
+// packet.
+
+type RecircAction struct {
+	ID uint32
+}
+
+func NewRecircAction(id uint32) RecircAction {
+	return RecircAction{ID: id}
+}
+
+func (ra RecircAction) String() string {
+	return fmt.Sprintf("RecircAction{id: %d}", ra.ID)
+}
+
+func (RecircAction) TypeId() uint16 {
+	return OVS_ACTION_ATTR_RECIRC
+}
+
+func (ra RecircAction) toNlAttr(msg *NlMsgBuilder) {
+	msg.PutUint32Attr(OVS_ACTION_ATTR_RECIRC, ra.ID)
+}
+
+func (a RecircAction) Equals(bx Action) bool {
+	b, ok := bx.(RecircAction)
+	if !ok {
+		return false
+	}
+	return a == b
+}
+
+func parseRecircAction(typ uint16, data []byte) (Action, error) {
+	if len(data) != 4 {
+		return nil, fmt.Errorf("flow action type %d has wrong length (expects 4 bytes, got %d)", typ, len(data))
+	}
+
+	return RecircAction{ID: *uint32At(data, 0)}, nil
+}
+
+// OVS_ACTION_ATTR_HASH: Compute a hash of the packet, which later
+// flows can match on with an OVS_KEY_ATTR_DP_HASH key, usually after
+// a RecircAction.  Alg is an OVS_HASH_ALG_* value, and Basis seeds
+// the hash.
+
+type HashAction struct {
+	Alg   uint32
+	Basis uint32
+}
+
+func NewHashAction(basis uint32) HashAction {
+	return HashAction{Alg: OVS_HASH_ALG_L4, Basis: basis}
+}
+
+func (ha HashAction) String() string {
+	return fmt.Sprintf("HashAction{alg: %d, basis: %#x}", ha.Alg, ha.Basis)
+}
+
+func (HashAction) TypeId() uint16 {
+	return OVS_ACTION_ATTR_HASH
+}
+
+// struct ovs_action_hash
+func (ha HashAction) toNlAttr(msg *NlMsgBuilder) {
+	msg.PutAttr(OVS_ACTION_ATTR_HASH, func() {
+		pos := msg.Grow(8)
+		*uint32At(msg.buf, pos) = ha.Alg
+		*uint32At(msg.buf, pos+4) = ha.Basis
+	})
+}
+
+func (a HashAction) Equals(bx Action) bool {
+	b, ok := bx.(HashAction)
+	if !ok {
+		return false
+	}
+	return a == b
+}
+
+func parseHashAction(typ uint16, data []byte) (Action, error) {
+	if len(data) != 8 {
+		return nil, fmt.Errorf("flow action type %d has wrong length (expects 8 bytes, got %d)", typ, len(data))
+	}
+
+	return HashAction{
+		Alg:   *uint32At(data, 0),
+		Basis: *uint32At(data, 4),
+	}, nil
+}
+
+// OVS_ACTION_ATTR_PUSH_MPLS: Push an MPLS label stack entry,
+// changing the packet's ethertype to EtherType (0x8847 or 0x8848).
+
+type PushMplsAction struct {
+	LSE       uint32
+	EtherType uint16
+}
+
+// MPLS labels are 20 bits, so label must be below 1<<20.
+func NewPushMplsAction(label uint32, tc uint8, bos bool, ttl uint8) (PushMplsAction, error) {
+	if label > MPLS_LS_LABEL_MASK>>MPLS_LS_LABEL_SHIFT {
+		return PushMplsAction{}, fmt.Errorf("MPLS label %d out of range", label)
+	}
+
+	if tc > MPLS_LS_TC_MASK>>MPLS_LS_TC_SHIFT {
+		return PushMplsAction{}, fmt.Errorf("MPLS traffic class %d out of range", tc)
+	}
+
+	lse := label<<MPLS_LS_LABEL_SHIFT | uint32(tc)<<MPLS_LS_TC_SHIFT | uint32(ttl)
+	if bos {
+		lse |= MPLS_LS_S_MASK
+	}
+
+	return PushMplsAction{LSE: lse, EtherType: ETH_P_MPLS_UC}, nil
+}
+
+func (pa PushMplsAction) String() string {
+	return fmt.Sprintf("PushMplsAction{ethertype: %#x, label: %d, tc: %d, bos: %t, ttl: %d}",
+		pa.EtherType, pa.LSE>>MPLS_LS_LABEL_SHIFT,
+		pa.LSE&MPLS_LS_TC_MASK>>MPLS_LS_TC_SHIFT, pa.LSE&MPLS_LS_S_MASK != 0,
+		pa.LSE&MPLS_LS_TTL_MASK)
+}
+
+func (PushMplsAction) TypeId() uint16 {
+	return OVS_ACTION_ATTR_PUSH_MPLS
+}
+
+// struct ovs_action_push_mpls, including its trailing padding
+func (pa PushMplsAction) toNlAttr(msg *NlMsgBuilder) {
+	msg.PutAttr(OVS_ACTION_ATTR_PUSH_MPLS, func() {
+		pos := msg.Grow(8)
+		*uint32At(msg.buf, pos) = uint32ToBE(pa.LSE)
+		*uint16At(msg.buf, pos+4) = uint16ToBE(pa.EtherType)
+	})
+}
+
+func (a PushMplsAction) Equals(bx Action) bool {
+	b, ok := bx.(PushMplsAction)
+	if !ok {
+		return false
+	}
+	return a == b
+}
+
+func parsePushMplsAction(typ uint16, data []byte) (Action, error) {
+	if len(data) != 8 {
+		return nil, fmt.Errorf("flow action type %d has wrong length (expects 8 bytes, got %d)", typ, len(data))
+	}
+
+	return PushMplsAction{
+		LSE:       uint32FromBE(*uint32At(data, 0)),
+		EtherType: uint16FromBE(*uint16At(data, 4)),
+	}, nil
+}
+
+// OVS_ACTION_ATTR_POP_MPLS: Pop the outermost MPLS label stack
+// entry, changing the packet's ethertype to EtherType.
+
+type PopMplsAction struct {
+	EtherType uint16
+}
+
+func NewPopMplsAction(ethType uint16) PopMplsAction {
+	return PopMplsAction{EtherType: ethType}
+}
+
+func (pa PopMplsAction) String() string {
+	return fmt.Sprintf("PopMplsAction{ethertype: %#x}", pa.EtherType)
+}
+
+func (PopMplsAction) TypeId() uint16 {
+	return OVS_ACTION_ATTR_POP_MPLS
+}
+
+func (pa PopMplsAction) toNlAttr(msg *NlMsgBuilder) {
+	msg.PutAttr(OVS_ACTION_ATTR_POP_MPLS, func() {
+		pos := msg.Grow(2)
+		*uint16At(msg.buf, pos) = uint16ToBE(pa.EtherType)
+	})
+}
+
+func (a PopMplsAction) Equals(bx Action) bool {
+	b, ok := bx.(PopMplsAction)
+	if !ok {
+		return false
+	}
+	return a == b
+}
+
+func parsePopMplsAction(typ uint16, data []byte) (Action, error) {
+	if len(data) != 2 {
+		return nil, fmt.Errorf("flow action type %d has wrong length (expects 2 bytes, got %d)", typ, len(data))
+	}
+
+	return PopMplsAction{EtherType: uint16FromBE(*uint16At(data, 0))}, nil
+}
+
+// OVS_ACTION_ATTR_SAMPLE: Apply a nested list of actions to a random
+// sample of packets.  Probability is out of 1<<32 - 1, which means
+// always.
+
+type SampleAction struct {
+	Probability uint32
+	Actions     []Action
+}
+
+func NewSampleAction(probability uint32, actions []Action) SampleAction {
+	return SampleAction{Probability: probability, Actions: actions}
+}
+
+func (sa SampleAction) String() string {
+	return fmt.Sprintf("SampleAction{probability: %d, actions: %v}", sa.Probability, sa.Actions)
+}
+
+func (SampleAction) TypeId() uint16 {
+	return OVS_ACTION_ATTR_SAMPLE
+}
+
+func (sa SampleAction) toNlAttr(msg *NlMsgBuilder) {
+	msg.PutNestedAttrs(OVS_ACTION_ATTR_SAMPLE, func() {
+		msg.PutUint32Attr(OVS_SAMPLE_ATTR_PROBABILITY, sa.Probability)
+		msg.PutNestedAttrs(OVS_SAMPLE_ATTR_ACTIONS, func() {
+			for _, a := range sa.Actions {
+				a.toNlAttr(msg)
+			}
+		})
+	})
+}
+
+func (a SampleAction) Equals(bx Action) bool {
+	b, ok := bx.(SampleAction)
+	if !ok || a.Probability != b.Probability || len(a.Actions) != len(b.Actions) {
+		return false
+	}
+
+	for i := range a.Actions {
+		if !a.Actions[i].Equals(b.Actions[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func parseSampleAction(typ uint16, data []byte) (Action, error) {
+	attrs, err := ParseNestedAttrs(data)
+	if err != nil {
+		return nil, err
+	}
+
+	probability, err := attrs.GetUint32(OVS_SAMPLE_ATTR_PROBABILITY)
+	if err != nil {
+		return nil, err
+	}
+
+	actattrs, err := attrs.GetOrderedAttrs(OVS_SAMPLE_ATTR_ACTIONS)
+	if err != nil {
+		return nil, err
+	}
+
+	actions, err := parseActions(actattrs)
+	if err != nil {
+		return nil, err
+	}
+
+	return SampleAction{Probability: probability, Actions: actions}, nil
+}
+
+type SetTunnelAction struct {
+	TunnelAttrs
+	Present TunnelAttrsPresence
+}
+
+func (ta SetTunnelAction) String() string {
+	var buf bytes.Buffer
+	var sep string
+	fmt.Fprint(&buf, "SetTunnelAction{")
+
+	if ta.Present.TunnelId {
+		fmt.Fprintf(&buf, "%sid: %s", sep,
+			hex.EncodeToString(ta.TunnelId[:]))
+		sep = ", "
+	}
+
+	if ta.Present.Ipv4Src {
+		fmt.Fprintf(&buf, "%sipv4src: %s", sep,
+			ipv4ToString(ta.Ipv4Src[:]))
+		sep = ", "
+	}
+
+	if ta.Present.Ipv4Dst {
+		fmt.Fprintf(&buf, "%sipv4dst: %s", sep,
+			ipv4ToString(ta.Ipv4Dst[:]))
+		sep = ", "
+	}
+
+	if ta.Present.Tos {
+		fmt.Fprintf(&buf, "%stos: %d", sep, ta.Tos)
+		sep = ", "
+	}
+
+	if ta.Present.Ttl {
+		fmt.Fprintf(&buf, "%sttl: %d", sep, ta.Ttl)
+		sep = ", "
+	}
+
+	if ta.Present.Df {
+		fmt.Fprintf(&buf, "%sdf: %t", sep, ta.Df)
+		sep = ", "
+	}
+
+	if ta.Present.Csum {
+		fmt.Fprintf(&buf, "%scsum: %t", sep, ta.Csum)
+		sep = ", "
+	}
+
+	if ta.Present.TpSrc {
+		fmt.Fprintf(&buf, "%stpsrc: %d", sep, ta.TpSrc)
+		sep = ", "
+	}
+
+	if ta.Present.TpDst {
+		fmt.Fprintf(&buf, "%stpdst: %d", sep, ta.TpDst)
+		sep = ", "
+	}
+
+	fmt.Fprint(&buf, "}")
+	return buf.String()
+}
+
+func (SetTunnelAction) TypeId() uint16 {
+	return OVS_ACTION_ATTR_SET
+}
+
+func (ta SetTunnelAction) toNlAttr(msg *NlMsgBuilder) {
+	msg.PutNestedAttrs(OVS_ACTION_ATTR_SET, func() {
+		msg.PutNestedAttrs(OVS_KEY_ATTR_TUNNEL, func() {
+			ta.Present.Df = ta.Df
+			ta.Present.Csum = ta.Csum
+			ta.TunnelAttrs.toNlAttrs(msg, ta.Present)
+		})
+	})
+}
+
+func (a SetTunnelAction) Equals(bx Action) bool {
+	b, ok := bx.(SetTunnelAction)
+	if !ok {
+		return false
+	}
+	return a.TunnelAttrs == b.TunnelAttrs
+}
+
+func (a *SetTunnelAction) SetTunnelId(id [8]byte) {
+	a.TunnelId = id
+	a.Present.TunnelId = true
+}
+
+func (a *SetTunnelAction) SetIpv4Src(addr [4]byte) {
+	a.Ipv4Src = addr
+	a.Present.Ipv4Src = true
+}
+
+func (a *SetTunnelAction) SetIpv4Dst(addr [4]byte) {
+	a.Ipv4Dst = addr
+	a.Present.Ipv4Dst = true
+}
+
+func (a *SetTunnelAction) SetTos(tos uint8) {
+	a.Tos = tos
+	a.Present.Tos = true
+}
+
+func (a *SetTunnelAction) SetTtl(ttl uint8) {
+	a.Ttl = ttl
+	a.Present.Ttl = true
+}
+
+func (a *SetTunnelAction) SetDf(df bool) {
+	a.Df = df
+	a.Present.Df = true
+}
+
+func (a *SetTunnelAction) SetCsum(csum bool) {
+	a.Csum = csum
+	a.Present.Csum = true
+}
+
+func (a *SetTunnelAction) SetTpSrc(port uint16) {
+	a.TpSrc = port
+	a.Present.TpSrc = true
+}
+
+func (a *SetTunnelAction) SetTpDst(port uint16) {
+	a.TpDst = port
+	a.Present.TpDst = true
+}
+
+// OVS_ACTION_ATTR_SET with a flow key other than a tunnel key:
+// Rewrite the packet header fields covered by the flow key.  The
+// whole of the flow key is written, so its mask is disregarded; e.g.
+// to rewrite the IPv4 destination, the other fields of the IPv4 key
+// must be set to the packet's existing values.
+
+type SetFieldAction struct {
+	Key FlowKey
+}
+
+func NewSetFieldAction(key FlowKey) SetFieldAction {
+	return SetFieldAction{Key: key}
+}
+
+func (sa SetFieldAction) String() string {
+	return fmt.Sprintf("SetFieldAction{%v}", sa.Key)
+}
+
+func (SetFieldAction) TypeId() uint16 {
+	return OVS_ACTION_ATTR_SET
+}
+
+func (sa SetFieldAction) toNlAttr(msg *NlMsgBuilder) {
+	msg.PutNestedAttrs(OVS_ACTION_ATTR_SET, func() {
+		sa.Key.putKeyNlAttr(msg)
+	})
+}
+
+func (a SetFieldAction) Equals(bx Action) bool {
+	b, ok := bx.(SetFieldAction)
+	if !ok {
+		return false
+	}
+
+	// Compare only the key values if we can, as masks don't
+	// apply
+	abx, aok := a.Key.(BlobFlowKeyish)
+	bbx, bok := b.Key.(BlobFlowKeyish)
+	if aok && bok {
+		ab := abx.toBlobFlowKey()
+		bb := bbx.toBlobFlowKey()
+		return ab.typ == bb.typ && bytes.Equal(ab.key(), bb.key())
+	}
+
+	return a.Key.Equals(b.Key)
+}
+
+func parseSetAction(typ uint16, data []byte) (Action, error) {
+	attrs, err := ParseNestedAttrs(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var res Action
+	first := true
+	for typ, data := range attrs {
+		if !first {
+			return nil, fmt.Errorf("multiple attributes within OVS_ACTION_ATTR_SET")
+		}
+
+		switch typ {
+		case OVS_KEY_ATTR_TUNNEL:
+			ta, present, err := parseTunnelAttrs(data)
+			if err != nil {
+				return nil, err
+			}
+			res = SetTunnelAction{TunnelAttrs: ta, Present: present}
+			break
+
+		default:
+			parser, ok := flowKeyParsers[typ]
+			if !ok {
+				return nil, fmt.Errorf("unsupported OVS_ACTION_ATTR_SET attribute %d", typ)
+			}
+
+			fk, err := parser.parse(typ, data, parser.exactMask)
+			if err != nil {
+				return nil, err
+			}
+			res = SetFieldAction{Key: fk}
+		}
+
+		first = false
+	}
+
+	return res, nil
+}
+
+// OVS_ACTION_ATTR_CT: Send the packet through the kernel's
+// connection tracker, so that later flows (after recirculation) can
+// match on the ct_* flow keys.  When Commit is set, the connection is
+// committed, and Mark and Labels are stored on it under their masks
+// (which must be nonzero for them to be set).  NAT, if non-nil,
+// applies network address translation.  EventMask, if non-nil,
+// limits the conntrack events generated for the connection, and
+// Timeout names a conntrack timeout policy.
+
+type ConntrackAction struct {
+	Commit      bool
+	ForceCommit bool
+	Zone        uint16
+	Mark        uint32
+	MarkMask    uint32
+	Labels      [OVS_CT_LABELS_LEN]byte
+	LabelsMask  [OVS_CT_LABELS_LEN]byte
+	Helper      string
+	NAT         *ConntrackNAT
+	EventMask   *uint32
+	Timeout     string
+}
+
+// The NAT options of a ConntrackAction.  An empty ConntrackNAT
+// applies the NAT already established for the connection.  Otherwise
+// one of Src or Dst should be set, and the addresses and ports are
+// translated to the ranges given (IPMax and ProtoMax are optional).
+
+type ConntrackNAT struct {
+	Src         bool
+	Dst         bool
+	IPMin       net.IP
+	IPMax       net.IP
+	ProtoMin    uint16
+	ProtoMax    uint16
+	Persistent  bool
+	ProtoHash   bool
+	ProtoRandom bool
+}
+
+func NewConntrackAction(commit bool, zone uint16) ConntrackAction {
+	return ConntrackAction{Commit: commit, Zone: zone}
+}
+
+func (ca ConntrackAction) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "ConntrackAction{zone: %d", ca.Zone)
+	if ca.Commit {
+		fmt.Fprint(&buf, ", commit")
+	}
+	if ca.ForceCommit {
+		fmt.Fprint(&buf, ", force_commit")
+	}
+	if ca.MarkMask != 0 {
+		fmt.Fprintf(&buf, ", mark: %#x&%x", ca.Mark, ca.MarkMask)
+	}
+	if !AllBytes(ca.LabelsMask[:], 0) {
+		fmt.Fprintf(&buf, ", labels: %s&%s", ctLabelsToString(ca.Labels[:]),
+			ctLabelsToString(ca.LabelsMask[:]))
+	}
+	if ca.Helper != "" {
+		fmt.Fprintf(&buf, ", helper: %s", ca.Helper)
+	}
+	if ca.NAT != nil {
+		fmt.Fprintf(&buf, ", nat: %v", *ca.NAT)
+	}
+	if ca.EventMask != nil {
+		fmt.Fprintf(&buf, ", eventmask: %#x", *ca.EventMask)
+	}
+	if ca.Timeout != "" {
+		fmt.Fprintf(&buf, ", timeout: %s", ca.Timeout)
+	}
+	fmt.Fprint(&buf, "}")
+	return buf.String()
+}
+
+func (ConntrackAction) TypeId() uint16 {
+	return OVS_ACTION_ATTR_CT
+}
+
+func (ca ConntrackAction) toNlAttr(msg *NlMsgBuilder) {
+	msg.PutNestedAttrs(OVS_ACTION_ATTR_CT, func() {
+		if ca.Commit {
+			msg.PutEmptyAttr(OVS_CT_ATTR_COMMIT)
+		}
+		if ca.ForceCommit {
+			msg.PutEmptyAttr(OVS_CT_ATTR_FORCE_COMMIT)
+		}
+		if ca.Zone != 0 {
+			msg.PutUint16Attr(OVS_CT_ATTR_ZONE, ca.Zone)
+		}
+		if ca.MarkMask != 0 {
+			// struct md_mark
+			msg.PutAttr(OVS_CT_ATTR_MARK, func() {
+				pos := msg.Grow(8)
+				*uint32At(msg.buf, pos) = ca.Mark
+				*uint32At(msg.buf, pos+4) = ca.MarkMask
+			})
+		}
+		if !AllBytes(ca.LabelsMask[:], 0) {
+			// struct md_labels
+			msg.PutAttr(OVS_CT_ATTR_LABELS, func() {
+				pos := msg.Grow(2 * OVS_CT_LABELS_LEN)
+				copy(msg.buf[pos:], ca.Labels[:])
+				copy(msg.buf[pos+OVS_CT_LABELS_LEN:], ca.LabelsMask[:])
+			})
+		}
+		if ca.Helper != "" {
+			msg.PutStringAttr(OVS_CT_ATTR_HELPER, ca.Helper)
+		}
+		if ca.NAT != nil {
+			msg.PutNestedAttrs(OVS_CT_ATTR_NAT, func() {
+				ca.NAT.toNlAttrs(msg)
+			})
+		}
+		if ca.EventMask != nil {
+			msg.PutUint32Attr(OVS_CT_ATTR_EVENTMASK, *ca.EventMask)
+		}
+		if ca.Timeout != "" {
+			msg.PutStringAttr(OVS_CT_ATTR_TIMEOUT, ca.Timeout)
+		}
+	})
+}
+
+func (nat ConntrackNAT) toNlAttrs(msg *NlMsgBuilder) {
+	if nat.Src {
+		msg.PutEmptyAttr(OVS_NAT_ATTR_SRC)
+	}
+	if nat.Dst {
+		msg.PutEmptyAttr(OVS_NAT_ATTR_DST)
+	}
+	if nat.IPMin != nil {
+		msg.PutSliceAttr(OVS_NAT_ATTR_IP_MIN, natIPBytes(nat.IPMin))
+	}
+	if nat.IPMax != nil {
+		msg.PutSliceAttr(OVS_NAT_ATTR_IP_MAX, natIPBytes(nat.IPMax))
+	}
+	if nat.ProtoMin != 0 {
+		msg.PutUint16Attr(OVS_NAT_ATTR_PROTO_MIN, nat.ProtoMin)
+	}
+	if nat.ProtoMax != 0 {
+		msg.PutUint16Attr(OVS_NAT_ATTR_PROTO_MAX, nat.ProtoMax)
+	}
+	if nat.Persistent {
+		msg.PutEmptyAttr(OVS_NAT_ATTR_PERSISTENT)
+	}
+	if nat.ProtoHash {
+		msg.PutEmptyAttr(OVS_NAT_ATTR_PROTO_HASH)
+	}
+	if nat.ProtoRandom {
+		msg.PutEmptyAttr(OVS_NAT_ATTR_PROTO_RANDOM)
+	}
+}
+
+// The kernel takes 4 bytes for an IPv4 NAT address, and 16 for IPv6
+func natIPBytes(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
+
+func (a ConntrackAction) Equals(bx Action) bool {
+	b, ok := bx.(ConntrackAction)
+	if !ok || a.NAT == nil != (b.NAT == nil) ||
+		a.EventMask == nil != (b.EventMask == nil) {
+		return false
+	}
+
+	if a.EventMask != nil && *a.EventMask != *b.EventMask {
+		return false
+	}
+
+	if a.NAT != nil && !a.NAT.Equals(*b.NAT) {
+		return false
+	}
+
+	return a.Commit == b.Commit && a.ForceCommit == b.ForceCommit &&
+		a.Zone == b.Zone && a.Mark == b.Mark && a.MarkMask == b.MarkMask &&
+		a.Labels == b.Labels && a.LabelsMask == b.LabelsMask &&
+		a.Helper == b.Helper && a.Timeout == b.Timeout
+}
+
+func (a ConntrackNAT) Equals(b ConntrackNAT) bool {
+	return a.Src == b.Src && a.Dst == b.Dst &&
+		natIPEqual(a.IPMin, b.IPMin) && natIPEqual(a.IPMax, b.IPMax) &&
+		a.ProtoMin == b.ProtoMin && a.ProtoMax == b.ProtoMax &&
+		a.Persistent == b.Persistent && a.ProtoHash == b.ProtoHash &&
+		a.ProtoRandom == b.ProtoRandom
+}
+
+func natIPEqual(a, b net.IP) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Equal(b)
+}
+
+func parseConntrackAction(typ uint16, data []byte) (Action, error) {
+	attrs, err := ParseNestedAttrs(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var ca ConntrackAction
+	if ca.Commit, err = attrs.GetEmpty(OVS_CT_ATTR_COMMIT); err != nil {
+		return nil, err
+	}
+
+	if ca.ForceCommit, err = attrs.GetEmpty(OVS_CT_ATTR_FORCE_COMMIT); err != nil {
+		return nil, err
+	}
+
+	if ca.Zone, _, err = attrs.GetOptionalUint16(OVS_CT_ATTR_ZONE); err != nil {
+		return nil, err
+	}
+
+	mark, err := attrs.GetFixedBytes(OVS_CT_ATTR_MARK, 8, true)
+	if err != nil {
+		return nil, err
+	}
+	if mark != nil {
+		ca.Mark = *uint32At(mark, 0)
+		ca.MarkMask = *uint32At(mark, 4)
+	}
 
-	if ta.Present.Ipv4Src {
-		fmt.Fprintf(&buf, "%sipv4src: %s", sep,
-			ipv4ToString(ta.Ipv4Src[:]))
-		sep = ", "
+	labels, err := attrs.GetFixedBytes(OVS_CT_ATTR_LABELS,
+		2*OVS_CT_LABELS_LEN, true)
+	if err != nil {
+		return nil, err
+	}
+	if labels != nil {
+		copy(ca.Labels[:], labels)
+		copy(ca.LabelsMask[:], labels[OVS_CT_LABELS_LEN:])
 	}
 
-	if ta.Present.Ipv4Dst {
-		fmt.Fprintf(&buf, "%sipv4dst: %s", sep,
-			ipv4ToString(ta.Ipv4Dst[:]))
-		sep = ", "
+	if _, ok := attrs[OVS_CT_ATTR_HELPER]; ok {
+		if ca.Helper, err = attrs.GetString(OVS_CT_ATTR_HELPER); err != nil {
+			return nil, err
+		}
 	}
 
-	if ta.Present.Tos {
-		fmt.Fprintf(&buf, "%stos: %d", sep, ta.Tos)
-		sep = ", "
+	natattrs, err := attrs.GetNestedAttrs(OVS_CT_ATTR_NAT, true)
+	if err != nil {
+		return nil, err
+	}
+	if natattrs != nil {
+		nat, err := parseConntrackNAT(natattrs)
+		if err != nil {
+			return nil, err
+		}
+		ca.NAT = &nat
 	}
 
-	if ta.Present.Ttl {
-		fmt.Fprintf(&buf, "%sttl: %d", sep, ta.Ttl)
-		sep = ", "
+	eventMask, present, err := attrs.GetOptionalUint32(OVS_CT_ATTR_EVENTMASK)
+	if err != nil {
+		return nil, err
+	}
+	if present {
+		ca.EventMask = &eventMask
 	}
 
-	if ta.Present.Df {
-		fmt.Fprintf(&buf, "%sdf: %t", sep, ta.Df)
-		sep = ", "
+	if _, ok := attrs[OVS_CT_ATTR_TIMEOUT]; ok {
+		if ca.Timeout, err = attrs.GetString(OVS_CT_ATTR_TIMEOUT); err != nil {
+			return nil, err
+		}
 	}
 
-	if ta.Present.Csum {
-		fmt.Fprintf(&buf, "%scsum: %t", sep, ta.Csum)
-		sep = ", "
+	return ca, nil
+}
+
+func parseConntrackNAT(attrs Attrs) (nat ConntrackNAT, err error) {
+	flags := []struct {
+		typ uint16
+		val *bool
+	}{
+		{OVS_NAT_ATTR_SRC, &nat.Src},
+		{OVS_NAT_ATTR_DST, &nat.Dst},
+		{OVS_NAT_ATTR_PERSISTENT, &nat.Persistent},
+		{OVS_NAT_ATTR_PROTO_HASH, &nat.ProtoHash},
+		{OVS_NAT_ATTR_PROTO_RANDOM, &nat.ProtoRandom},
+	}
+	for _, f := range flags {
+		if *f.val, err = attrs.GetEmpty(f.typ); err != nil {
+			return
+		}
 	}
 
-	if ta.Present.TpSrc {
-		fmt.Fprintf(&buf, "%stpsrc: %d", sep, ta.TpSrc)
-		sep = ", "
+	if nat.IPMin, err = parseNATIP(attrs, OVS_NAT_ATTR_IP_MIN); err != nil {
+		return
 	}
 
-	if ta.Present.TpDst {
-		fmt.Fprintf(&buf, "%stpdst: %d", sep, ta.TpDst)
-		sep = ", "
+	if nat.IPMax, err = parseNATIP(attrs, OVS_NAT_ATTR_IP_MAX); err != nil {
+		return
 	}
 
-	fmt.Fprint(&buf, "}")
-	return buf.String()
-}
+	if nat.ProtoMin, _, err = attrs.GetOptionalUint16(OVS_NAT_ATTR_PROTO_MIN); err != nil {
+		return
+	}
 
-func (SetTunnelAction) TypeId() uint16 {
-	return OVS_ACTION_ATTR_SET
+	nat.ProtoMax, _, err = attrs.GetOptionalUint16(OVS_NAT_ATTR_PROTO_MAX)
+	return
 }
 
-func (ta SetTunnelAction) toNlAttr(msg *NlMsgBuilder) {
-	msg.PutNestedAttrs(OVS_ACTION_ATTR_SET, func() {
-		msg.PutNestedAttrs(OVS_KEY_ATTR_TUNNEL, func() {
-			ta.Present.Df = ta.Df
-			ta.Present.Csum = ta.Csum
-			ta.TunnelAttrs.toNlAttrs(msg, ta.Present)
-		})
-	})
-}
+func parseNATIP(attrs Attrs, typ uint16) (net.IP, error) {
+	val, err := attrs.Get(typ, true)
+	if err != nil || val == nil {
+		return nil, err
+	}
 
-func (a SetTunnelAction) Equals(bx Action) bool {
-	b, ok := bx.(SetTunnelAction)
-	if !ok {
-		return false
+	if len(val) != net.IPv4len && len(val) != net.IPv6len {
+		return nil, fmt.Errorf("NAT address attribute %d has wrong length (%d bytes)", typ, len(val))
 	}
-	return a.TunnelAttrs == b.TunnelAttrs
-}
 
-func (a *SetTunnelAction) SetTunnelId(id [8]byte) {
-	a.TunnelId = id
-	a.Present.TunnelId = true
+	return append(net.IP(nil), val...), nil
 }
 
-func (a *SetTunnelAction) SetIpv4Src(addr [4]byte) {
-	a.Ipv4Src = addr
-	a.Present.Ipv4Src = true
+var actionParsers = map[uint16](func(uint16, []byte) (Action, error)){
+	OVS_ACTION_ATTR_OUTPUT:    parseOutputAction,
+	OVS_ACTION_ATTR_USERSPACE: parseUserspaceAction,
+	OVS_ACTION_ATTR_SET:       parseSetAction,
+	OVS_ACTION_ATTR_PUSH_VLAN: parsePushVlanAction,
+	OVS_ACTION_ATTR_POP_VLAN:  parsePopVlanAction,
+	OVS_ACTION_ATTR_RECIRC:    parseRecircAction,
+	OVS_ACTION_ATTR_HASH:      parseHashAction,
+	OVS_ACTION_ATTR_PUSH_MPLS: parsePushMplsAction,
+	OVS_ACTION_ATTR_POP_MPLS:  parsePopMplsAction,
+	OVS_ACTION_ATTR_CT:        parseConntrackAction,
 }
 
-func (a *SetTunnelAction) SetIpv4Dst(addr [4]byte) {
-	a.Ipv4Dst = addr
-	a.Present.Ipv4Dst = true
+// The sample action parser refers to actionParsers, so it has to be
+// added here to avoid an initialization loop.
+func init() {
+	actionParsers[OVS_ACTION_ATTR_SAMPLE] = parseSampleAction
 }
 
-func (a *SetTunnelAction) SetTos(tos uint8) {
-	a.Tos = tos
-	a.Present.Tos = true
-}
+// An action of a type we don't know how to parse, holding the
+// attribute value.  This allows flows with such actions to be
+// dumped, and even recreated.
 
-func (a *SetTunnelAction) SetTtl(ttl uint8) {
-	a.Ttl = ttl
-	a.Present.Ttl = true
+type RawAction struct {
+	Type  uint16
+	Value []byte
 }
 
-func (a *SetTunnelAction) SetDf(df bool) {
-	a.Df = df
-	a.Present.Df = true
+func (ra RawAction) String() string {
+	return fmt.Sprintf("RawAction{type: %d, value: %s}", ra.Type, hex.EncodeToString(ra.Value))
 }
 
-func (a *SetTunnelAction) SetCsum(csum bool) {
-	a.Csum = csum
-	a.Present.Csum = true
+func (ra RawAction) TypeId() uint16 {
+	return ra.Type
 }
 
-func (a *SetTunnelAction) SetTpSrc(port uint16) {
-	a.TpSrc = port
-	a.Present.TpSrc = true
+func (ra RawAction) toNlAttr(msg *NlMsgBuilder) {
+	msg.PutSliceAttr(ra.Type, ra.Value)
 }
 
-func (a *SetTunnelAction) SetTpDst(port uint16) {
-	a.TpDst = port
-	a.Present.TpDst = true
+func (a RawAction) Equals(bx Action) bool {
+	b, ok := bx.(RawAction)
+	if !ok {
+		return false
+	}
+	return a.Type == b.Type && bytes.Equal(a.Value, b.Value)
 }
 
-func parseSetAction(typ uint16, data []byte) (Action, error) {
-	attrs, err := ParseNestedAttrs(data)
+// Parse the value of an OVS_FLOW_ATTR_ACTIONS or
+// OVS_PACKET_ATTR_ACTIONS attribute.
+func ParseActions(data []byte) ([]Action, error) {
+	actattrs, err := ParseOrderedAttrs(data)
 	if err != nil {
 		return nil, err
 	}
 
-	var res Action
-	first := true
-	for typ, data := range attrs {
-		if !first {
-			return nil, fmt.Errorf("multiple attributes within OVS_ACTION_ATTR_SET")
-		}
-
-		switch typ {
-		case OVS_KEY_ATTR_TUNNEL:
-			ta, present, err := parseTunnelAttrs(data)
-			if err != nil {
-				return nil, err
-			}
-			res = SetTunnelAction{TunnelAttrs: ta, Present: present}
-			break
+	return parseActions(actattrs)
+}
 
-		default:
-			return nil, fmt.Errorf("unsupported OVS_ACTION_ATTR_SET attribute %d", typ)
+func parseActions(actattrs []Attr) ([]Action, error) {
+	actions := make([]Action, 0)
+	for _, actattr := range actattrs {
+		parser, ok := actionParsers[actattr.Type]
+		if !ok {
+			actions = append(actions, RawAction{Type: actattr.Type, Value: actattr.Value})
+			continue
 		}
 
-		first = false
+		action, err := parser(actattr.Type, actattr.Value)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, action)
 	}
 
-	return res, nil
-}
-
-var actionParsers = map[uint16](func(uint16, []byte) (Action, error)){
-	OVS_ACTION_ATTR_OUTPUT: parseOutputAction,
-	OVS_ACTION_ATTR_SET:    parseSetAction,
+	return actions, nil
 }
 
 // Complete flows
@@ -1051,13 +2730,7 @@ func NewFlowSpec() FlowSpec {
 }
 
 func (f FlowSpec) String() string {
-	var keys []FlowKey
-
-	for _, k := range f.FlowKeys {
-		keys = append(keys, k)
-	}
-
-	return fmt.Sprintf("FlowSpec{keys: %v, actions: %v}", keys, f.Actions)
+	return fmt.Sprintf("FlowSpec{keys: %s, actions: %v}", f.FlowKeys, f.Actions)
 }
 
 func (f *FlowSpec) AddKey(k FlowKey) {
@@ -1127,70 +2800,138 @@ func parseFlowSpec(attrs Attrs) (f FlowSpec, err error) {
 		return f, err
 	}
 
-	actions := make([]Action, 0)
-	for _, actattr := range actattrs {
-		parser, ok := actionParsers[actattr.typ]
-		if !ok {
-			return f, fmt.Errorf("unknown action type %d (value %v)", actattr.typ, actattr.val)
-		}
-
-		action, err := parser(actattr.typ, actattr.val)
-		if err != nil {
-			return f, err
-		}
-		actions = append(actions, action)
-	}
-
-	f.Actions = actions
-	return f, nil
+	f.Actions, err = parseActions(actattrs)
+	return f, err
 }
 
 func (dp DatapathHandle) CreateFlow(f FlowSpec) error {
 	dpif := dp.dpif
 
-	req := NewNlMsgBuilder(RequestFlags, dpif.families[FLOW].id)
+	req := GetBuilder(RequestFlags, dpif.families[FLOW].id)
+	defer req.Release()
 	req.PutGenlMsghdr(OVS_FLOW_CMD_NEW, OVS_FLOW_VERSION)
-	req.putOvsHeader(dp.ifindex)
+	req.PutOvsHeader(dp.ifindex)
 	f.toNlAttrs(req)
 
 	_, err := dpif.sock.Request(req)
 	return err
 }
 
+// Like CreateFlow, but returning the new flow as echoed by the
+// kernel.  This is the same message that other sockets subscribed to
+// the ovs_flow multicast group receive as a notification (see
+// RequestFlags).
+func (dp DatapathHandle) CreateFlowEcho(f FlowSpec) (FlowInfo, error) {
+	return dp.requestFlowEcho(OVS_FLOW_CMD_NEW, f)
+}
+
+// Replace the actions of an existing flow, returning the flow as
+// echoed by the kernel.
+func (dp DatapathHandle) SetFlow(f FlowSpec) (FlowInfo, error) {
+	return dp.requestFlowEcho(OVS_FLOW_CMD_SET, f)
+}
+
+func (dp DatapathHandle) requestFlowEcho(cmd uint8, f FlowSpec) (FlowInfo, error) {
+	dpif := dp.dpif
+
+	req := GetBuilder(RequestFlags, dpif.families[FLOW].id)
+	defer req.Release()
+	req.PutGenlMsghdr(cmd, OVS_FLOW_VERSION)
+	req.PutOvsHeader(dp.ifindex)
+	f.toNlAttrs(req)
+
+	resp, err := dpif.sock.Request(req)
+	if err != nil {
+		return FlowInfo{}, err
+	}
+
+	// The reply to a SET may carry OVS_FLOW_CMD_NEW rather than
+	// OVS_FLOW_CMD_SET, so don't insist on either.
+	if err := dp.checkNlMsgHeaders(resp, FLOW, -1); err != nil {
+		return FlowInfo{}, err
+	}
+
+	attrs, err := resp.TakeAttrs()
+	if err != nil {
+		return FlowInfo{}, err
+	}
+
+	return parseFlowInfo(attrs)
+}
+
+// Create several flows, sending the requests to the kernel in
+// batches.  All of the flows are attempted, even if some fail.
+func (dp DatapathHandle) CreateFlows(fs []FlowSpec) error {
+	dpif := dp.dpif
+
+	var batch NlMsgBatch
+	for _, f := range fs {
+		req := GetBuilder(AckFlags, dpif.families[FLOW].id)
+		req.PutGenlMsghdr(OVS_FLOW_CMD_NEW, OVS_FLOW_VERSION)
+		req.PutOvsHeader(dp.ifindex)
+		f.toNlAttrs(req)
+		batch.Add(req)
+		req.Release()
+	}
+
+	return dpif.sock.RequestBatch(&batch)
+}
+
 func (dp DatapathHandle) DeleteFlow(fks FlowKeys) error {
 	dpif := dp.dpif
 
-	req := NewNlMsgBuilder(RequestFlags, dpif.families[FLOW].id)
+	req := GetBuilder(AckFlags, dpif.families[FLOW].id)
+	defer req.Release()
 	req.PutGenlMsghdr(OVS_FLOW_CMD_DEL, OVS_FLOW_VERSION)
-	req.putOvsHeader(dp.ifindex)
+	req.PutOvsHeader(dp.ifindex)
 	fks.toNlAttrs(req)
 
-	_, err := dpif.sock.Request(req)
+	err := dpif.sock.RequestAck(req)
 	return err
 }
 
-func (dp DatapathHandle) ClearFlow(f FlowSpec) error {
+// Delete all flows on the datapath.  An OVS_FLOW_CMD_DEL without a
+// flow key does this in one request.
+func (dp DatapathHandle) FlushFlows() error {
 	dpif := dp.dpif
 
-	req := NewNlMsgBuilder(RequestFlags, dpif.families[FLOW].id)
+	req := NewNlMsgBuilder(AckFlags, dpif.families[FLOW].id)
+	req.PutGenlMsghdr(OVS_FLOW_CMD_DEL, OVS_FLOW_VERSION)
+	req.PutOvsHeader(dp.ifindex)
+
+	return dpif.sock.RequestAck(req)
+}
+
+func (dp DatapathHandle) ClearFlow(f FlowSpec) error {
+	return dp.dpif.sock.RequestAck(dp.clearFlowRequest(AckFlags, f.toNlAttrs))
+}
+
+// Build an OVS_FLOW_CMD_SET request that resets the statistics of
+// the flow described by the attributes putFlow adds.
+func (dp DatapathHandle) clearFlowRequest(flags uint16, putFlow func(*NlMsgBuilder)) *NlMsgBuilder {
+	req := NewNlMsgBuilder(flags, dp.dpif.families[FLOW].id)
 	req.PutGenlMsghdr(OVS_FLOW_CMD_SET, OVS_FLOW_VERSION)
-	req.putOvsHeader(dp.ifindex)
-	f.toNlAttrs(req)
+	req.PutOvsHeader(dp.ifindex)
+	putFlow(req)
 	req.PutEmptyAttr(OVS_FLOW_ATTR_CLEAR)
-
-	_, err := dpif.sock.Request(req)
-	return err
+	return req
 }
 
 func IsNoSuchFlowError(err error) bool {
-	return err == NetlinkError(syscall.ENOENT)
+	return isNetlinkError(err, syscall.ENOENT)
 }
 
 type FlowInfo struct {
 	FlowSpec
 	Packets uint64
 	Bytes   uint64
-	Used    uint64
+
+	// When the flow last matched a packet, in milliseconds on the
+	// kernel's CLOCK_MONOTONIC.  Zero if it has never been used.
+	Used uint64
+
+	// Union of the TCP flags seen in packets matching the flow
+	TcpFlags uint8
 }
 
 func parseFlowInfo(attrs Attrs) (fi FlowInfo, err error) {
@@ -1218,16 +2959,73 @@ func parseFlowInfo(attrs Attrs) (fi FlowInfo, err error) {
 		fi.Used = used
 	}
 
+	// The kernel only includes TCP_FLAGS when they are nonzero
+	fi.TcpFlags, _, err = attrs.GetOptionalUint8(OVS_FLOW_ATTR_TCP_FLAGS)
 	return
 }
 
+// IdleTime returns how long it is since the flow last matched a
+// packet.  The second result is false if the flow has never been
+// used.
+func (fi FlowInfo) IdleTime() (time.Duration, bool, error) {
+	if fi.Used == 0 {
+		return 0, false, nil
+	}
+
+	now, err := monotonicMillis()
+	if err != nil {
+		return 0, false, err
+	}
+
+	return idleTime(fi.Used, now), true, nil
+}
+
+func idleTime(used, now uint64) time.Duration {
+	if now < used {
+		return 0
+	}
+
+	return time.Duration(now-used) * time.Millisecond
+}
+
+// Look up the flow with the given keys, returning its current
+// statistics.  If clear is set, the statistics are also reset in the
+// same request, so that nothing counted between reading and clearing
+// them is lost; the returned FlowInfo holds the values from just
+// before the reset.
+func (dp DatapathHandle) GetFlowStats(fks FlowKeys, clear bool) (FlowInfo, error) {
+	dpif := dp.dpif
+
+	var req *NlMsgBuilder
+	if clear {
+		req = dp.clearFlowRequest(RequestFlags, fks.toNlAttrs)
+	} else {
+		req = NewNlMsgBuilder(RequestFlags, dpif.families[FLOW].id)
+		req.PutGenlMsghdr(OVS_FLOW_CMD_GET, OVS_FLOW_VERSION)
+		req.PutOvsHeader(dp.ifindex)
+		fks.toNlAttrs(req)
+	}
+
+	resp, err := dpif.sock.Request(req)
+	if err != nil {
+		return FlowInfo{}, err
+	}
+
+	attrs, err := dp.parseFlowMsg(resp)
+	if err != nil {
+		return FlowInfo{}, err
+	}
+
+	return parseFlowInfo(attrs)
+}
+
 func (dp DatapathHandle) EnumerateFlows() ([]FlowInfo, error) {
 	dpif := dp.dpif
 	res := make([]FlowInfo, 0)
 
 	req := NewNlMsgBuilder(DumpFlags, dpif.families[FLOW].id)
 	req.PutGenlMsghdr(OVS_FLOW_CMD_GET, OVS_FLOW_VERSION)
-	req.putOvsHeader(dp.ifindex)
+	req.PutOvsHeader(dp.ifindex)
 
 	consumer := func(resp *NlMsgParser) error {
 		attrs, err := dp.parseFlowMsg(resp)
@@ -1251,3 +3049,79 @@ func (dp DatapathHandle) EnumerateFlows() ([]FlowInfo, error) {
 
 	return res, nil
 }
+
+// Notifications for both new flows and changed flows (e.g. by
+// SetFlow) go to FlowChanged, as the kernel may send either as
+// OVS_FLOW_CMD_NEW.
+type FlowEventsConsumer interface {
+	FlowChanged(ifindex int32, flow FlowInfo) error
+	FlowDeleted(ifindex int32, flow FlowInfo) error
+	Error(err error, stopped bool)
+}
+
+// Consume notifications from the ovs_flow multicast group, dropping
+// those caused by requests from the given netlink port ids (as with
+// ConsumeVportEventsIgnoring).
+func (dpif *Dpif) ConsumeFlowEvents(consumer FlowEventsConsumer, ignorePortIds ...uint32) (Cancelable, error) {
+	return DatapathHandle{dpif, -1}.ConsumeFlowEvents(consumer, ignorePortIds...)
+}
+
+func (dp DatapathHandle) ConsumeFlowEvents(consumer FlowEventsConsumer, ignorePortIds ...uint32) (Cancelable, error) {
+	mcGroup, err := dp.dpif.getMCGroup(FLOW, "ovs_flow")
+	if err != nil {
+		return nil, err
+	}
+
+	consumeDpif, err := dp.dpif.Reopen()
+	if err != nil {
+		return nil, err
+	}
+
+	err = consumeDpif.sock.JoinMulticastGroup(mcGroup)
+	if err != nil {
+		consumeDpif.Close()
+		return nil, err
+	}
+
+	go consumeDpif.consumeFlowEvents(consumer, dp.ifindex, ignorePortIds)
+	return cancelableDpif{consumeDpif}, nil
+}
+
+func (dpif *Dpif) consumeFlowEvents(consumer FlowEventsConsumer, ifindex int32, ignorePortIds []uint32) {
+	dpif.sock.consume(consumer, nil, func(msg *NlMsgParser) error {
+		if sentByPortId(msg, ignorePortIds) {
+			return nil
+		}
+
+		genlhdr, ovshdr, err := dpif.checkNlMsgHeaders(msg, FLOW, -1)
+		if err != nil {
+			return err
+		}
+
+		// filter by ifindex, if consuming on a specific datapath
+		if ifindex >= 0 && ovshdr.DpIfIndex != ifindex {
+			return nil
+		}
+
+		attrs, err := msg.TakeAttrs()
+		if err != nil {
+			return err
+		}
+
+		fi, err := parseFlowInfo(attrs)
+		if err != nil {
+			return err
+		}
+
+		switch genlhdr.Cmd {
+		case OVS_FLOW_CMD_NEW, OVS_FLOW_CMD_SET:
+			return consumer.FlowChanged(ovshdr.DpIfIndex, fi)
+
+		case OVS_FLOW_CMD_DEL:
+			return consumer.FlowDeleted(ovshdr.DpIfIndex, fi)
+
+		default:
+			return nil
+		}
+	})
+}
@@ -0,0 +1,794 @@
+package odp
+
+import (
+	"bytes"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Encode flow keys as they would be in a flow message, and parse
+// them back
+func roundTripFlowKeys(t *testing.T, fks FlowKeys) FlowKeys {
+	// The ethernet flow key is mandatory, so toNlAttrs would
+	// add one
+	if fks[OVS_KEY_ATTR_ETHERNET] == nil {
+		fks.Add(NewEthernetFlowKey())
+	}
+
+	msg := NewNlMsgBuilder(RequestFlags, 0)
+	fks.toNlAttrs(msg)
+	data, _ := msg.Finish()
+
+	attrs, err := ParseNestedAttrs(data[syscall.NLMSG_HDRLEN:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := attrs.GetNestedAttrs(OVS_FLOW_ATTR_KEY, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	masks, err := attrs.GetNestedAttrs(OVS_FLOW_ATTR_MASK, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ParseFlowKeys(keys, masks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !res.Equals(fks) {
+		t.Fatalf("flow keys changed in round trip: %v became %v", fks, res)
+	}
+
+	return res
+}
+
+func TestTunnelFlowKeyIgnored(t *testing.T) {
+	var tun TunnelFlowKey
+	if !tun.Ignored() {
+		t.Fatal("wildcard tunnel key not ignored")
+	}
+
+	// Matching on only the DF flag is still a match
+	tun.SetDf(false)
+	if tun.Ignored() {
+		t.Fatal("tunnel key matching on DF is ignored")
+	}
+}
+
+func TestIPv4FlowKeys(t *testing.T) {
+	fks := MakeFlowKeys()
+
+	etfk := NewEtherTypeFlowKey()
+	etfk.SetEtherType(0x0800)
+	fks.Add(etfk)
+
+	ipfk := NewIPv4FlowKey()
+	ipfk.SetMaskedSrc([4]byte{10, 0, 0, 0}, [4]byte{255, 0, 0, 0})
+	ipfk.SetDst([4]byte{192, 168, 1, 2})
+	ipfk.SetProto(17)
+	fks.Add(ipfk)
+
+	res := roundTripFlowKeys(t, fks)
+
+	et, ok := res[OVS_KEY_ATTR_ETHERTYPE].(EtherTypeFlowKey)
+	if !ok || et.EtherType() != 0x0800 || et.EtherTypeMask() != 0xffff {
+		t.Fatal(res[OVS_KEY_ATTR_ETHERTYPE])
+	}
+
+	ip, ok := res[OVS_KEY_ATTR_IPV4].(IPv4FlowKey)
+	if !ok {
+		t.Fatal(res[OVS_KEY_ATTR_IPV4])
+	}
+
+	k, m := ip.Key(), ip.Mask()
+	if k.Src != [4]byte{10, 0, 0, 0} || m.Src != [4]byte{255, 0, 0, 0} || k.Dst != [4]byte{192, 168, 1, 2} || m.Dst != [4]byte{255, 255, 255, 255} || k.Proto != 17 || m.Proto != 0xff || m.Ttl != 0 {
+		t.Fatal(ip)
+	}
+
+	// The wire format of the ethertype is network byte order
+	if et.BlobFlowKey.key()[0] != 0x08 {
+		t.Fatal(et.BlobFlowKey.key())
+	}
+}
+
+func TestMplsFlowKey(t *testing.T) {
+	fks := MakeFlowKeys()
+
+	etfk := NewEtherTypeFlowKey()
+	etfk.SetEtherType(ETH_P_MPLS_UC)
+	fks.Add(etfk)
+
+	mplsfk := NewMplsFlowKey()
+	mplsfk.SetLabel(1000)
+	mplsfk.SetTC(5)
+	mplsfk.SetBoS(true)
+	fks.Add(mplsfk)
+
+	mpls, ok := roundTripFlowKeys(t, fks)[OVS_KEY_ATTR_MPLS].(MplsFlowKey)
+	if !ok || mpls.Label() != 1000 || mpls.TC() != 5 || !mpls.BoS() || mpls.TTL() != 0 {
+		t.Fatal(mpls)
+	}
+
+	// The TTL is wildcarded
+	if mpls.LSEMask() != MPLS_LS_LABEL_MASK|MPLS_LS_TC_MASK|MPLS_LS_S_MASK {
+		t.Fatalf("%#x", mpls.LSEMask())
+	}
+
+	// The LSE is in network byte order
+	if k := mpls.BlobFlowKey.key(); k[0] != 0x00 || k[1] != 0x3e || k[2] != 0x8b || k[3] != 0 {
+		t.Fatal(k)
+	}
+
+	// Keys can hold up to MPLS_LABEL_DEPTH entries
+	stack := []uint32{16 << MPLS_LS_LABEL_SHIFT, 17<<MPLS_LS_LABEL_SHIFT | MPLS_LS_S_MASK}
+	stackMasks := []uint32{MPLS_LS_LABEL_MASK, 0xffffffff}
+	if err := mplsfk.SetMaskedLSEs(stack, stackMasks); err != nil {
+		t.Fatal(err)
+	}
+	fks.Add(mplsfk)
+
+	mpls, ok = roundTripFlowKeys(t, fks)[OVS_KEY_ATTR_MPLS].(MplsFlowKey)
+	lses, masks := mpls.LSEs()
+	if !ok || len(lses) != 2 || lses[0] != stack[0] || lses[1] != stack[1] ||
+		masks[0] != stackMasks[0] || masks[1] != stackMasks[1] || mpls.Label() != 16 {
+		t.Fatal(mpls)
+	}
+
+	if err := mplsfk.SetMaskedLSEs(make([]uint32, 4), make([]uint32, 4)); err == nil {
+		t.Fatal("too deep label stack accepted")
+	}
+
+	// With no mask from the kernel, all entries are exact
+	fk, err := mplsFlowKeyParser.parse(OVS_KEY_ATTR_MPLS, make([]byte, 12), mplsFlowKeyParser.exactMask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, masks := fk.(MplsFlowKey).LSEs(); len(masks) != 3 || masks[2] != 0xffffffff {
+		t.Fatal(fk)
+	}
+
+	if _, err := mplsFlowKeyParser.parse(OVS_KEY_ATTR_MPLS, make([]byte, 6), make([]byte, 6)); err == nil {
+		t.Fatal("MPLS key of bad length accepted")
+	}
+}
+
+func TestCtFlowKeys(t *testing.T) {
+	fks := MakeFlowKeys()
+
+	state := NewCtStateFlowKey()
+	state.SetStateFlag(OVS_CS_F_TRACKED|OVS_CS_F_ESTABLISHED, true)
+	state.SetStateFlag(OVS_CS_F_NEW, false)
+	fks.Add(state)
+
+	zone := NewCtZoneFlowKey()
+	zone.SetZone(5)
+	fks.Add(zone)
+
+	mark := NewCtMarkFlowKey()
+	mark.SetMaskedMark(0x10, 0xf0)
+	fks.Add(mark)
+
+	labels := NewCtLabelsFlowKey()
+	var l, lm [OVS_CT_LABELS_LEN]byte
+	l[15], lm[15] = 1, 1
+	labels.SetMaskedLabels(l, lm)
+	fks.Add(labels)
+
+	res := roundTripFlowKeys(t, fks)
+
+	st, ok := res[OVS_KEY_ATTR_CT_STATE].(CtStateFlowKey)
+	if !ok || st.State() != OVS_CS_F_TRACKED|OVS_CS_F_ESTABLISHED ||
+		st.StateMask() != OVS_CS_F_TRACKED|OVS_CS_F_ESTABLISHED|OVS_CS_F_NEW {
+		t.Fatal(res[OVS_KEY_ATTR_CT_STATE])
+	}
+
+	z, ok := res[OVS_KEY_ATTR_CT_ZONE].(CtZoneFlowKey)
+	if !ok || z.Zone() != 5 || z.ZoneMask() != 0xffff {
+		t.Fatal(res[OVS_KEY_ATTR_CT_ZONE])
+	}
+
+	m, ok := res[OVS_KEY_ATTR_CT_MARK].(CtMarkFlowKey)
+	if !ok || m.Mark() != 0x10 || m.MarkMask() != 0xf0 {
+		t.Fatal(res[OVS_KEY_ATTR_CT_MARK])
+	}
+
+	lab, ok := res[OVS_KEY_ATTR_CT_LABELS].(CtLabelsFlowKey)
+	if !ok || lab.Labels() != l || lab.LabelsMask() != lm {
+		t.Fatal(res[OVS_KEY_ATTR_CT_LABELS])
+	}
+
+	// Fully wildcarded ct keys are ignored
+	if !NewCtStateFlowKey().Ignored() || !NewCtLabelsFlowKey().Ignored() {
+		t.Fatal("wildcard ct keys should be ignored")
+	}
+}
+
+func TestTcpFlowKeys(t *testing.T) {
+	fks := MakeFlowKeys()
+
+	etfk := NewEtherTypeFlowKey()
+	etfk.SetEtherType(0x0800)
+	fks.Add(etfk)
+
+	ipfk := NewIPv4FlowKey()
+	ipfk.SetSrc([4]byte{10, 0, 0, 1})
+	ipfk.SetDst([4]byte{10, 0, 0, 2})
+	ipfk.SetProto(syscall.IPPROTO_TCP)
+	fks.Add(ipfk)
+
+	tcpfk := NewTcpFlowKey()
+	tcpfk.SetSrc(49152)
+	tcpfk.SetDst(80)
+	fks.Add(tcpfk)
+
+	flagsfk := NewTcpFlagsFlowKey()
+	flagsfk.SetMaskedFlags(0x02, 0x12)
+	fks.Add(flagsfk)
+
+	res := roundTripFlowKeys(t, fks)
+
+	tcp, ok := res[OVS_KEY_ATTR_TCP].(TransportFlowKey)
+	if !ok || tcp.Src() != 49152 || tcp.Dst() != 80 || tcp.SrcMask() != 0xffff || tcp.DstMask() != 0xffff {
+		t.Fatal(res[OVS_KEY_ATTR_TCP])
+	}
+
+	// Ports are in network byte order
+	if k := tcp.BlobFlowKey.key(); k[0] != 0xc0 || k[1] != 0 || k[2] != 0 || k[3] != 80 {
+		t.Fatal(k)
+	}
+
+	flags, ok := res[OVS_KEY_ATTR_TCP_FLAGS].(TcpFlagsFlowKey)
+	if !ok || flags.Flags() != 0x02 || flags.FlagsMask() != 0x12 {
+		t.Fatal(res[OVS_KEY_ATTR_TCP_FLAGS])
+	}
+
+	// A UDP key with only the destination port set
+	udpfk := NewUdpFlowKey()
+	udpfk.SetDst(53)
+	fks = MakeFlowKeys()
+	fks.Add(udpfk)
+	res = roundTripFlowKeys(t, fks)
+
+	udp, ok := res[OVS_KEY_ATTR_UDP].(TransportFlowKey)
+	if !ok || udp.Dst() != 53 || udp.SrcMask() != 0 {
+		t.Fatal(res[OVS_KEY_ATTR_UDP])
+	}
+}
+
+func TestTunnelFlowKeys(t *testing.T) {
+	var tun TunnelFlowKey
+	tun.SetTunnelId([8]byte{0, 0, 0, 0, 0, 0x12, 0x34, 0x56})
+	tun.SetIpv4Src([4]byte{10, 0, 0, 1})
+	tun.SetIpv4Dst([4]byte{10, 0, 0, 2})
+	tun.SetTos(0x10)
+	tun.SetTtl(64)
+	tun.SetDf(true)
+	tun.SetCsum(true)
+	tun.SetTpSrc(1234)
+	tun.SetTpDst(4789)
+
+	fks := MakeFlowKeys()
+	fks.Add(tun)
+
+	msg := NewNlMsgBuilder(RequestFlags, 0)
+	tun.putKeyNlAttr(msg)
+	data, _ := msg.Finish()
+	outer, err := ParseNestedAttrs(data[syscall.NLMSG_HDRLEN:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The wire format is big-endian throughout
+	attrs, err := ParseNestedAttrs(outer[OVS_KEY_ATTR_TUNNEL])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for typ, expect := range map[uint16][]byte{
+		OVS_TUNNEL_KEY_ATTR_ID:       {0, 0, 0, 0, 0, 0x12, 0x34, 0x56},
+		OVS_TUNNEL_KEY_ATTR_IPV4_SRC: {10, 0, 0, 1},
+		OVS_TUNNEL_KEY_ATTR_IPV4_DST: {10, 0, 0, 2},
+		OVS_TUNNEL_KEY_ATTR_TP_SRC:   {0x04, 0xd2},
+		OVS_TUNNEL_KEY_ATTR_TP_DST:   {0x12, 0xb5},
+	} {
+		if !bytes.Equal(attrs[typ], expect) {
+			t.Fatal(typ, attrs[typ])
+		}
+	}
+
+	res := roundTripFlowKeys(t, fks)
+	if !res[OVS_KEY_ATTR_TUNNEL].Equals(tun) {
+		t.Fatal(res[OVS_KEY_ATTR_TUNNEL], tun)
+	}
+
+	// A wildcarded field survives the round trip as a wildcard
+	var partial TunnelFlowKey
+	partial.SetIpv4Dst([4]byte{10, 0, 0, 2})
+	partial.SetTtl(64)
+	fks.Add(partial)
+	res = roundTripFlowKeys(t, fks)
+	if !res[OVS_KEY_ATTR_TUNNEL].Equals(partial) {
+		t.Fatal(res[OVS_KEY_ATTR_TUNNEL], partial)
+	}
+
+	// A malformed address is reported
+	msg = NewNlMsgBuilder(RequestFlags, 0)
+	msg.PutSliceAttr(OVS_TUNNEL_KEY_ATTR_IPV4_DST, []byte{10, 0, 0})
+	msg.PutUint8Attr(OVS_TUNNEL_KEY_ATTR_TTL, 64)
+	data, _ = msg.Finish()
+	if _, _, err := parseTunnelAttrs(data[syscall.NLMSG_HDRLEN:]); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestFlowKeyMasks(t *testing.T) {
+	ipfk := NewIPv4FlowKey()
+	if !ipfk.Ignored() || ipfk.ExactMatch() {
+		t.Fatal(ipfk)
+	}
+
+	ipfk.SetMaskedDst([4]byte{10, 0, 0, 0}, [4]byte{255, 0, 0, 0})
+	if ipfk.Ignored() || ipfk.ExactMatch() {
+		t.Fatal(ipfk)
+	}
+
+	ipfk.SetExactMatch()
+	if !ipfk.ExactMatch() || ipfk.Key().Dst != [4]byte{10, 0, 0, 0} {
+		t.Fatal(ipfk)
+	}
+
+	ipfk.SetWildcard()
+	if !ipfk.Ignored() || ipfk.Key().Dst != [4]byte{} {
+		t.Fatal(ipfk)
+	}
+
+	// Ignored keys are omitted from both the keys and the masks
+	fks := MakeFlowKeys()
+	fks.Add(ipfk)
+	res := roundTripFlowKeys(t, fks)
+	if _, ok := res[OVS_KEY_ATTR_IPV4]; ok {
+		t.Fatal(res)
+	}
+}
+
+func TestVlanFlowKeys(t *testing.T) {
+	fks := MakeFlowKeys()
+
+	etfk := NewEtherTypeFlowKey()
+	etfk.SetEtherType(ETH_P_8021Q)
+	fks.Add(etfk)
+
+	vfk := NewVlanFlowKey()
+	vfk.SetVid(10)
+	vfk.SetPcp(3)
+	fks.Add(vfk)
+
+	encap := NewEncapFlowKey()
+	inner := NewEtherTypeFlowKey()
+	inner.SetEtherType(0x0800)
+	encap.Add(inner)
+	ipfk := NewIPv4FlowKey()
+	ipfk.SetDst([4]byte{10, 0, 0, 1})
+	encap.Add(ipfk)
+	fks.Add(encap)
+
+	res := roundTripFlowKeys(t, fks)
+
+	v, ok := res[OVS_KEY_ATTR_VLAN].(VlanFlowKey)
+	if !ok || v.Vid() != 10 || v.Pcp() != 3 || v.TCI() != 0x700a || v.TCIMask() != 0xffff {
+		t.Fatal(res[OVS_KEY_ATTR_VLAN])
+	}
+
+	e, ok := res[OVS_KEY_ATTR_ENCAP].(EncapFlowKey)
+	if !ok {
+		t.Fatal(res[OVS_KEY_ATTR_ENCAP])
+	}
+
+	if et, ok := e.FlowKeys()[OVS_KEY_ATTR_ETHERTYPE].(EtherTypeFlowKey); !ok || et.EtherType() != 0x0800 {
+		t.Fatal(e)
+	}
+
+	if ip, ok := e.FlowKeys()[OVS_KEY_ATTR_IPV4].(IPv4FlowKey); !ok || ip.Key().Dst != [4]byte{10, 0, 0, 1} {
+		t.Fatal(e)
+	}
+
+	// A zero EncapFlowKey is usable too
+	var zero EncapFlowKey
+	zero.Add(inner)
+	if !zero.FlowKeys().Equals(FlowKeys{OVS_KEY_ATTR_ETHERTYPE: inner}) {
+		t.Fatal(zero)
+	}
+
+	// Matching only the VID leaves the PCP wildcarded
+	vfk = NewVlanFlowKey()
+	vfk.SetVid(20)
+	if vfk.TCI() != 0x1014 || vfk.TCIMask() != 0x1fff {
+		t.Fatal(vfk)
+	}
+}
+
+func TestPartialFlowKeys(t *testing.T) {
+	// A key for which only a subset of fields is present in
+	// the mask parses back with the others wildcarded
+	fks := MakeFlowKeys()
+	ipfk := NewIPv4FlowKey()
+	ipfk.SetMaskedDst([4]byte{192, 168, 0, 0}, [4]byte{255, 255, 0, 0})
+	fks.Add(ipfk)
+	fks.Add(NewInPortFlowKey(3))
+
+	ip := roundTripFlowKeys(t, fks)[OVS_KEY_ATTR_IPV4].(IPv4FlowKey)
+	if m := ip.Mask(); m.Src != [4]byte{} || m.Proto != 0 {
+		t.Fatal(ip)
+	}
+}
+
+// Encode actions as they would be in a flow message, and parse
+// them back
+func roundTripActions(t *testing.T, actions []Action) []Action {
+	msg := NewNlMsgBuilder(RequestFlags, 0)
+	msg.PutNestedAttrs(OVS_FLOW_ATTR_ACTIONS, func() {
+		for _, a := range actions {
+			a.toNlAttr(msg)
+		}
+	})
+	data, _ := msg.Finish()
+
+	attrs, err := ParseNestedAttrs(data[syscall.NLMSG_HDRLEN:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actattrs, err := attrs.GetOrderedAttrs(OVS_FLOW_ATTR_ACTIONS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := parseActions(actattrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res) != len(actions) {
+		t.Fatalf("actions changed in round trip: %v became %v", actions, res)
+	}
+
+	for i := range res {
+		if !res[i].Equals(actions[i]) {
+			t.Fatalf("actions changed in round trip: %v became %v", actions, res)
+		}
+	}
+
+	return res
+}
+
+func TestOutputAndUserspaceActions(t *testing.T) {
+	roundTripActions(t, []Action{
+		NewOutputAction(1),
+		NewUserspaceAction(1234, []byte{1, 2, 3}),
+		NewUserspaceAction(5678, nil),
+		NewOutputAction(2),
+	})
+
+	// No actions means drop
+	roundTripActions(t, []Action{})
+
+	if NewUserspaceAction(1, []byte{1}).Equals(NewUserspaceAction(1, []byte{2})) {
+		t.Fatal("userspace actions with different userdata are equal")
+	}
+}
+
+func TestVlanActions(t *testing.T) {
+	push := NewPushVlanAction(100, 5)
+	if push.TPID != 0x8100 || push.TCI != 0xb064 {
+		t.Fatal(push)
+	}
+
+	res := roundTripActions(t, []Action{
+		NewPopVlanAction(),
+		push,
+		PushVlanAction{TPID: 0x88a8, TCI: VLAN_CFI_MASK | 7},
+		NewOutputAction(1),
+	})
+
+	if pa := res[2].(PushVlanAction); pa.TPID != 0x88a8 || pa.TCI != 0x1007 {
+		t.Fatal(pa)
+	}
+
+	// The struct fields are in network byte order
+	msg := NewNlMsgBuilder(RequestFlags, 0)
+	push.toNlAttr(msg)
+	data, _ := msg.Finish()
+	val := data[syscall.NLMSG_HDRLEN+syscall.SizeofNlAttr:]
+	if !bytes.Equal(val, []byte{0x81, 0x00, 0xb0, 0x64}) {
+		t.Fatal(val)
+	}
+}
+
+func TestSampleAction(t *testing.T) {
+	res := roundTripActions(t, []Action{
+		NewSampleAction(1<<31, []Action{
+			NewUserspaceAction(1234, []byte{1}),
+			NewSampleAction(1<<32-1, []Action{NewOutputAction(2)}),
+		}),
+		NewOutputAction(1),
+	})
+
+	sa := res[0].(SampleAction)
+	if sa.Probability != 1<<31 || len(sa.Actions) != 2 {
+		t.Fatal(sa)
+	}
+
+	// An empty action list drops the sampled packets
+	roundTripActions(t, []Action{NewSampleAction(100, nil)})
+
+	if NewSampleAction(1, []Action{NewOutputAction(1)}).Equals(NewSampleAction(1, []Action{NewOutputAction(2)})) {
+		t.Fatal("sample actions with different actions are equal")
+	}
+}
+
+func TestMplsActions(t *testing.T) {
+	push, err := NewPushMplsAction(1000, 5, true, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewPushMplsAction(1<<20, 0, true, 64); err == nil {
+		t.Fatal("out of range MPLS label accepted")
+	}
+
+	if _, err := NewPushMplsAction(1000, 8, true, 64); err == nil {
+		t.Fatal("out of range MPLS traffic class accepted")
+	}
+
+	res := roundTripActions(t, []Action{
+		push,
+		PushMplsAction{LSE: 16 << MPLS_LS_LABEL_SHIFT, EtherType: ETH_P_MPLS_MC},
+		NewPopMplsAction(0x0800),
+		NewOutputAction(1),
+	})
+
+	if pa := res[0].(PushMplsAction); pa.EtherType != ETH_P_MPLS_UC || pa.LSE != 1000<<12|5<<9|1<<8|64 {
+		t.Fatal(pa)
+	}
+
+	if pa := res[2].(PopMplsAction); pa.EtherType != 0x0800 {
+		t.Fatal(pa)
+	}
+}
+
+func TestHashAndRecircActions(t *testing.T) {
+	// The first stage hashes and recirculates
+	res := roundTripActions(t, []Action{
+		NewHashAction(0x1234),
+		NewRecircAction(7),
+	})
+
+	if ha := res[0].(HashAction); ha.Alg != OVS_HASH_ALG_L4 || ha.Basis != 0x1234 {
+		t.Fatal(ha)
+	}
+
+	if ra := res[1].(RecircAction); ra.ID != 7 {
+		t.Fatal(ra)
+	}
+
+	// The second stage matches on the recirc id
+	fks := MakeFlowKeys()
+	fks.Add(NewRecircIdFlowKey(7))
+	fk, ok := roundTripFlowKeys(t, fks)[OVS_KEY_ATTR_RECIRC_ID].(RecircIdFlowKey)
+	if !ok || fk.RecircId() != 7 || !fk.ExactMatch() {
+		t.Fatal(fk)
+	}
+}
+
+func TestConntrackAction(t *testing.T) {
+	commit := NewConntrackAction(true, 5)
+	commit.Mark, commit.MarkMask = 0x10, 0xff
+	commit.Labels[15], commit.LabelsMask[15] = 1, 1
+	commit.Helper = "ftp"
+
+	snat := NewConntrackAction(true, 0)
+	snat.NAT = &ConntrackNAT{
+		Src:       true,
+		IPMin:     net.IPv4(10, 0, 0, 1),
+		IPMax:     net.IPv4(10, 0, 0, 9),
+		ProtoMin:  1024,
+		ProtoMax:  65535,
+		ProtoHash: true,
+	}
+
+	restoreNAT := NewConntrackAction(false, 0)
+	restoreNAT.NAT = &ConntrackNAT{}
+
+	noEvents := uint32(0)
+	events := NewConntrackAction(true, 0)
+	events.EventMask = &noEvents
+	events.Timeout = "tcp_short"
+
+	res := roundTripActions(t, []Action{
+		NewConntrackAction(false, 0),
+		commit,
+		snat,
+		restoreNAT,
+		ConntrackAction{NAT: &ConntrackNAT{Dst: true, IPMin: net.ParseIP("fd00::1")}},
+		events,
+		NewOutputAction(1),
+	})
+
+	if ca := res[1].(ConntrackAction); ca.Zone != 5 || ca.MarkMask != 0xff || ca.Helper != "ftp" {
+		t.Fatal(ca)
+	}
+
+	if nat := res[2].(ConntrackAction).NAT; nat == nil || !nat.IPMin.Equal(net.IPv4(10, 0, 0, 1)) || nat.ProtoMax != 65535 {
+		t.Fatal(nat)
+	}
+
+	if res[3].(ConntrackAction).NAT == nil {
+		t.Fatal("empty NAT options were lost")
+	}
+
+	if ca := res[5].(ConntrackAction); ca.EventMask == nil || *ca.EventMask != 0 || ca.Timeout != "tcp_short" {
+		t.Fatal(ca)
+	}
+
+	if commit.Equals(NewConntrackAction(true, 5)) || snat.Equals(NewConntrackAction(true, 0)) ||
+		events.Equals(NewConntrackAction(true, 0)) {
+		t.Fatal("ConntrackAction.Equals ignores some fields")
+	}
+
+	// Labels are shown in ct_label syntax
+	labels := NewConntrackAction(true, 0)
+	labels.Labels[0], labels.Labels[15] = 1, 1
+	for i := range labels.LabelsMask {
+		labels.LabelsMask[i] = 0xff
+	}
+	if s := labels.String(); s != "ConntrackAction{zone: 0, commit, labels: 0x1000000000000000000000000000001&0xffffffffffffffffffffffffffffffff}" {
+		t.Fatal(s)
+	}
+}
+
+func TestRawAction(t *testing.T) {
+	res := roundTripActions(t, []Action{
+		NewOutputAction(1),
+		RawAction{Type: 100, Value: []byte{1, 2, 3, 4}},
+	})
+
+	if ra, ok := res[1].(RawAction); !ok || ra.TypeId() != 100 {
+		t.Fatal(res[1])
+	}
+
+	msg := NewNlMsgBuilder(RequestFlags, 0)
+	NewPopVlanAction().toNlAttr(msg)
+	NewOutputAction(3).toNlAttr(msg)
+	data, _ := msg.Finish()
+
+	actions, err := ParseActions(data[syscall.NLMSG_HDRLEN:])
+	if err != nil || len(actions) != 2 || !actions[0].Equals(NewPopVlanAction()) || !actions[1].Equals(NewOutputAction(3)) {
+		t.Fatal(actions, err)
+	}
+}
+
+func TestSetFieldAction(t *testing.T) {
+	ipfk := NewIPv4FlowKey()
+	ipfk.SetSrc([4]byte{10, 0, 0, 1})
+	ipfk.SetDst([4]byte{192, 168, 0, 1})
+	ipfk.SetProto(syscall.IPPROTO_UDP)
+	ipfk.SetTtl(64)
+
+	ethfk := NewEthernetFlowKey()
+	ethfk.SetEthSrc([...]byte{0x02, 0, 0, 0, 0, 1})
+
+	res := roundTripActions(t, []Action{
+		NewSetFieldAction(ipfk),
+		NewSetFieldAction(ethfk),
+		NewOutputAction(1),
+	})
+
+	sa, ok := res[0].(SetFieldAction)
+	if !ok {
+		t.Fatal(res[0])
+	}
+
+	ip, ok := sa.Key.(IPv4FlowKey)
+	if !ok || ip.Key().Dst != [4]byte{192, 168, 0, 1} || ip.Key().Ttl != 64 {
+		t.Fatal(sa)
+	}
+
+	other := NewIPv4FlowKey()
+	other.SetDst([4]byte{192, 168, 0, 2})
+	if NewSetFieldAction(ipfk).Equals(NewSetFieldAction(other)) {
+		t.Fatal("set actions with different keys are equal")
+	}
+}
+
+func TestParseFlowInfo(t *testing.T) {
+	f := NewFlowSpec()
+	f.AddKey(NewInPortFlowKey(1))
+	f.AddKey(NewEthernetFlowKey())
+	f.AddAction(NewOutputAction(2))
+
+	msg := NewNlMsgBuilder(RequestFlags, 0)
+	f.toNlAttrs(msg)
+	msg.PutSliceAttr(OVS_FLOW_ATTR_STATS, []byte{3, 0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0})
+	msg.PutUint64Attr(OVS_FLOW_ATTR_USED, 5)
+	msg.PutUint8Attr(OVS_FLOW_ATTR_TCP_FLAGS, 0x12)
+	data, _ := msg.Finish()
+
+	attrs, err := ParseNestedAttrs(data[syscall.NLMSG_HDRLEN:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := parseFlowInfo(attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !fi.FlowSpec.Equals(f) || fi.Packets != 3 || fi.Bytes != 4 || fi.Used != 5 || fi.TcpFlags != 0x12 {
+		t.Fatal(fi)
+	}
+}
+
+func TestFlowIdleTime(t *testing.T) {
+	if d := idleTime(1000, 3500); d != 2500*time.Millisecond {
+		t.Fatal(d)
+	}
+	if d := idleTime(3500, 1000); d != 0 {
+		t.Fatal(d)
+	}
+
+	if _, used, err := (FlowInfo{}).IdleTime(); err != nil || used {
+		t.Fatal(used, err)
+	}
+
+	now, err := monotonicMillis()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, used, err := FlowInfo{Used: now}.IdleTime()
+	if err != nil || !used || d < 0 || d > time.Second {
+		t.Fatal(d, used, err)
+	}
+}
+
+func buildBenchmarkFlow() FlowSpec {
+	f := NewFlowSpec()
+	ethfk := NewEthernetFlowKey()
+	ethfk.SetEthSrc([...]byte{0x02, 0, 0, 0, 0, 1})
+	ethfk.SetEthDst([...]byte{0x02, 0, 0, 0, 0, 2})
+	f.AddKey(ethfk)
+	f.AddKey(NewInPortFlowKey(1))
+	for i := 0; i < 8; i++ {
+		f.AddAction(NewOutputAction(VportID(i + 2)))
+	}
+	return f
+}
+
+func BenchmarkEncodeFlow(b *testing.B) {
+	f := buildBenchmarkFlow()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := NewNlMsgBuilder(RequestFlags, 0)
+		f.toNlAttrs(req)
+		req.Finish()
+	}
+}
+
+func BenchmarkEncodeFlowPooled(b *testing.B) {
+	f := buildBenchmarkFlow()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := GetBuilder(RequestFlags, 0)
+		f.toNlAttrs(req)
+		req.Finish()
+		req.Release()
+	}
+}
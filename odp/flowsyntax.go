@@ -0,0 +1,1146 @@
+package odp
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Flow keys in the textual syntax used by OVS (e.g. in the output of
+// "ovs-dpctl dump-flows"), such as
+//
+//	in_port(2),eth(src=02:00:00:00:00:01,dst=02:00:00:00:00:02),eth_type(0x0800)
+//
+// Only the fields that are matched on are included.  Partially
+// masked fields are written as value/mask.
+
+// The position of key types in the output, following OVS.  Key types
+// not listed here come afterwards, in type id order.
+var flowKeySyntaxOrder = map[uint16]int{
+	OVS_KEY_ATTR_RECIRC_ID: 0,
+	OVS_KEY_ATTR_DP_HASH:   1,
+	OVS_KEY_ATTR_TUNNEL:    2,
+	OVS_KEY_ATTR_PRIORITY:  3,
+	OVS_KEY_ATTR_SKB_MARK:  4,
+	OVS_KEY_ATTR_CT_STATE:  5,
+	OVS_KEY_ATTR_CT_ZONE:   6,
+	OVS_KEY_ATTR_CT_MARK:   7,
+	OVS_KEY_ATTR_CT_LABELS: 8,
+	OVS_KEY_ATTR_IN_PORT:   9,
+	OVS_KEY_ATTR_ETHERNET:  10,
+	OVS_KEY_ATTR_ETHERTYPE: 11,
+	OVS_KEY_ATTR_VLAN:      12,
+	OVS_KEY_ATTR_ENCAP:     13,
+}
+
+func flowKeySyntaxRank(typ uint16) int {
+	if rank, ok := flowKeySyntaxOrder[typ]; ok {
+		return rank
+	}
+
+	return len(flowKeySyntaxOrder) + int(typ)
+}
+
+// The names of the flow keys that consist of a single uint32 in host
+// byte order.
+var uint32FlowKeyNames = map[uint16]string{
+	OVS_KEY_ATTR_PRIORITY:  "priority",
+	OVS_KEY_ATTR_SKB_MARK:  "skb_mark",
+	OVS_KEY_ATTR_DP_HASH:   "dp_hash",
+	OVS_KEY_ATTR_RECIRC_ID: "recirc_id",
+}
+
+func (keys FlowKeys) String() string {
+	var sorted []FlowKey
+	for _, k := range keys {
+		if !k.Ignored() {
+			sorted = append(sorted, k)
+		}
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return flowKeySyntaxRank(sorted[i].TypeId()) <
+			flowKeySyntaxRank(sorted[j].TypeId())
+	})
+
+	strs := make([]string, len(sorted))
+	for i, k := range sorted {
+		strs[i] = FormatFlowKey(k)
+	}
+
+	return strings.Join(strs, ",")
+}
+
+// FormatFlowKey returns a single flow key in OVS syntax.
+func FormatFlowKey(fk FlowKey) string {
+	var f syntaxFields
+
+	switch k := fk.(type) {
+	case InPortFlowKey:
+		return fmt.Sprintf("in_port(%d)", k.VportID())
+
+	case EthernetFlowKey:
+		key := k.Key()
+		mask := k.Mask()
+		f.addBytes("src", key.EthSrc[:], mask.EthSrc[:], macToString)
+		f.addBytes("dst", key.EthDst[:], mask.EthDst[:], macToString)
+		return f.format("eth")
+
+	case EtherTypeFlowKey:
+		return "eth_type(" + maskedUint(uint64(k.EtherType()),
+			uint64(k.EtherTypeMask()), 0xffff, "0x%04x") + ")"
+
+	case VlanFlowKey:
+		tci := k.TCI()
+		mask := k.TCIMask()
+		f.addUint("vid", uint64(tci&VLAN_VID_MASK),
+			uint64(mask&VLAN_VID_MASK), VLAN_VID_MASK, "%d")
+		f.addUint("pcp", uint64(tci>>VLAN_PRIO_SHIFT),
+			uint64(mask>>VLAN_PRIO_SHIFT), VLAN_PRIO_MASK>>VLAN_PRIO_SHIFT, "%d")
+		if mask&VLAN_CFI_MASK != 0 && tci&VLAN_CFI_MASK == 0 {
+			f = append(f, "cfi=0")
+		}
+		return f.format("vlan")
+
+	case EncapFlowKey:
+		return "encap(" + k.FlowKeys().String() + ")"
+
+	case MplsFlowKey:
+		if lses, masks := k.LSEs(); len(lses) > 1 {
+			// Like OVS, show deeper stacks as raw LSEs
+			for i := range lses {
+				f = append(f, fmt.Sprintf("lse%d=%s", i,
+					maskedUint(uint64(lses[i]), uint64(masks[i]), 0xffffffff, "%#x")))
+			}
+			return f.format("mpls")
+		}
+
+		lse := k.LSE()
+		mask := k.LSEMask()
+		f.addUint("label", uint64(lse>>MPLS_LS_LABEL_SHIFT),
+			uint64(mask>>MPLS_LS_LABEL_SHIFT), MPLS_LS_LABEL_MASK>>MPLS_LS_LABEL_SHIFT, "%d")
+		f.addUint("tc", uint64(lse&MPLS_LS_TC_MASK>>MPLS_LS_TC_SHIFT),
+			uint64(mask&MPLS_LS_TC_MASK>>MPLS_LS_TC_SHIFT), MPLS_LS_TC_MASK>>MPLS_LS_TC_SHIFT, "%d")
+		f.addUint("ttl", uint64(lse&MPLS_LS_TTL_MASK),
+			uint64(mask&MPLS_LS_TTL_MASK), MPLS_LS_TTL_MASK, "%d")
+		f.addUint("bos", uint64(lse&MPLS_LS_S_MASK>>MPLS_LS_S_SHIFT),
+			uint64(mask&MPLS_LS_S_MASK>>MPLS_LS_S_SHIFT), 1, "%d")
+		return f.format("mpls")
+
+	case IPv4FlowKey:
+		key := k.Key()
+		mask := k.Mask()
+		f.addBytes("src", key.Src[:], mask.Src[:], ipv4ToString)
+		f.addBytes("dst", key.Dst[:], mask.Dst[:], ipv4ToString)
+		f.addUint("proto", uint64(key.Proto), uint64(mask.Proto), 0xff, "%d")
+		f.addUint("tos", uint64(key.Tos), uint64(mask.Tos), 0xff, "%#x")
+		f.addUint("ttl", uint64(key.Ttl), uint64(mask.Ttl), 0xff, "%d")
+		if mask.Frag == 0xff && int(key.Frag) < len(fragTypeNames) {
+			f = append(f, "frag="+fragTypeNames[key.Frag])
+		} else {
+			f.addUint("frag", uint64(key.Frag), uint64(mask.Frag), 0xff, "%d")
+		}
+		return f.format("ipv4")
+
+	case TransportFlowKey:
+		name, ok := transportFlowKeyNames[k.typ]
+		if !ok {
+			return formatBlobFlowKey(k.BlobFlowKey)
+		}
+
+		f.addUint("src", uint64(k.Src()), uint64(k.SrcMask()), 0xffff, "%d")
+		f.addUint("dst", uint64(k.Dst()), uint64(k.DstMask()), 0xffff, "%d")
+		return f.format(name)
+
+	case TcpFlagsFlowKey:
+		return "tcp_flags(" + maskedUint(uint64(k.Flags()),
+			uint64(k.FlagsMask()), 0xffff, "0x%03x") + ")"
+
+	case CtStateFlowKey:
+		state := k.State()
+		mask := k.StateMask()
+		if mask&^ctStateFlags() != 0 {
+			// Bits we have no names for
+			return "ct_state(" + maskedUint(uint64(state),
+				uint64(mask), 0xffffffff, "%#x") + ")"
+		}
+
+		var flags string
+		for _, cs := range ctStateFlagNames {
+			flags += maskedFlag(cs.name, state&cs.flag != 0, mask&cs.flag != 0)
+		}
+		return "ct_state(" + flags + ")"
+
+	case CtZoneFlowKey:
+		return "ct_zone(" + maskedUint(uint64(k.Zone()),
+			uint64(k.ZoneMask()), 0xffff, "%#x") + ")"
+
+	case CtMarkFlowKey:
+		return "ct_mark(" + maskedUint(uint64(k.Mark()),
+			uint64(k.MarkMask()), 0xffffffff, "%#x") + ")"
+
+	case CtLabelsFlowKey:
+		s := ctLabelsToString(k.key())
+		if m := k.mask(); !AllBytes(m, 0xff) {
+			s += "/" + ctLabelsToString(m)
+		}
+		return "ct_label(" + s + ")"
+
+	case TunnelFlowKey:
+		key := k.Key()
+		mask := k.Mask()
+		f.addBytes("tun_id", key.TunnelId[:], mask.TunnelId[:], tunnelIdToString)
+		f.addBytes("src", key.Ipv4Src[:], mask.Ipv4Src[:], ipv4ToString)
+		f.addBytes("dst", key.Ipv4Dst[:], mask.Ipv4Dst[:], ipv4ToString)
+		f.addUint("tos", uint64(key.Tos), uint64(mask.Tos), 0xff, "%#x")
+		f.addUint("ttl", uint64(key.Ttl), uint64(mask.Ttl), 0xff, "%d")
+		f.addUint("tp_src", uint64(key.TpSrc), uint64(mask.TpSrc), 0xffff, "%d")
+		f.addUint("tp_dst", uint64(key.TpDst), uint64(mask.TpDst), 0xffff, "%d")
+
+		var flags string
+		flags += maskedFlag("df", key.Df, mask.Df)
+		flags += maskedFlag("csum", key.Csum, mask.Csum)
+		if flags != "" {
+			f = append(f, "flags("+flags+")")
+		}
+		return f.format("tunnel")
+
+	case BlobFlowKeyish:
+		return formatBlobFlowKey(k.toBlobFlowKey())
+	}
+
+	return fmt.Sprint(fk)
+}
+
+var fragTypeNames = []string{"no", "first", "later"}
+
+// The names of the ct_state bits, in the order OVS writes them
+var ctStateFlagNames = []struct {
+	name string
+	flag uint32
+}{
+	{"new", OVS_CS_F_NEW},
+	{"est", OVS_CS_F_ESTABLISHED},
+	{"rel", OVS_CS_F_RELATED},
+	{"rpl", OVS_CS_F_REPLY_DIR},
+	{"inv", OVS_CS_F_INVALID},
+	{"trk", OVS_CS_F_TRACKED},
+	{"snat", OVS_CS_F_SRC_NAT},
+	{"dnat", OVS_CS_F_DST_NAT},
+}
+
+func ctStateFlags() (all uint32) {
+	for _, cs := range ctStateFlagNames {
+		all |= cs.flag
+	}
+	return
+}
+
+var transportFlowKeyNames = map[uint16]string{
+	OVS_KEY_ATTR_TCP:  "tcp",
+	OVS_KEY_ATTR_UDP:  "udp",
+	OVS_KEY_ATTR_SCTP: "sctp",
+}
+
+func formatBlobFlowKey(k BlobFlowKey) string {
+	key := k.key()
+	mask := k.mask()
+
+	if name, ok := uint32FlowKeyNames[k.typ]; ok && len(key) == 4 {
+		return name + "(" + maskedUint(uint64(*uint32At(key, 0)),
+			uint64(*uint32At(mask, 0)), 0xffffffff, "%#x") + ")"
+	}
+
+	// OVS's syntax for keys it doesn't know about
+	s := hex.EncodeToString(key)
+	if !AllBytes(mask, 0xff) {
+		s += "/" + hex.EncodeToString(mask)
+	}
+	return fmt.Sprintf("key%d(%s)", k.typ, s)
+}
+
+type syntaxFields []string
+
+func (f syntaxFields) format(name string) string {
+	return name + "(" + strings.Join(f, ",") + ")"
+}
+
+func (f *syntaxFields) addBytes(name string, k, m []byte, s func([]byte) string) {
+	if AllBytes(m, 0) {
+		return
+	}
+
+	v := s(k)
+	if !AllBytes(m, 0xff) {
+		v += "/" + s(m)
+	}
+	*f = append(*f, name+"="+v)
+}
+
+func (f *syntaxFields) addUint(name string, k, m, all uint64, format string) {
+	if m != 0 {
+		*f = append(*f, name+"="+maskedUint(k, m, all, format))
+	}
+}
+
+func maskedUint(k, m, all uint64, format string) string {
+	s := fmt.Sprintf(format, k)
+	if m != all {
+		s += fmt.Sprintf("/%#x", m)
+	}
+	return s
+}
+
+func maskedFlag(name string, k, m bool) string {
+	switch {
+	case !m:
+		return ""
+	case k:
+		return "+" + name
+	default:
+		return "-" + name
+	}
+}
+
+func macToString(mac []byte) string {
+	return net.HardwareAddr(mac).String()
+}
+
+// The ct_label key is OVS's ovs_u128, a 128-bit integer in host byte
+// order.  Like OVS, we show it as a hex number without leading zeros.
+func ctLabelsToString(labels []byte) string {
+	digits := strings.TrimLeft(hex.EncodeToString(swapCtLabels(labels)), "0")
+	if digits == "" {
+		digits = "0"
+	}
+	return "0x" + digits
+}
+
+// Convert ct_label between host and network byte order, in either
+// direction.
+func swapCtLabels(labels []byte) []byte {
+	res := make([]byte, len(labels))
+	copy(res, labels)
+	if hostLittleEndian {
+		for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+			res[i], res[j] = res[j], res[i]
+		}
+	}
+	return res
+}
+
+func tunnelIdToString(id []byte) string {
+	return fmt.Sprintf("%#x", binary.BigEndian.Uint64(id))
+}
+
+// FlowSyntaxError reports a problem with flow syntax passed to
+// ParseFlowKeyString, at byte offset Offset.
+type FlowSyntaxError struct {
+	Offset int
+	Msg    string
+}
+
+func (err FlowSyntaxError) Error() string {
+	return fmt.Sprintf("flow syntax error at offset %d: %s", err.Offset, err.Msg)
+}
+
+func IsFlowSyntaxError(err error) bool {
+	var serr FlowSyntaxError
+	return errors.As(err, &serr)
+}
+
+// ParseFlowKeyString parses flow keys written in OVS syntax, as
+// produced by FlowKeys.String.  The masks follow from the syntax:
+// Fields that are given without a mask are matched exactly, and
+// omitted fields are wildcarded.  Numbers are decimal, or hex with a
+// 0x prefix, and each field may only be given once.
+func ParseFlowKeyString(s string) (FlowKeys, error) {
+	p := flowSyntaxParser{s: s}
+
+	p.skipSpace()
+	if p.atEnd() {
+		return MakeFlowKeys(), nil
+	}
+
+	keys, err := p.keys()
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.atEnd() {
+		return nil, p.errorf("unexpected %q", p.s[p.pos])
+	}
+
+	return keys, nil
+}
+
+type flowSyntaxParser struct {
+	s   string
+	pos int
+}
+
+type syntaxField struct {
+	name  string
+	value string
+	mask  string
+	pos   int
+}
+
+func (p *flowSyntaxParser) errorAt(pos int, format string, args ...interface{}) error {
+	return FlowSyntaxError{Offset: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *flowSyntaxParser) errorf(format string, args ...interface{}) error {
+	return p.errorAt(p.pos, format, args...)
+}
+
+func (p *flowSyntaxParser) atEnd() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *flowSyntaxParser) peek() byte {
+	if p.atEnd() {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *flowSyntaxParser) skipSpace() {
+	for !p.atEnd() && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *flowSyntaxParser) expect(c byte) error {
+	p.skipSpace()
+	if p.peek() != c {
+		if p.atEnd() {
+			return p.errorf("expected %q, got end of input", c)
+		}
+		return p.errorf("expected %q, got %q", c, p.s[p.pos])
+	}
+
+	p.pos++
+	return nil
+}
+
+func (p *flowSyntaxParser) name() string {
+	p.skipSpace()
+	start := p.pos
+	for !p.atEnd() {
+		c := p.s[p.pos]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_') {
+			break
+		}
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// A value runs up to the next comma or parenthesis
+func (p *flowSyntaxParser) value() syntaxField {
+	p.skipSpace()
+	start := p.pos
+	for !p.atEnd() && strings.IndexByte(",()", p.s[p.pos]) < 0 {
+		p.pos++
+	}
+
+	f := syntaxField{value: strings.TrimSpace(p.s[start:p.pos]), pos: start}
+	if i := strings.IndexByte(f.value, '/'); i >= 0 {
+		f.mask = f.value[i+1:]
+		f.value = f.value[:i]
+	}
+	return f
+}
+
+func (p *flowSyntaxParser) keys() (FlowKeys, error) {
+	keys := MakeFlowKeys()
+	for {
+		p.skipSpace()
+		start := p.pos
+		k, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+
+		if _, dup := keys[k.TypeId()]; dup {
+			return nil, p.errorAt(start, "duplicate flow key")
+		}
+		keys.Add(k)
+
+		p.skipSpace()
+		if p.peek() != ',' {
+			return keys, nil
+		}
+		p.pos++
+	}
+}
+
+func (p *flowSyntaxParser) key() (FlowKey, error) {
+	start := p.pos
+	name := p.name()
+	if name == "" {
+		return nil, p.errorf("expected flow key name")
+	}
+
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+
+	var fk FlowKey
+	var err error
+	switch name {
+	case "encap":
+		fk, err = p.encap()
+	case "in_port", "eth_type", "tcp_flags", "ct_state", "ct_zone", "ct_mark", "ct_label":
+		fk, err = singleValueFlowKey(name, p.value())
+	case "eth", "ipv4", "tcp", "udp", "sctp", "vlan", "mpls", "tunnel":
+		var fields []syntaxField
+		fields, err = p.fields()
+		if err == nil {
+			fk, err = fieldsFlowKey(name, fields)
+		}
+	default:
+		fk, err = p.otherFlowKey(name, start)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return fk, p.expect(')')
+}
+
+func (p *flowSyntaxParser) encap() (FlowKey, error) {
+	fk := NewEncapFlowKey()
+	p.skipSpace()
+	if p.peek() == ')' {
+		return fk, nil
+	}
+
+	keys, err := p.keys()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, k := range keys {
+		fk.Add(k)
+	}
+	return fk, nil
+}
+
+func (p *flowSyntaxParser) fields() ([]syntaxField, error) {
+	var fields []syntaxField
+	seen := make(map[string]bool)
+	for {
+		p.skipSpace()
+		if p.peek() == ')' {
+			return fields, nil
+		}
+
+		start := p.pos
+		name := p.name()
+		if name == "" {
+			return nil, p.errorf("expected field name")
+		}
+
+		var f syntaxField
+		p.skipSpace()
+		if p.peek() == '(' {
+			// e.g. the tunnel flags(...)
+			p.pos++
+			f = p.value()
+			if err := p.expect(')'); err != nil {
+				return nil, err
+			}
+		} else {
+			if err := p.expect('='); err != nil {
+				return nil, err
+			}
+			f = p.value()
+		}
+
+		if seen[name] {
+			return nil, p.errorAt(start, "duplicate field %q", name)
+		}
+		seen[name] = true
+
+		f.name = name
+		f.pos = start
+		fields = append(fields, f)
+
+		p.skipSpace()
+		if p.peek() != ',' {
+			return fields, nil
+		}
+		p.pos++
+	}
+}
+
+// The named uint32 keys, and keyN(hex) for any key type
+func (p *flowSyntaxParser) otherFlowKey(name string, start int) (FlowKey, error) {
+	for typ, n := range uint32FlowKeyNames {
+		if n == name {
+			f := p.value()
+			v, m, err := f.uint(32)
+			if err != nil {
+				return nil, err
+			}
+
+			keyMask := MakeAlignedByteSlice(8)
+			*uint32At(keyMask, 0) = uint32(v)
+			*uint32At(keyMask, 4) = uint32(m)
+			return flowKeyParsers[typ].parse(typ, keyMask[:4], keyMask[4:])
+		}
+	}
+
+	if !strings.HasPrefix(name, "key") {
+		return nil, p.errorAt(start, "unknown flow key %q", name)
+	}
+
+	typ, err := strconv.ParseUint(name[3:], 10, 16)
+	if err != nil {
+		return nil, p.errorAt(start, "unknown flow key %q", name)
+	}
+
+	parser, ok := flowKeyParsers[uint16(typ)]
+	if !ok {
+		return nil, p.errorAt(start, "unknown flow key type %d", typ)
+	}
+
+	f := p.value()
+	key, err := hex.DecodeString(f.value)
+	if err != nil {
+		return nil, f.errorf("bad hex value %q", f.value)
+	}
+
+	var mask []byte
+	if f.mask == "" {
+		mask = parser.exactMask
+	} else if mask, err = hex.DecodeString(f.mask); err != nil {
+		return nil, f.errorf("bad hex mask %q", f.mask)
+	}
+
+	fk, err := parser.parse(uint16(typ), key, mask)
+	if err != nil {
+		return nil, f.errorf("%s", err)
+	}
+	return fk, nil
+}
+
+func singleValueFlowKey(name string, f syntaxField) (FlowKey, error) {
+	switch name {
+	case "in_port":
+		if f.mask != "" {
+			return nil, f.errorf("in_port cannot be masked")
+		}
+
+		v, _, err := f.uint(32)
+		if err != nil {
+			return nil, err
+		}
+		return NewInPortFlowKey(VportID(v)), nil
+
+	case "eth_type":
+		v, m, err := f.uint(16)
+		if err != nil {
+			return nil, err
+		}
+
+		fk := NewEtherTypeFlowKey()
+		fk.SetMaskedEtherType(uint16(v), uint16(m))
+		return fk, nil
+
+	case "tcp_flags":
+		v, m, err := f.uint(16)
+		if err != nil {
+			return nil, err
+		}
+
+		fk := NewTcpFlagsFlowKey()
+		fk.SetMaskedFlags(uint16(v), uint16(m))
+		return fk, nil
+
+	case "ct_state":
+		fk := NewCtStateFlowKey()
+		if f.value == "" || f.value[0] == '+' || f.value[0] == '-' {
+			return fk, f.ctStateFlags(&fk)
+		}
+
+		v, m, err := f.uint(32)
+		if err != nil {
+			return nil, err
+		}
+		fk.SetMaskedState(uint32(v), uint32(m))
+		return fk, nil
+
+	case "ct_zone":
+		v, m, err := f.uint16()
+		if err != nil {
+			return nil, err
+		}
+
+		fk := NewCtZoneFlowKey()
+		fk.SetMaskedZone(v, m)
+		return fk, nil
+
+	case "ct_mark":
+		v, m, err := f.uint(32)
+		if err != nil {
+			return nil, err
+		}
+
+		fk := NewCtMarkFlowKey()
+		fk.SetMaskedMark(uint32(v), uint32(m))
+		return fk, nil
+
+	default: // ct_label
+		v, m, err := f.ctLabels()
+		if err != nil {
+			return nil, err
+		}
+
+		fk := NewCtLabelsFlowKey()
+		fk.SetMaskedLabels(v, m)
+		return fk, nil
+	}
+}
+
+func fieldsFlowKey(name string, fields []syntaxField) (FlowKey, error) {
+	switch name {
+	case "eth":
+		return ethernetFromFields(fields)
+	case "ipv4":
+		return ipv4FromFields(fields)
+	case "vlan":
+		return vlanFromFields(fields)
+	case "mpls":
+		return mplsFromFields(fields)
+	case "tunnel":
+		return tunnelFromFields(fields)
+	case "tcp":
+		return transportFromFields(NewTcpFlowKey(), fields)
+	case "udp":
+		return transportFromFields(NewUdpFlowKey(), fields)
+	default:
+		return transportFromFields(NewSctpFlowKey(), fields)
+	}
+}
+
+func ethernetFromFields(fields []syntaxField) (FlowKey, error) {
+	fk := EthernetFlowKey{newWildcardBlobFlowKey(OVS_KEY_ATTR_ETHERNET,
+		SizeofOvsKeyEthernet)}
+	for _, f := range fields {
+		if f.name != "src" && f.name != "dst" {
+			return nil, f.unknown()
+		}
+
+		v, m, err := f.mac()
+		if err != nil {
+			return nil, err
+		}
+
+		if f.name == "src" {
+			fk.SetMaskedEthSrc(v, m)
+		} else {
+			fk.SetMaskedEthDst(v, m)
+		}
+	}
+	return fk, nil
+}
+
+func ipv4FromFields(fields []syntaxField) (FlowKey, error) {
+	fk := NewIPv4FlowKey()
+	for _, f := range fields {
+		switch f.name {
+		case "src", "dst":
+			v, m, err := f.ipv4()
+			if err != nil {
+				return nil, err
+			}
+
+			if f.name == "src" {
+				fk.SetMaskedSrc(v, m)
+			} else {
+				fk.SetMaskedDst(v, m)
+			}
+
+		case "proto", "tos", "ttl", "frag":
+			v, m, err := f.ipv4Uint8()
+			if err != nil {
+				return nil, err
+			}
+
+			k := fk.key()
+			mask := fk.mask()
+			switch f.name {
+			case "proto":
+				k.Proto, mask.Proto = v, m
+			case "tos":
+				k.Tos, mask.Tos = v, m
+			case "ttl":
+				k.Ttl, mask.Ttl = v, m
+			default:
+				k.Frag, mask.Frag = v, m
+			}
+
+		default:
+			return nil, f.unknown()
+		}
+	}
+	return fk, nil
+}
+
+func transportFromFields(fk TransportFlowKey, fields []syntaxField) (FlowKey, error) {
+	for _, f := range fields {
+		if f.name != "src" && f.name != "dst" {
+			return nil, f.unknown()
+		}
+
+		v, m, err := f.uint16()
+		if err != nil {
+			return nil, err
+		}
+
+		if f.name == "src" {
+			fk.SetMaskedSrc(v, m)
+		} else {
+			fk.SetMaskedDst(v, m)
+		}
+	}
+	return fk, nil
+}
+
+// A vlan key implies that a tag is present, unless it says cfi=0
+func vlanFromFields(fields []syntaxField) (FlowKey, error) {
+	tci := uint16(VLAN_CFI_MASK)
+	mask := uint16(VLAN_CFI_MASK)
+	for _, f := range fields {
+		switch f.name {
+		case "vid":
+			v, m, err := f.uint(12)
+			if err != nil {
+				return nil, err
+			}
+			tci |= uint16(v)
+			mask |= uint16(m) & VLAN_VID_MASK
+
+		case "pcp":
+			v, m, err := f.uint(3)
+			if err != nil {
+				return nil, err
+			}
+			tci |= uint16(v) << VLAN_PRIO_SHIFT
+			mask |= uint16(m&7) << VLAN_PRIO_SHIFT
+
+		case "cfi":
+			v, _, err := f.uint(1)
+			if err != nil {
+				return nil, err
+			}
+			if v == 0 {
+				tci &^= VLAN_CFI_MASK
+			}
+
+		default:
+			return nil, f.unknown()
+		}
+	}
+
+	fk := NewVlanFlowKey()
+	fk.SetMaskedTCI(tci, mask)
+	return fk, nil
+}
+
+func mplsFromFields(fields []syntaxField) (FlowKey, error) {
+	var lse, mask uint32
+	var lses, masks []uint32
+	named := false
+	for _, f := range fields {
+		// Either lse0, lse1 etc., in order, or the named
+		// fields of a single LSE
+		if strings.HasPrefix(f.name, "lse") {
+			if named || f.name != fmt.Sprint("lse", len(lses)) || len(lses) == MPLS_LABEL_DEPTH {
+				return nil, f.unknown()
+			}
+
+			v, m, err := f.uint(32)
+			if err != nil {
+				return nil, err
+			}
+			lses = append(lses, uint32(v))
+			masks = append(masks, uint32(m))
+			continue
+		}
+
+		if lses != nil {
+			return nil, f.unknown()
+		}
+		named = true
+
+		var bits, shift int
+		switch f.name {
+		case "label":
+			bits, shift = 20, MPLS_LS_LABEL_SHIFT
+		case "tc":
+			bits, shift = 3, MPLS_LS_TC_SHIFT
+		case "bos":
+			bits, shift = 1, MPLS_LS_S_SHIFT
+		case "ttl":
+			bits, shift = 8, 0
+		default:
+			return nil, f.unknown()
+		}
+
+		v, m, err := f.uint(bits)
+		if err != nil {
+			return nil, err
+		}
+		lse |= uint32(v) << uint(shift)
+		mask |= uint32(m&(1<<uint(bits)-1)) << uint(shift)
+	}
+
+	fk := NewMplsFlowKey()
+	if lses != nil {
+		return fk, fk.SetMaskedLSEs(lses, masks)
+	}
+
+	fk.SetMaskedLSE(lse, mask)
+	return fk, nil
+}
+
+func tunnelFromFields(fields []syntaxField) (FlowKey, error) {
+	var fk TunnelFlowKey
+	for _, f := range fields {
+		var err error
+		switch f.name {
+		case "tun_id":
+			var v, m uint64
+			v, m, err = f.uint(64)
+			binary.BigEndian.PutUint64(fk.key.TunnelId[:], v)
+			binary.BigEndian.PutUint64(fk.mask.TunnelId[:], m)
+		case "src":
+			fk.key.Ipv4Src, fk.mask.Ipv4Src, err = f.ipv4()
+		case "dst":
+			fk.key.Ipv4Dst, fk.mask.Ipv4Dst, err = f.ipv4()
+		case "tos":
+			fk.key.Tos, fk.mask.Tos, err = f.uint8()
+		case "ttl":
+			fk.key.Ttl, fk.mask.Ttl, err = f.uint8()
+		case "tp_src":
+			fk.key.TpSrc, fk.mask.TpSrc, err = f.uint16()
+		case "tp_dst":
+			fk.key.TpDst, fk.mask.TpDst, err = f.uint16()
+		case "flags":
+			err = f.tunnelFlags(&fk)
+		default:
+			err = f.unknown()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fk, nil
+}
+
+// Tunnel flags are written as e.g. "+df-csum"
+func (f syntaxField) tunnelFlags(fk *TunnelFlowKey) error {
+	s := f.value
+	for s != "" {
+		if s[0] != '+' && s[0] != '-' {
+			return f.errorf("bad tunnel flags %q", f.value)
+		}
+
+		set := s[0] == '+'
+		s = s[1:]
+		n := strings.IndexAny(s, "+-")
+		if n < 0 {
+			n = len(s)
+		}
+
+		switch s[:n] {
+		case "df":
+			fk.SetDf(set)
+		case "csum":
+			fk.SetCsum(set)
+		default:
+			return f.errorf("unknown tunnel flag %q", s[:n])
+		}
+		s = s[n:]
+	}
+	return nil
+}
+
+// ct_state flags are written as e.g. "-new+est+trk"
+func (f syntaxField) ctStateFlags(fk *CtStateFlowKey) error {
+	s := f.value
+	for s != "" {
+		if s[0] != '+' && s[0] != '-' {
+			return f.errorf("bad ct_state flags %q", f.value)
+		}
+
+		set := s[0] == '+'
+		s = s[1:]
+		n := strings.IndexAny(s, "+-")
+		if n < 0 {
+			n = len(s)
+		}
+
+		found := false
+		for _, cs := range ctStateFlagNames {
+			if cs.name == s[:n] {
+				fk.SetStateFlag(cs.flag, set)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return f.errorf("unknown ct_state flag %q", s[:n])
+		}
+		s = s[n:]
+	}
+	return nil
+}
+
+func (f syntaxField) errorf(format string, args ...interface{}) error {
+	return FlowSyntaxError{Offset: f.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (f syntaxField) unknown() error {
+	return f.errorf("unknown field %q", f.name)
+}
+
+// Parse a numeric value and mask.  Without a mask, all bits are
+// matched.
+func (f syntaxField) uint(bits int) (v uint64, m uint64, err error) {
+	v, err = parseSyntaxUint(f.value, bits)
+	if err != nil {
+		return 0, 0, f.errorf("bad %d-bit value %q", bits, f.value)
+	}
+
+	if f.mask == "" {
+		return v, 1<<uint(bits) - 1, nil
+	}
+
+	m, err = parseSyntaxUint(f.mask, bits)
+	if err != nil {
+		return 0, 0, f.errorf("bad %d-bit mask %q", bits, f.mask)
+	}
+	return v, m, nil
+}
+
+// Numbers are decimal unless they have a 0x prefix.  (A leading 0
+// doesn't mean octal, as it would with strconv's base 0.)
+func parseSyntaxUint(s string, bits int) (uint64, error) {
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		return strconv.ParseUint(s[2:], 16, bits)
+	}
+
+	return strconv.ParseUint(s, 10, bits)
+}
+
+func (f syntaxField) uint8() (uint8, uint8, error) {
+	v, m, err := f.uint(8)
+	return uint8(v), uint8(m), err
+}
+
+func (f syntaxField) uint16() (uint16, uint16, error) {
+	v, m, err := f.uint(16)
+	return uint16(v), uint16(m), err
+}
+
+// Like uint8, but also accepting the names of fragment types
+func (f syntaxField) ipv4Uint8() (uint8, uint8, error) {
+	if f.name == "frag" && f.mask == "" {
+		for i, n := range fragTypeNames {
+			if f.value == n {
+				return uint8(i), 0xff, nil
+			}
+		}
+	}
+	return f.uint8()
+}
+
+// ct labels are written as a hex number of up to 128 bits
+func (f syntaxField) ctLabels() (v, m [OVS_CT_LABELS_LEN]byte, err error) {
+	parse := func(s string, what string) ([OVS_CT_LABELS_LEN]byte, error) {
+		var res [OVS_CT_LABELS_LEN]byte
+		digits := strings.TrimPrefix(s, "0x")
+		if len(digits) == 0 || len(digits) > 2*OVS_CT_LABELS_LEN {
+			return res, f.errorf("bad ct_label %s %q", what, s)
+		}
+
+		digits = strings.Repeat("0", 2*OVS_CT_LABELS_LEN-len(digits)) + digits
+		if _, err := hex.Decode(res[:], []byte(digits)); err != nil {
+			return res, f.errorf("bad ct_label %s %q", what, s)
+		}
+		copy(res[:], swapCtLabels(res[:]))
+		return res, nil
+	}
+
+	if v, err = parse(f.value, "value"); err != nil {
+		return
+	}
+
+	if f.mask == "" {
+		for i := range m {
+			m[i] = 0xff
+		}
+		return
+	}
+
+	m, err = parse(f.mask, "mask")
+	return
+}
+
+func (f syntaxField) mac() (v, m [ETH_ALEN]byte, err error) {
+	parse := func(s string, what string) ([ETH_ALEN]byte, error) {
+		var res [ETH_ALEN]byte
+		addr, err := net.ParseMAC(s)
+		if err != nil || len(addr) != ETH_ALEN {
+			return res, f.errorf("bad MAC %s %q", what, s)
+		}
+		copy(res[:], addr)
+		return res, nil
+	}
+
+	if v, err = parse(f.value, "address"); err != nil {
+		return
+	}
+
+	if f.mask == "" {
+		m = [...]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+		return
+	}
+
+	m, err = parse(f.mask, "mask")
+	return
+}
+
+func (f syntaxField) ipv4() (v, m [4]byte, err error) {
+	parse := func(s string, what string) ([4]byte, error) {
+		var res [4]byte
+		ip := net.ParseIP(s).To4()
+		if ip == nil {
+			return res, f.errorf("bad IPv4 %s %q", what, s)
+		}
+		copy(res[:], ip)
+		return res, nil
+	}
+
+	if v, err = parse(f.value, "address"); err != nil {
+		return
+	}
+
+	if f.mask == "" {
+		m = [...]byte{0xff, 0xff, 0xff, 0xff}
+		return
+	}
+
+	m, err = parse(f.mask, "mask")
+	return
+}
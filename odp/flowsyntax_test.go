@@ -0,0 +1,206 @@
+package odp
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFormatFlowKeys(t *testing.T) {
+	fks := MakeFlowKeys()
+	fks.Add(NewInPortFlowKey(2))
+
+	eth := NewEthernetFlowKey()
+	eth.SetEthSrc([...]byte{0x02, 0, 0, 0, 0, 1})
+	eth.SetMaskedEthDst([...]byte{0x02, 0, 0, 0, 0, 2},
+		[...]byte{0xff, 0xff, 0xff, 0, 0, 0})
+	fks.Add(eth)
+
+	ethType := NewEtherTypeFlowKey()
+	ethType.SetEtherType(0x0800)
+	fks.Add(ethType)
+
+	ip := NewIPv4FlowKey()
+	ip.SetSrc([...]byte{10, 0, 0, 1})
+	ip.SetMaskedDst([...]byte{10, 0, 0, 0}, [...]byte{255, 0, 0, 0})
+	ip.SetProto(6)
+	fks.Add(ip)
+
+	tcp := NewTcpFlowKey()
+	tcp.SetDst(80)
+	fks.Add(tcp)
+
+	// Ignored keys are left out
+	fks.Add(NewUdpFlowKey())
+
+	expect := "in_port(2)," +
+		"eth(src=02:00:00:00:00:01,dst=02:00:00:00:00:02/ff:ff:ff:00:00:00)," +
+		"eth_type(0x0800)," +
+		"ipv4(src=10.0.0.1,dst=10.0.0.0/255.0.0.0,proto=6)," +
+		"tcp(dst=80)"
+	if s := fks.String(); s != expect {
+		t.Fatal(s)
+	}
+}
+
+func TestFormatFlowKey(t *testing.T) {
+	vlan := NewVlanFlowKey()
+	vlan.SetVid(10)
+
+	vlanEtherType := NewEtherTypeFlowKey()
+	vlanEtherType.SetEtherType(0x0800)
+	encap := NewEncapFlowKey()
+	encap.Add(vlanEtherType)
+
+	flags := NewTcpFlagsFlowKey()
+	flags.SetMaskedFlags(0x02, 0x12)
+
+	var tun TunnelFlowKey
+	tun.SetTunnelId([8]byte{0, 0, 0, 0, 0, 0, 0, 5})
+	tun.SetIpv4Dst([4]byte{192, 168, 0, 1})
+	tun.SetDf(true)
+	tun.SetCsum(false)
+
+	mark := NewBlobFlowKey(OVS_KEY_ATTR_SKB_MARK, 4)
+	*uint32At(mark.key(), 0) = 7
+
+	icmp := NewBlobFlowKey(OVS_KEY_ATTR_ICMP, 2)
+	icmp.key()[0] = 8
+	icmp.mask()[1] = 0
+
+	for _, c := range []struct {
+		fk     FlowKey
+		expect string
+	}{
+		{vlan, "vlan(vid=10)"},
+		{encap, "encap(eth_type(0x0800))"},
+		{flags, "tcp_flags(0x002/0x12)"},
+		{tun, "tunnel(tun_id=0x5,dst=192.168.0.1,flags(+df-csum))"},
+		{mark, "skb_mark(0x7)"},
+		{icmp, "key11(0800/ff00)"},
+	} {
+		if s := FormatFlowKey(c.fk); s != c.expect {
+			t.Errorf("got %s, expected %s", s, c.expect)
+		}
+	}
+}
+
+func TestParseFlowKeyString(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"in_port(2),eth(src=02:00:00:00:00:01,dst=02:00:00:00:00:02/ff:ff:ff:00:00:00),eth_type(0x0800),ipv4(src=10.0.0.1,dst=10.0.0.0/255.0.0.0,proto=6,ttl=64,frag=no),tcp(dst=80)",
+		"eth_type(0x8100),vlan(vid=10,pcp=3),encap(eth_type(0x0800),ipv4(proto=17),udp(src=53/0xff00))",
+		"vlan(cfi=0)",
+		"sctp(src=1),tcp_flags(0x002/0x12)",
+		"tunnel(tun_id=0x5,src=10.0.0.1,dst=192.168.0.1/255.255.255.0,ttl=64,tp_dst=4789,flags(+df-csum))",
+		"skb_mark(0x7),key11(0800/ff00)",
+		"ct_state(-new+est+trk),ct_zone(0x5),ct_mark(0x10/0xf0),ct_label(0x1/0xff),in_port(1)",
+		"ct_state(0x100/0x1ff)",
+		"eth_type(0x8847),mpls(label=100,tc=3,ttl=64,bos=1)",
+		"mpls(label=16/0xff0)",
+		"mpls(lse0=0x10000/0xfffff000,lse1=0x11140)",
+		"recirc_id(0x7),in_port(1)",
+	} {
+		fks, err := ParseFlowKeyString(s)
+		if err != nil {
+			t.Fatal(s, err)
+		}
+
+		if fks.String() != s {
+			t.Fatalf("%s round-tripped as %s", s, fks)
+		}
+
+		again, err := ParseFlowKeyString(fks.String())
+		if err != nil || !again.Equals(fks) {
+			t.Fatal(s, err)
+		}
+	}
+
+	fks, err := ParseFlowKeyString(" in_port( 3 ) , eth_type(2048)")
+	if err != nil || fks.String() != "in_port(3),eth_type(0x0800)" {
+		t.Fatal(fks, err)
+	}
+
+	// Omitted fields are wildcarded
+	fks, err = ParseFlowKeyString("eth(src=02:00:00:00:00:01)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eth := fks[OVS_KEY_ATTR_ETHERNET].(EthernetFlowKey)
+	if m := eth.Mask(); m.EthDst != [ETH_ALEN]byte{} || m.EthSrc != [...]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff} {
+		t.Fatal(eth)
+	}
+
+	// A leading zero doesn't mean octal
+	fks, err = ParseFlowKeyString("tcp(dst=080)")
+	if err != nil || fks[OVS_KEY_ATTR_TCP].(TransportFlowKey).Dst() != 80 {
+		t.Fatal(fks, err)
+	}
+}
+
+func TestParseFlowKeyStringErrors(t *testing.T) {
+	for _, c := range []struct {
+		s      string
+		offset int
+	}{
+		{"foo(1)", 0},
+		{"in_port(2", 9},
+		{"in_port(x)", 8},
+		{"in_port(1),in_port(2)", 11},
+		{"eth(src=1:2)", 4},
+		{"eth(vid=1)", 4},
+		{"ipv4(src=10.0.0.1,dst=10.0.0.256)", 18},
+		{"tcp(dst=65536)", 4},
+		{"in_port(1) x", 11},
+		{"tunnel(flags(df))", 7},
+		{"tcp(src=1,src=2)", 10},
+		{"in_port(0x)", 8},
+		{"ct_state(+foo)", 9},
+		{"ct_label(0xg)", 9},
+		{"mpls(label=1,lse0=0x1)", 13},
+	} {
+		_, err := ParseFlowKeyString(c.s)
+		var serr FlowSyntaxError
+		if !errors.As(err, &serr) || serr.Offset != c.offset {
+			t.Errorf("%s: %v", c.s, err)
+		}
+	}
+}
+
+func TestCtLabelSyntax(t *testing.T) {
+	// As ovs-dpctl dump-flows prints them: OVS formats ct_label as
+	// a 128-bit integer, so label bit 0 is 0x1 and bit 64 is
+	// 0x10000000000000000.
+	bits := func(from, to int) (b [OVS_CT_LABELS_LEN]byte) {
+		for n := from; n < to; n++ {
+			i := n / 8
+			if !hostLittleEndian {
+				i = OVS_CT_LABELS_LEN - 1 - i
+			}
+			b[i] |= 1 << uint(n%8)
+		}
+		return
+	}
+
+	for _, c := range []struct {
+		s            string
+		labels, mask [OVS_CT_LABELS_LEN]byte
+	}{
+		{"ct_label(0x1)", bits(0, 1), bits(0, 128)},
+		{"ct_label(0x10000000000000000/0xffffffffffffffff0000000000000000)", bits(64, 65), bits(64, 128)},
+	} {
+		fks, err := ParseFlowKeyString(c.s)
+		if err != nil {
+			t.Fatal(c.s, err)
+		}
+
+		fk := fks[OVS_KEY_ATTR_CT_LABELS].(CtLabelsFlowKey)
+		if fk.Labels() != c.labels || fk.LabelsMask() != c.mask {
+			t.Fatal(c.s, fk)
+		}
+
+		if fks.String() != c.s {
+			t.Fatalf("%s formatted as %s", c.s, fks)
+		}
+	}
+}
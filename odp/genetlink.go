@@ -1,17 +1,37 @@
 package odp
 
-import (
-	"fmt"
-	"syscall"
-)
+import "fmt"
 
 type GenlFamily struct {
 	id       uint16
+	version  uint32
 	mcGroups map[string]uint32
 }
 
+// The dynamically assigned generic netlink family id, to be used as
+// the nlmsghdr type in requests to the family.
+func (family GenlFamily) ID() uint16 {
+	return family.id
+}
+
+// The version of the family implemented by the kernel
+// (CTRL_ATTR_VERSION), or 0 if the kernel didn't report one.
+func (family GenlFamily) Version() uint32 {
+	return family.version
+}
+
+// The multicast groups advertised by the family, mapping group names
+// to group ids.
+func (family GenlFamily) MCGroups() map[string]uint32 {
+	res := make(map[string]uint32)
+	for name, id := range family.mcGroups {
+		res[name] = id
+	}
+	return res
+}
+
 func (nlmsg *NlMsgBuilder) PutGenlMsghdr(cmd uint8, version uint8) *GenlMsghdr {
-	pos := nlmsg.AlignGrow(syscall.NLMSG_ALIGNTO, SizeofGenlMsghdr)
+	pos := nlmsg.nlmsgAlignGrow(SizeofGenlMsghdr)
 	res := genlMsghdrAt(nlmsg.buf, pos)
 	res.Cmd = cmd
 	res.Version = version
@@ -19,7 +39,7 @@ func (nlmsg *NlMsgBuilder) PutGenlMsghdr(cmd uint8, version uint8) *GenlMsghdr {
 }
 
 func (nlmsg *NlMsgParser) CheckGenlMsghdr(cmd int) (*GenlMsghdr, error) {
-	pos, err := nlmsg.AlignAdvance(syscall.NLMSG_ALIGNTO, SizeofGenlMsghdr)
+	pos, err := nlmsg.nlmsgAlignAdvance(SizeofGenlMsghdr)
 	if err != nil {
 		return nil, err
 	}
@@ -41,6 +61,17 @@ func (nlmsg *NlMsgParser) CheckGenlMsghdr(cmd int) (*GenlMsghdr, error) {
 	return gh, nil
 }
 
+// Check both the nlmsghdr and genlmsghdr of a response: The message
+// type should be the family id, and the genl command should be cmd
+// (unless cmd is negative).
+func (nlmsg *NlMsgParser) ExpectGenlResponse(family uint16, cmd int) (*GenlMsghdr, error) {
+	if _, err := nlmsg.ExpectNlMsghdr(family); err != nil {
+		return nil, err
+	}
+
+	return nlmsg.CheckGenlMsghdr(cmd)
+}
+
 func (s *NetlinkSocket) LookupGenlFamily(name string) (family GenlFamily, err error) {
 	req := NewNlMsgBuilder(RequestFlags, GENL_ID_CTRL)
 
@@ -52,22 +83,22 @@ func (s *NetlinkSocket) LookupGenlFamily(name string) (family GenlFamily, err er
 		return
 	}
 
-	_, err = resp.ExpectNlMsghdr(GENL_ID_CTRL)
+	_, err = resp.ExpectGenlResponse(GENL_ID_CTRL, CTRL_CMD_NEWFAMILY)
 	if err != nil {
 		return
 	}
 
-	_, err = resp.CheckGenlMsghdr(CTRL_CMD_NEWFAMILY)
+	attrs, err := resp.TakeAttrs()
 	if err != nil {
 		return
 	}
 
-	attrs, err := resp.TakeAttrs()
+	family.id, err = attrs.GetUint16(CTRL_ATTR_FAMILY_ID)
 	if err != nil {
 		return
 	}
 
-	family.id, err = attrs.GetUint16(CTRL_ATTR_FAMILY_ID)
+	family.version, _, err = attrs.GetOptionalUint32(CTRL_ATTR_VERSION)
 	if err != nil {
 		return
 	}
@@ -1,27 +1,184 @@
 package odp
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"reflect"
+	"runtime"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 func align(n int, a int) int {
 	return (n + a - 1) & -a
 }
 
+// NLMSG_ALIGN
+func nlmsgAlign(n int) int {
+	return align(n, syscall.NLMSG_ALIGNTO)
+}
+
+// NLA_ALIGN.  rtnetlink's RTA_ALIGN is the same 4-byte alignment,
+// and rtnetlink attributes are built and parsed by the same code as
+// other netlink attributes, so there is no separate rtaAlign.
+func nlaAlign(n int) int {
+	return align(n, syscall.NLA_ALIGNTO)
+}
+
+// Request, RequestContext and RequestMulti may be called concurrently
+// on a NetlinkSocket: each holds the socket's lock from sending the
+// request until it has received the response, so they can't consume
+// each other's responses.  Receive does not take the lock, so it
+// should only be used on sockets that are not also used for requests.
+// The setters (SetNoENOBUFS, SetRecvTimeout etc.) take the lock too,
+// so that the settings they record for Reopen stay consistent.
 type NetlinkSocket struct {
-	fd   int
-	addr *syscall.SockaddrNetlink
+	// First, so that the counters are 64-bit aligned for the
+	// atomic operations even on 32-bit platforms
+	stats SocketStats
+
+	fd       int
+	addr     *syscall.SockaddrNetlink
+	lock     sync.Mutex
+	nonblock bool
+
+	// Settings for Reopen to restore
+	protocol    int
+	noENOBUFS   bool
+	recvbufSize int
+	recvTimeout time.Duration
+	extAck      bool
+	groups      map[uint32]struct{}
+
+	// For sockets opened by OpenNetlinkSocketInNetns, our own
+	// descriptor for the network namespace, otherwise -1
+	netns int
 }
 
 func OpenNetlinkSocket(protocol int) (*NetlinkSocket, error) {
-	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, protocol)
+	fd, addr, err := openNetlinkFd(protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NetlinkSocket{
+		fd:        fd,
+		addr:      addr,
+		protocol:  protocol,
+		noENOBUFS: true,
+		groups:    make(map[uint32]struct{}),
+		netns:     -1,
+	}, nil
+}
+
+// Like OpenNetlinkSocket, but the socket is created in the network
+// namespace referred to by nsFd (e.g. an open /proc/<pid>/ns/net),
+// so that it talks to that namespace's kernel state.  The calling
+// goroutine's namespace is not affected.  The NetlinkSocket keeps its
+// own duplicate of nsFd, so that Reopen can use the same namespace;
+// the caller may close nsFd afterwards.
+func OpenNetlinkSocketInNetns(protocol int, nsFd int) (*NetlinkSocket, error) {
+	netns, err := dupCloexec(nsFd)
 	if err != nil {
 		return nil, err
 	}
 
+	fd, addr, err := openNetlinkFdInNetns(protocol, netns)
+	if err != nil {
+		syscall.Close(netns)
+		return nil, err
+	}
+
+	return &NetlinkSocket{
+		fd:        fd,
+		addr:      addr,
+		protocol:  protocol,
+		noENOBUFS: true,
+		groups:    make(map[uint32]struct{}),
+		netns:     netns,
+	}, nil
+}
+
+func dupCloexec(fd int) (int, error) {
+	newfd, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd),
+		syscall.F_DUPFD_CLOEXEC, 0)
+	if errno != 0 {
+		return -1, errno
+	}
+
+	return int(newfd), nil
+}
+
+func setns(fd int) error {
+	_, _, errno := syscall.Syscall(sysSetns, uintptr(fd),
+		syscall.CLONE_NEWNET, 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// The network namespace is a property of the OS thread, so the
+// socket is created on a dedicated locked thread.  If switching that
+// thread back to its original namespace fails, the goroutine exits
+// without unlocking it, and the runtime discards the thread rather
+// than let other goroutines run in the wrong namespace.
+func openNetlinkFdInNetns(protocol int, netns int) (int, *syscall.SockaddrNetlink, error) {
+	type result struct {
+		fd   int
+		addr *syscall.SockaddrNetlink
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		orig, err := syscall.Open(fmt.Sprintf("/proc/self/task/%d/ns/net",
+			syscall.Gettid()), syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			runtime.UnlockOSThread()
+			done <- result{-1, nil, err}
+			return
+		}
+		defer syscall.Close(orig)
+
+		if err := setns(netns); err != nil {
+			runtime.UnlockOSThread()
+			done <- result{-1, nil, err}
+			return
+		}
+
+		fd, addr, err := openNetlinkFd(protocol)
+
+		if rerr := setns(orig); rerr != nil {
+			if err == nil {
+				syscall.Close(fd)
+			}
+			done <- result{-1, nil, fmt.Errorf("restoring network namespace: %w", rerr)}
+			return
+		}
+
+		runtime.UnlockOSThread()
+		done <- result{fd, addr, err}
+	}()
+
+	res := <-done
+	return res.fd, res.addr, res.err
+}
+
+func openNetlinkFd(protocol int) (int, *syscall.SockaddrNetlink, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, protocol)
+	if err != nil {
+		return -1, nil, err
+	}
+
 	success := false
 	defer func() {
 		if !success {
@@ -35,26 +192,346 @@ func OpenNetlinkSocket(protocol int) (*NetlinkSocket, error) {
 	// and the default of /proc/sys/net/core/rmem_max means we
 	// can't easily increase it.
 	if err := syscall.SetsockoptInt(fd, SOL_NETLINK, syscall.NETLINK_NO_ENOBUFS, 1); err != nil {
-		return nil, err
+		return -1, nil, err
 	}
 
 	addr := syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
 	if err := syscall.Bind(fd, &addr); err != nil {
-		return nil, err
+		return -1, nil, err
 	}
 
 	localaddr, err := syscall.Getsockname(fd)
 	if err != nil {
-		return nil, err
+		return -1, nil, err
 	}
 
 	switch nladdr := localaddr.(type) {
 	case *syscall.SockaddrNetlink:
 		success = true
-		return &NetlinkSocket{fd: fd, addr: nladdr}, nil
+		return fd, nladdr, nil
 
 	default:
-		return nil, fmt.Errorf("Expected netlink sockaddr, got %s", reflect.TypeOf(localaddr))
+		return -1, nil, fmt.Errorf("Expected netlink sockaddr, got %s", reflect.TypeOf(localaddr))
+	}
+}
+
+// Reopen replaces the socket with a new one of the same protocol, for
+// recovery from unrecoverable errors.  Settings made through the
+// NetlinkSocket methods, and multicast group memberships, are carried
+// over to the new socket.  The new socket has a different port id,
+// which is returned.  If opening or configuring the new socket fails,
+// the old one is kept.  Reopen excludes concurrent requests, but
+// should not be called while the socket is otherwise in use (e.g. by
+// Receive).
+func (s *NetlinkSocket) Reopen() (uint32, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var fd int
+	var addr *syscall.SockaddrNetlink
+	var err error
+	if s.netns >= 0 {
+		fd, addr, err = openNetlinkFdInNetns(s.protocol, s.netns)
+	} else {
+		fd, addr, err = openNetlinkFd(s.protocol)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.restoreSettings(fd); err != nil {
+		syscall.Close(fd)
+		return 0, err
+	}
+
+	if s.fd >= 0 {
+		syscall.Close(s.fd)
+	}
+
+	s.fd = fd
+	s.addr = addr
+	return addr.Pid, nil
+}
+
+// Apply the recorded settings to a new socket fd.  Called with the
+// lock held.
+func (s *NetlinkSocket) restoreSettings(fd int) error {
+	if !s.noENOBUFS {
+		if err := setNoENOBUFS(fd, false); err != nil {
+			return err
+		}
+	}
+
+	if s.recvbufSize != 0 {
+		if err := setRecvbufSize(fd, s.recvbufSize); err != nil {
+			return err
+		}
+	}
+
+	if s.recvTimeout != 0 {
+		if err := setRecvTimeout(fd, s.recvTimeout); err != nil {
+			return err
+		}
+	}
+
+	if s.nonblock {
+		if err := syscall.SetNonblock(fd, true); err != nil {
+			return err
+		}
+	}
+
+	if s.extAck {
+		if err := setBoolSockopt(fd, NETLINK_EXT_ACK, true); err != nil {
+			return err
+		}
+	}
+
+	for group := range s.groups {
+		if err := syscall.SetsockoptInt(fd, SOL_NETLINK, syscall.NETLINK_ADD_MEMBERSHIP, int(group)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// OpenNetlinkSocket enables NETLINK_NO_ENOBUFS.  This trades error
+// reporting for resilience: When the socket buffer overflows, the
+// kernel silently drops messages rather than reporting ENOBUFS on the
+// next recv.  Disabling it means that overruns get reported (see
+// IsSocketOverrunError), but then whatever is receiving from the
+// socket needs to be prepared to handle that error.
+func (s *NetlinkSocket) SetNoENOBUFS(on bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := setNoENOBUFS(s.fd, on); err != nil {
+		return err
+	}
+
+	s.noENOBUFS = on
+	return nil
+}
+
+func setNoENOBUFS(fd int, on bool) error {
+	return setBoolSockopt(fd, syscall.NETLINK_NO_ENOBUFS, on)
+}
+
+func setBoolSockopt(fd int, opt int, on bool) error {
+	val := 0
+	if on {
+		val = 1
+	}
+
+	return syscall.SetsockoptInt(fd, SOL_NETLINK, opt, val)
+}
+
+// SetExtAck enables extended acks (NETLINK_EXT_ACK, since Linux
+// 4.12), so that error responses can carry a message and the offset
+// of the offending attribute, reported as a NetlinkExtAckError.  No
+// flags need to be set on requests: The kernel sets NLM_F_ACK_TLVS
+// (and NLM_F_CAPPED if it didn't echo the whole request) on error
+// responses that carry the extended ack attributes.
+func (s *NetlinkSocket) SetExtAck(on bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := setBoolSockopt(s.fd, NETLINK_EXT_ACK, on); err != nil {
+		return err
+	}
+
+	s.extAck = on
+	return nil
+}
+
+// Messages destined for the socket were dropped by the kernel because
+// the socket buffer was full.  Only reported when NETLINK_NO_ENOBUFS
+// is disabled.
+func IsSocketOverrunError(err error) bool {
+	return errors.Is(err, syscall.ENOBUFS)
+}
+
+// Set the socket receive buffer size.  SO_RCVBUFFORCE allows
+// exceeding /proc/sys/net/core/rmem_max, but needs CAP_NET_ADMIN, so
+// if that fails we fall back to SO_RCVBUF, which the kernel silently
+// caps at rmem_max.
+func (s *NetlinkSocket) SetRecvbufSize(bytes int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := setRecvbufSize(s.fd, bytes); err != nil {
+		return err
+	}
+
+	s.recvbufSize = bytes
+	return nil
+}
+
+func setRecvbufSize(fd int, bytes int) error {
+	// The kernel doubles the value it is given (to allow for
+	// bookkeeping overhead), and stores it in an int.
+	const maxRecvbufSize = (1<<31 - 1) / 2
+
+	if bytes <= 0 || bytes > maxRecvbufSize {
+		return fmt.Errorf("invalid socket receive buffer size %d", bytes)
+	}
+
+	err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, bytes)
+	if err == syscall.EPERM {
+		err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, bytes)
+	}
+
+	return err
+}
+
+// Get the socket receive buffer size, as reported by the kernel
+// (i.e. including the kernel's doubling of the requested size).
+func (s *NetlinkSocket) RecvbufSize() (int, error) {
+	return syscall.GetsockoptInt(s.fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+}
+
+// Set a timeout for receiving on the socket, after which receive
+// operations fail with an error satisfying IsRecvTimeoutError.  A
+// zero duration means no timeout.  SO_RCVTIMEO has microsecond
+// resolution, so shorter positive durations are rounded up to 1µs,
+// rather than truncated to zero and so to no timeout at all.
+func (s *NetlinkSocket) SetRecvTimeout(d time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if d > 0 && d < time.Microsecond {
+		d = time.Microsecond
+	}
+
+	if err := setRecvTimeout(s.fd, d); err != nil {
+		return err
+	}
+
+	s.recvTimeout = d
+	return nil
+}
+
+func setRecvTimeout(fd int, d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("negative receive timeout %s", d)
+	}
+
+	tv := syscall.NsecToTimeval(d.Nanoseconds())
+	return syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+}
+
+type recvTimeoutError struct{}
+
+func (recvTimeoutError) Error() string {
+	return "netlink receive timed out"
+}
+
+func IsRecvTimeoutError(err error) bool {
+	_, ok := err.(recvTimeoutError)
+	return ok
+}
+
+// Multicast group memberships are tracked on the NetlinkSocket, under
+// its lock.
+func (s *NetlinkSocket) JoinMulticastGroup(group uint32) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, joined := s.groups[group]; joined {
+		return nil
+	}
+
+	if err := syscall.SetsockoptInt(s.fd, SOL_NETLINK, syscall.NETLINK_ADD_MEMBERSHIP, int(group)); err != nil {
+		return err
+	}
+
+	s.groups[group] = struct{}{}
+	return nil
+}
+
+func (s *NetlinkSocket) LeaveMulticastGroup(group uint32) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := syscall.SetsockoptInt(s.fd, SOL_NETLINK, syscall.NETLINK_DROP_MEMBERSHIP, int(group)); err != nil {
+		return err
+	}
+
+	delete(s.groups, group)
+	return nil
+}
+
+// The multicast groups joined through JoinMulticastGroup, in
+// ascending order.
+func (s *NetlinkSocket) JoinedGroups() []uint32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	res := make([]uint32, 0, len(s.groups))
+	for group := range s.groups {
+		res = append(res, group)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
+// Fd returns the socket's file descriptor, e.g. for registering
+// with an external poller.  The descriptor remains owned by the
+// NetlinkSocket: the caller must not close it, and must not use it
+// after Close.
+func (s *NetlinkSocket) Fd() int {
+	return s.fd
+}
+
+// SetNonblock puts the socket into (or takes it out of) non-blocking
+// mode.  In non-blocking mode, receive operations (Recv, Receive
+// etc.) fail with syscall.EAGAIN when no message is available, rather
+// than with a receive timeout error, so that the caller can wait on
+// Fd in an external event loop.  Request and the other request
+// methods still wait for their responses, subject to the receive
+// timeout.  Changing modes while a receive operation is in progress
+// is the caller's responsibility.
+func (s *NetlinkSocket) SetNonblock(nonblocking bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := syscall.SetNonblock(s.fd, nonblocking); err != nil {
+		return err
+	}
+
+	s.nonblock = nonblocking
+	return nil
+}
+
+// Counters of netlink socket activity, for diagnosing lost messages.
+type SocketStats struct {
+	// Datagrams sent and received
+	Sent     uint64
+	Received uint64
+
+	// Receives that failed with ENOBUFS, each meaning that some
+	// messages were dropped (see SetNoENOBUFS)
+	Overruns uint64
+
+	// Responses discarded because their sequence number didn't
+	// match the request
+	SeqMismatches uint64
+
+	// Received datagrams holding a truncated netlink message
+	Truncated uint64
+}
+
+// Stats returns a snapshot of the socket's counters.  The counters
+// are maintained with atomic operations, so this may be called
+// concurrently with other uses of the socket.
+func (s *NetlinkSocket) Stats() SocketStats {
+	return SocketStats{
+		Sent:          atomic.LoadUint64(&s.stats.Sent),
+		Received:      atomic.LoadUint64(&s.stats.Received),
+		Overruns:      atomic.LoadUint64(&s.stats.Overruns),
+		SeqMismatches: atomic.LoadUint64(&s.stats.SeqMismatches),
+		Truncated:     atomic.LoadUint64(&s.stats.Truncated),
 	}
 }
 
@@ -63,6 +540,11 @@ func (s *NetlinkSocket) PortId() uint32 {
 }
 
 func (s *NetlinkSocket) Close() error {
+	if s.netns >= 0 {
+		syscall.Close(s.netns)
+		s.netns = -1
+	}
+
 	if s.fd < 0 {
 		return nil
 	}
@@ -74,10 +556,26 @@ func (s *NetlinkSocket) Close() error {
 
 type NlMsgBuilder struct {
 	buf []byte
+
+	// The buffer of the last finished message, for Reset to reuse
+	finished []byte
+
+	// Set by Release, so that releasing twice is harmless
+	released bool
 }
 
 func NewNlMsgBuilder(flags uint16, typ uint16) *NlMsgBuilder {
-	buf := MakeAlignedByteSlice(syscall.NLMSG_HDRLEN)
+	return NewNlMsgBuilderSize(flags, typ, syscall.NLMSG_HDRLEN)
+}
+
+// Like NewNlMsgBuilder, but preallocating hint bytes for the message,
+// to avoid reallocating the buffer as a large message is built.
+func NewNlMsgBuilderSize(flags uint16, typ uint16, hint int) *NlMsgBuilder {
+	if hint < syscall.NLMSG_HDRLEN {
+		hint = syscall.NLMSG_HDRLEN
+	}
+
+	buf := MakeAlignedByteSliceCap(syscall.NLMSG_HDRLEN, hint)
 	nlmsg := &NlMsgBuilder{buf: buf}
 	h := nlMsghdrAt(buf, 0)
 	h.Flags = flags
@@ -85,6 +583,83 @@ func NewNlMsgBuilder(flags uint16, typ uint16) *NlMsgBuilder {
 	return nlmsg
 }
 
+// Start a new message, reusing the buffer of the message previously
+// built (even if it was finished).  So the data returned by Finish
+// must not be used after Reset.
+func (nlmsg *NlMsgBuilder) Reset(flags uint16, typ uint16) {
+	buf := nlmsg.buf
+	if buf == nil {
+		buf = nlmsg.finished
+	}
+	nlmsg.finished = nil
+
+	if buf == nil {
+		buf = MakeAlignedByteSlice(syscall.NLMSG_HDRLEN)
+	}
+
+	// Builder methods rely on grown space being zeroed
+	for i := range buf {
+		buf[i] = 0
+	}
+
+	nlmsg.buf = buf[:syscall.NLMSG_HDRLEN]
+	h := nlMsghdrAt(nlmsg.buf, 0)
+	h.Flags = flags
+	h.Type = typ
+}
+
+var builderPool = sync.Pool{
+	New: func() interface{} {
+		return NewNlMsgBuilder(0, 0)
+	},
+}
+
+// Don't hold on to unusually large buffers in the pool
+const maxPooledBuilderSize = 64 * 1024
+
+// Like NewNlMsgBuilder, but taking the builder from a pool, so that
+// its buffer may be recycled.  Call Release when done with it.
+func GetBuilder(flags uint16, typ uint16) *NlMsgBuilder {
+	nlmsg := builderPool.Get().(*NlMsgBuilder)
+	nlmsg.Reset(flags, typ)
+	nlmsg.released = false
+	return nlmsg
+}
+
+// Return a builder to the pool used by GetBuilder.  Neither the
+// builder, nor the data returned by its Finish, may be used after
+// this.  The buffer is zeroed, so stale message contents don't leak
+// into later messages.  Releasing a builder again does nothing, so
+// it can't end up in the pool twice.
+func (nlmsg *NlMsgBuilder) Release() {
+	if nlmsg.released {
+		return
+	}
+
+	buf := nlmsg.buf
+	if buf == nil {
+		buf = nlmsg.finished
+	}
+
+	nlmsg.released = true
+	if cap(buf) > maxPooledBuilderSize {
+		return
+	}
+
+	nlmsg.Reset(0, 0)
+	builderPool.Put(nlmsg)
+}
+
+// Replace the flags in the message header.
+func (nlmsg *NlMsgBuilder) SetFlags(flags uint16) {
+	nlMsghdrAt(nlmsg.buf, 0).Flags = flags
+}
+
+// Add to the flags in the message header.
+func (nlmsg *NlMsgBuilder) AddFlags(flags uint16) {
+	nlMsghdrAt(nlmsg.buf, 0).Flags |= flags
+}
+
 // Expand the array underlying a slice to have capacity of at least l
 func expand(buf []byte, l int) []byte {
 	c := (cap(buf) + 1) * 3 / 2
@@ -124,20 +699,56 @@ func (nlmsg *NlMsgBuilder) AlignGrow(a int, size uintptr) int {
 	return apos
 }
 
+// Grow by size bytes at NLMSG_ALIGNTO alignment, for the headers that
+// follow the nlmsghdr (genlmsghdr, ifinfomsg etc.)
+func (nlmsg *NlMsgBuilder) nlmsgAlignGrow(size uintptr) int {
+	return nlmsg.AlignGrow(syscall.NLMSG_ALIGNTO, size)
+}
+
+// Grow by size bytes at NLA_ALIGNTO alignment
+func (nlmsg *NlMsgBuilder) nlaAlignGrow(size uintptr) int {
+	return nlmsg.AlignGrow(syscall.NLA_ALIGNTO, size)
+}
+
 var nextSeqNo uint32
 
+// Allocate a sequence number from the sequence used by Finish.
+//
+// The sequence is shared by all sockets and wraps around after 2^32
+// allocations, skipping 0, which the kernel uses in messages that
+// are not responses to requests (e.g. multicast notifications).  A
+// wrapped sequence number cannot collide with one that is still in
+// flight: Each socket has at most one request, or one batch chunk
+// of batchChunkSize requests, outstanding at a time, so only a
+// response that went unread across 2^32 allocations could be
+// mistaken for a reply to a later request.
+func NextSeqNo() uint32 {
+	for {
+		if seq := atomic.AddUint32(&nextSeqNo, 1); seq != 0 {
+			return seq
+		}
+	}
+}
+
 func (nlmsg *NlMsgBuilder) Finish() (res []byte, seq uint32) {
+	seq = NextSeqNo()
+	return nlmsg.FinishWithSeq(seq), seq
+}
+
+// Like Finish, but with a sequence number chosen by the caller, for
+// callers that match up responses with requests themselves.
+func (nlmsg *NlMsgBuilder) FinishWithSeq(seq uint32) []byte {
 	h := nlMsghdrAt(nlmsg.buf, 0)
 	h.Len = uint32(len(nlmsg.buf))
-	seq = atomic.AddUint32(&nextSeqNo, 1)
 	h.Seq = seq
-	res = nlmsg.buf
+	res := nlmsg.buf
 	nlmsg.buf = nil
-	return
+	nlmsg.finished = res
+	return res
 }
 
 func (nlmsg *NlMsgBuilder) PutAttr(typ uint16, gen func()) {
-	pos := nlmsg.AlignGrow(syscall.NLA_ALIGNTO, syscall.SizeofNlAttr)
+	pos := nlmsg.nlaAlignGrow(syscall.SizeofNlAttr)
 	gen()
 	nla := nlAttrAt(nlmsg.buf, pos)
 	nla.Type = typ
@@ -160,6 +771,13 @@ func (nlmsg *NlMsgBuilder) PutEmptyAttr(typ uint16) {
 	nlmsg.PutAttr(typ, func() {})
 }
 
+// Put a flag attribute (NLA_FLAG), such as OVS_FLOW_ATTR_PROBE: just
+// the attribute header, as presence is the value.  The same as
+// PutEmptyAttr, under the name used for rtnetlink attributes.
+func (nlmsg *NlMsgBuilder) PutFlagRtAttr(typ uint16) {
+	nlmsg.PutEmptyAttr(typ)
+}
+
 func (nlmsg *NlMsgBuilder) PutUint8Attr(typ uint16, val uint8) {
 	nlmsg.PutAttr(typ, func() {
 		pos := nlmsg.Grow(1)
@@ -181,6 +799,13 @@ func (nlmsg *NlMsgBuilder) PutUint32Attr(typ uint16, val uint32) {
 	})
 }
 
+func (nlmsg *NlMsgBuilder) PutUint64Attr(typ uint16, val uint64) {
+	nlmsg.PutAttr(typ, func() {
+		pos := nlmsg.Grow(8)
+		*uint64At(nlmsg.buf, pos) = val
+	})
+}
+
 func (nlmsg *NlMsgBuilder) putStringZ(str string) {
 	l := len(str)
 	pos := nlmsg.Grow(uintptr(l) + 1)
@@ -199,17 +824,119 @@ func (nlmsg *NlMsgBuilder) PutSliceAttr(typ uint16, data []byte) {
 	})
 }
 
+func (nlmsg *NlMsgBuilder) PutMACAttr(typ uint16, mac net.HardwareAddr) error {
+	if len(mac) != ETH_ALEN {
+		return fmt.Errorf("MAC address %s for attribute %d has wrong length (%d bytes)", mac, typ, len(mac))
+	}
+
+	nlmsg.PutSliceAttr(typ, mac)
+	return nil
+}
+
+// IP addresses go in attributes in network byte order, just as they
+// are held in a net.IP.
+func (nlmsg *NlMsgBuilder) PutIPv4Attr(typ uint16, ip net.IP) error {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return fmt.Errorf("%s for attribute %d is not an IPv4 address", ip, typ)
+	}
+
+	nlmsg.PutSliceAttr(typ, ip4)
+	return nil
+}
+
+// An IPv4 address (including an IPv4-mapped IPv6 address) is
+// rejected, rather than silently put as ::ffff:a.b.c.d.
+func (nlmsg *NlMsgBuilder) PutIPv6Attr(typ uint16, ip net.IP) error {
+	ip6 := ip.To16()
+	if ip6 == nil || ip.To4() != nil {
+		return fmt.Errorf("%s for attribute %d is not an IPv6 address", ip, typ)
+	}
+
+	nlmsg.PutSliceAttr(typ, ip6)
+	return nil
+}
+
 type NetlinkError syscall.Errno
 
 func (err NetlinkError) Error() string {
 	return fmt.Sprintf("netlink error response: %s", syscall.Errno(err))
 }
 
+// So that errors.Is(err, syscall.ENOENT) etc. work
+func (err NetlinkError) Unwrap() error {
+	return syscall.Errno(err)
+}
+
+// Modern kernels can attach extended ack attributes to an error
+// response, explaining what was wrong with the request.
+type NetlinkExtAckError struct {
+	NetlinkError
+	Msg string
+
+	// Offset of the offending attribute within the request
+	// message, if HaveOffset is set.
+	Offset     uint32
+	HaveOffset bool
+}
+
+func (err NetlinkExtAckError) Error() string {
+	if err.HaveOffset {
+		return fmt.Sprintf("%s: %s (at offset %d)", err.NetlinkError, err.Msg, err.Offset)
+	}
+
+	return fmt.Sprintf("%s: %s", err.NetlinkError, err.Msg)
+}
+
+func (err NetlinkExtAckError) Unwrap() error {
+	return err.NetlinkError
+}
+
+// Test whether err is the NetlinkError for errno, with or without
+// extended ack information.
+func isNetlinkError(err error, errno syscall.Errno) bool {
+	var nlerr NetlinkError
+	return errors.As(err, &nlerr) && nlerr == NetlinkError(errno)
+}
+
 type NlMsgParser struct {
 	data []byte
 	pos  int
 }
 
+// NewNlMsgParser returns a parser positioned at the start of data,
+// e.g. a message obtained from Recv.
+func NewNlMsgParser(data []byte) *NlMsgParser {
+	return &NlMsgParser{data: data, pos: 0}
+}
+
+// TruncationError reports that What, starting at offset At in the
+// data being parsed, needed Need bytes but only Have were available.
+type TruncationError struct {
+	What string
+	At   int
+	Need int
+	Have int
+}
+
+func (err TruncationError) Error() string {
+	return fmt.Sprintf("%s truncated (%d bytes available, %d expected)", err.What, err.Have, err.Need)
+}
+
+func IsTruncationError(err error) bool {
+	var terr TruncationError
+	return errors.As(err, &terr)
+}
+
+func (nlmsg *NlMsgParser) truncationError(what string, pos int, need int) error {
+	return TruncationError{
+		What: what,
+		At:   pos,
+		Need: need,
+		Have: len(nlmsg.data) - pos,
+	}
+}
+
 func (nlmsg *NlMsgParser) Advance(size uintptr) error {
 	if err := nlmsg.CheckAvailable(size); err != nil {
 		return err
@@ -229,6 +956,11 @@ func (nlmsg *NlMsgParser) AlignAdvance(a int, size uintptr) (int, error) {
 	return pos, nil
 }
 
+// The parsing counterpart of NlMsgBuilder.nlmsgAlignGrow
+func (nlmsg *NlMsgParser) nlmsgAlignAdvance(size uintptr) (int, error) {
+	return nlmsg.AlignAdvance(syscall.NLMSG_ALIGNTO, size)
+}
+
 func (nlmsg *NlMsgParser) NlMsghdr() *syscall.NlMsghdr {
 	return nlMsghdrAt(nlmsg.data, nlmsg.pos)
 }
@@ -241,22 +973,26 @@ func (msg *NlMsgParser) nextNlMsg() (*NlMsgParser, error) {
 	}
 
 	if avail < syscall.SizeofNlMsghdr {
-		return nil, fmt.Errorf("netlink message header truncated")
+		return nil, msg.truncationError("netlink message header", pos, syscall.SizeofNlMsghdr)
 	}
 
 	h := msg.NlMsghdr()
+	if h.Len < syscall.NLMSG_HDRLEN {
+		return nil, fmt.Errorf("netlink message length too short (%d bytes)", h.Len)
+	}
+
 	if avail < int(h.Len) {
-		return nil, fmt.Errorf("netlink message truncated (%d bytes available, %d expected)", avail, h.Len)
+		return nil, msg.truncationError("netlink message", pos, int(h.Len))
 	}
 
 	end := pos + int(h.Len)
-	msg.pos = align(end, syscall.NLMSG_ALIGNTO)
+	msg.pos = nlmsgAlign(end)
 	return &NlMsgParser{data: msg.data[:end], pos: pos}, nil
 }
 
 func (nlmsg *NlMsgParser) CheckAvailable(size uintptr) error {
 	if nlmsg.pos+int(size) > len(nlmsg.data) {
-		return fmt.Errorf("netlink message truncated")
+		return nlmsg.truncationError("netlink message", nlmsg.pos, int(size))
 	}
 
 	return nil
@@ -267,9 +1003,19 @@ func (nlmsg *NlMsgParser) checkHeader() error {
 	// present
 	h := nlmsg.NlMsghdr()
 	if h.Type == syscall.NLMSG_ERROR {
-		nlerr := nlMsgerrAt(nlmsg.data, nlmsg.pos+syscall.NLMSG_HDRLEN)
+		errpos := nlmsg.pos + syscall.NLMSG_HDRLEN
+		if errpos+syscall.SizeofNlMsgerr > len(nlmsg.data) {
+			return nlmsg.truncationError("netlink error response", errpos, syscall.SizeofNlMsgerr)
+		}
+
+		nlerr := nlMsgerrAt(nlmsg.data, errpos)
 		if nlerr.Error != 0 {
-			return NetlinkError(-nlerr.Error)
+			err := NetlinkError(-nlerr.Error)
+			if h.Flags&NLM_F_ACK_TLVS == 0 {
+				return err
+			}
+
+			return nlmsg.extAckError(err, nlerr)
 		}
 
 		// an error code of 0 means the error is an ack, so
@@ -279,6 +1025,48 @@ func (nlmsg *NlMsgParser) checkHeader() error {
 	return nil
 }
 
+// The extended ack attributes follow the nlmsgerr, which is followed
+// by the payload of the original request unless the kernel capped it.
+func (nlmsg *NlMsgParser) extAckError(nlerr NetlinkError, msgerr *syscall.NlMsgerr) error {
+	h := nlmsg.NlMsghdr()
+	pos := nlmsg.pos + syscall.NLMSG_HDRLEN + syscall.SizeofNlMsgerr
+	if h.Flags&NLM_F_CAPPED == 0 {
+		if msgerr.Msg.Len < syscall.NLMSG_HDRLEN {
+			return nlerr
+		}
+
+		pos += int(msgerr.Msg.Len) - syscall.NLMSG_HDRLEN
+	}
+
+	pos = nlaAlign(pos)
+	end := nlmsg.pos + int(h.Len)
+	if end > len(nlmsg.data) || pos > end {
+		return nlerr
+	}
+
+	attrs, err := ParseNestedAttrs(nlmsg.data[pos:end])
+	if err != nil {
+		return nlerr
+	}
+
+	res := NetlinkExtAckError{NetlinkError: nlerr}
+	if _, ok := attrs[NLMSGERR_ATTR_MSG]; ok {
+		if res.Msg, err = attrs.GetString(NLMSGERR_ATTR_MSG); err != nil {
+			return nlerr
+		}
+	}
+
+	if res.Offset, res.HaveOffset, err = attrs.GetOptionalUint32(NLMSGERR_ATTR_OFFS); err != nil {
+		return nlerr
+	}
+
+	if res.Msg == "" && !res.HaveOffset {
+		return nlerr
+	}
+
+	return res
+}
+
 func (nlmsg *NlMsgParser) checkResponseHeader(expectedPortId uint32, expectedSeq uint32) (relevant bool, err error) {
 	// nextNlMsg ensures that there is an nlmsghdr-worth of data
 	// present
@@ -302,13 +1090,24 @@ func (nlmsg *NlMsgParser) checkResponseHeader(expectedPortId uint32, expectedSeq
 	return true, nlmsg.checkHeader()
 }
 
-func (nlmsg *NlMsgParser) ExpectNlMsghdr(typ uint16) (*syscall.NlMsghdr, error) {
-	h := nlmsg.NlMsghdr()
+// Like NlMsgParser.checkResponseHeader, but counting sequence number
+// mismatches
+func (s *NetlinkSocket) checkResponseHeader(msg *NlMsgParser, seq uint32) (bool, error) {
+	relevant, err := msg.checkResponseHeader(s.PortId(), seq)
+	if !relevant {
+		atomic.AddUint64(&s.stats.SeqMismatches, 1)
+	}
+	return relevant, err
+}
 
-	if err := nlmsg.Advance(syscall.SizeofNlMsghdr); err != nil {
+func (nlmsg *NlMsgParser) ExpectNlMsghdr(typ uint16) (*syscall.NlMsghdr, error) {
+	if err := nlmsg.CheckAvailable(syscall.SizeofNlMsghdr); err != nil {
 		return nil, err
 	}
 
+	h := nlmsg.NlMsghdr()
+	nlmsg.pos += syscall.SizeofNlMsghdr
+
 	if h.Type != typ {
 		return nil, fmt.Errorf("netlink response has wrong type (got %d, expected %d)", h.Type, typ)
 	}
@@ -318,6 +1117,38 @@ func (nlmsg *NlMsgParser) ExpectNlMsghdr(typ uint16) (*syscall.NlMsghdr, error)
 
 type Attrs map[uint16][]byte
 
+// Parsing ignores attribute types that the caller doesn't look for,
+// for forward compatibility with newer kernels.  UnknownTypes and
+// CheckKnown allow stricter checking, to detect kernels sending
+// attributes that the caller doesn't handle.
+func (attrs Attrs) UnknownTypes(known ...uint16) []uint16 {
+	var res []uint16
+	for typ := range attrs {
+		found := false
+		for _, k := range known {
+			if typ == k {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			res = append(res, typ)
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
+func (attrs Attrs) CheckKnown(known ...uint16) error {
+	if unknown := attrs.UnknownTypes(known...); len(unknown) != 0 {
+		return fmt.Errorf("unexpected netlink attribute types %v", unknown)
+	}
+
+	return nil
+}
+
 func (attrs Attrs) Get(typ uint16, optional bool) ([]byte, error) {
 	val, ok := attrs[typ]
 	if !ok && !optional {
@@ -350,6 +1181,14 @@ func (attrs Attrs) GetOptionalBytes(typ uint16, dest []byte) (bool, error) {
 	return true, nil
 }
 
+// Whether a flag attribute is present, whatever the length of its
+// value.  Unlike GetEmpty, this doesn't insist that the value is
+// empty, so it can't fail.
+func (attrs Attrs) HasFlag(typ uint16) bool {
+	_, present := attrs[typ]
+	return present
+}
+
 func (attrs Attrs) GetEmpty(typ uint16) (bool, error) {
 	val, err := attrs.Get(typ, true)
 	if err != nil || val == nil {
@@ -363,27 +1202,35 @@ func (attrs Attrs) GetEmpty(typ uint16) (bool, error) {
 	return true, nil
 }
 
-func (attrs Attrs) GetOptionalUint8(typ uint16) (uint8, bool, error) {
-	val, err := attrs.Get(typ, true)
+// Get a scalar attribute value, checking that it has the right size
+// before the caller reads it.  Returns nil if an optional attribute
+// is absent.
+func (attrs Attrs) getScalar(typ uint16, size int, optional bool) ([]byte, error) {
+	val, err := attrs.Get(typ, optional)
 	if err != nil || val == nil {
-		return 0, false, err
+		return nil, err
 	}
 
-	if len(val) != 1 {
-		return 0, false, fmt.Errorf("uint8 attribute %d has wrong length (%d bytes)", typ, len(val))
+	if len(val) != size {
+		return nil, fmt.Errorf("uint%d attribute %d has wrong length (%d bytes)", size*8, typ, len(val))
 	}
 
-	return val[0], true, nil
+	return val, nil
 }
 
-func (attrs Attrs) getUint16(typ uint16, optional bool) (uint16, bool, error) {
-	val, err := attrs.Get(typ, optional)
+func (attrs Attrs) GetOptionalUint8(typ uint16) (uint8, bool, error) {
+	val, err := attrs.getScalar(typ, 1, true)
 	if err != nil || val == nil {
 		return 0, false, err
 	}
 
-	if len(val) != 2 {
-		return 0, false, fmt.Errorf("uint16 attribute %d has wrong length (%d bytes)", typ, len(val))
+	return val[0], true, nil
+}
+
+func (attrs Attrs) getUint16(typ uint16, optional bool) (uint16, bool, error) {
+	val, err := attrs.getScalar(typ, 2, optional)
+	if err != nil || val == nil {
+		return 0, false, err
 	}
 
 	return *uint16At(val, 0), true, nil
@@ -398,29 +1245,30 @@ func (attrs Attrs) GetOptionalUint16(typ uint16) (uint16, bool, error) {
 	return attrs.getUint16(typ, true)
 }
 
-func (attrs Attrs) GetUint32(typ uint16) (uint32, error) {
-	val, err := attrs.Get(typ, false)
-	if err != nil {
-		return 0, err
+func (attrs Attrs) getUint32(typ uint16, optional bool) (uint32, bool, error) {
+	val, err := attrs.getScalar(typ, 4, optional)
+	if err != nil || val == nil {
+		return 0, false, err
 	}
 
-	if len(val) != 4 {
-		return 0, fmt.Errorf("uint32 attribute %d has wrong length (%d bytes)", typ, len(val))
-	}
+	return *uint32At(val, 0), true, nil
+}
+
+func (attrs Attrs) GetUint32(typ uint16) (uint32, error) {
+	res, _, err := attrs.getUint32(typ, false)
+	return res, err
+}
 
-	return *uint32At(val, 0), nil
+func (attrs Attrs) GetOptionalUint32(typ uint16) (uint32, bool, error) {
+	return attrs.getUint32(typ, true)
 }
 
 func (attrs Attrs) getUint64(typ uint16, optional bool) (uint64, bool, error) {
-	val, err := attrs.Get(typ, optional)
+	val, err := attrs.getScalar(typ, 8, optional)
 	if err != nil || val == nil {
 		return 0, false, err
 	}
 
-	if len(val) != 8 {
-		return 0, false, fmt.Errorf("uint64 attribute %d has wrong length (%d bytes)", typ, len(val))
-	}
-
 	return *uint64At(val, 0), true, nil
 }
 
@@ -433,6 +1281,69 @@ func (attrs Attrs) GetOptionalUint64(typ uint16) (uint64, bool, error) {
 	return attrs.getUint64(typ, true)
 }
 
+// Most netlink attributes are in host byte order, but some OVS
+// attributes are in network byte order: Tunnel ids and ports
+// (OVS_TUNNEL_KEY_ATTR_ID, _TP_SRC, _TP_DST), the ethertype and VLAN
+// TCI flow keys, and the fields of the packet header flow key
+// structs.  The *BE getters are for those.
+
+func (attrs Attrs) GetUint16BE(typ uint16) (uint16, error) {
+	res, err := attrs.GetUint16(typ)
+	return uint16FromBE(res), err
+}
+
+func (attrs Attrs) GetOptionalUint16BE(typ uint16) (uint16, bool, error) {
+	res, present, err := attrs.getUint16(typ, true)
+	return uint16FromBE(res), present, err
+}
+
+func (attrs Attrs) GetUint32BE(typ uint16) (uint32, error) {
+	res, err := attrs.GetUint32(typ)
+	return uint32FromBE(res), err
+}
+
+func (attrs Attrs) GetOptionalUint32BE(typ uint16) (uint32, bool, error) {
+	res, present, err := attrs.getUint32(typ, true)
+	return uint32FromBE(res), present, err
+}
+
+func (attrs Attrs) GetUint64BE(typ uint16) (uint64, error) {
+	res, err := attrs.GetUint64(typ)
+	return uint64FromBE(res), err
+}
+
+func (attrs Attrs) GetOptionalUint64BE(typ uint16) (uint64, bool, error) {
+	res, present, err := attrs.getUint64(typ, true)
+	return uint64FromBE(res), present, err
+}
+
+func (attrs Attrs) GetMAC(typ uint16) (net.HardwareAddr, error) {
+	val, err := attrs.GetFixedBytes(typ, ETH_ALEN, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(net.HardwareAddr(nil), val...), nil
+}
+
+func (attrs Attrs) GetIPv4(typ uint16) (net.IP, error) {
+	val, err := attrs.GetFixedBytes(typ, net.IPv4len, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return net.IPv4(val[0], val[1], val[2], val[3]), nil
+}
+
+func (attrs Attrs) GetIPv6(typ uint16) (net.IP, error) {
+	val, err := attrs.GetFixedBytes(typ, net.IPv6len, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(net.IP(nil), val...), nil
+}
+
 func (attrs Attrs) GetString(typ uint16) (string, error) {
 	val, err := attrs.Get(typ, false)
 	if err != nil {
@@ -454,13 +1365,16 @@ func (nlmsg *NlMsgParser) checkData(l uintptr, obj string) error {
 	if nlmsg.pos+int(l) <= len(nlmsg.data) {
 		return nil
 	} else {
-		return fmt.Errorf("truncated %s (have %d bytes, expected %d)", obj, len(nlmsg.data)-nlmsg.pos, l)
+		return nlmsg.truncationError(obj, nlmsg.pos, int(l))
 	}
 }
 
-func (nlmsg *NlMsgParser) parseAttrs(consumer func(uint16, []byte)) error {
+// Call f for each of the remaining attributes in the message, without
+// building an Attrs map.  The values refer to the message data.
+// Stops at the first error returned by f, and returns it.
+func (nlmsg *NlMsgParser) ForEachAttr(f func(typ uint16, val []byte) error) error {
 	for {
-		apos := align(nlmsg.pos, syscall.NLA_ALIGNTO)
+		apos := nlaAlign(nlmsg.pos)
 		if len(nlmsg.data) <= apos {
 			break
 		}
@@ -472,12 +1386,19 @@ func (nlmsg *NlMsgParser) parseAttrs(consumer func(uint16, []byte)) error {
 		}
 
 		nla := nlAttrAt(nlmsg.data, nlmsg.pos)
+		if nla.Len < syscall.SizeofNlAttr {
+			return fmt.Errorf("netlink attribute length too short (%d bytes)", nla.Len)
+		}
+
 		if err := nlmsg.checkData(uintptr(nla.Len), "netlink attribute"); err != nil {
 			return err
 		}
 
-		valpos := align(nlmsg.pos+syscall.SizeofNlAttr, syscall.NLA_ALIGNTO)
-		consumer(nla.Type, nlmsg.data[valpos:nlmsg.pos+int(nla.Len)])
+		valpos := nlaAlign(nlmsg.pos + syscall.SizeofNlAttr)
+		if err := f(nla.Type, nlmsg.data[valpos:nlmsg.pos+int(nla.Len)]); err != nil {
+			return err
+		}
+
 		nlmsg.pos += int(nla.Len)
 	}
 
@@ -486,8 +1407,9 @@ func (nlmsg *NlMsgParser) parseAttrs(consumer func(uint16, []byte)) error {
 
 func (nlmsg *NlMsgParser) TakeAttrs() (Attrs, error) {
 	res := make(Attrs)
-	err := nlmsg.parseAttrs(func(typ uint16, val []byte) {
+	err := nlmsg.ForEachAttr(func(typ uint16, val []byte) error {
 		res[typ] = val
+		return nil
 	})
 	return res, err
 }
@@ -510,8 +1432,24 @@ func (attrs Attrs) GetNestedAttrs(typ uint16, optional bool) (Attrs, error) {
 // attribute order matters.
 
 type Attr struct {
-	typ uint16
-	val []byte
+	Type  uint16
+	Value []byte
+}
+
+// Like TakeAttrs, but preserving the order of attributes, and any
+// repeated attributes.
+func (nlmsg *NlMsgParser) TakeOrderedAttrs() ([]Attr, error) {
+	res := make([]Attr, 0)
+	err := nlmsg.ForEachAttr(func(typ uint16, val []byte) error {
+		res = append(res, Attr{typ, val})
+		return nil
+	})
+	return res, err
+}
+
+func ParseOrderedAttrs(data []byte) ([]Attr, error) {
+	parser := NlMsgParser{data: data, pos: 0}
+	return parser.TakeOrderedAttrs()
 }
 
 func (attrs Attrs) GetOrderedAttrs(typ uint16) ([]Attr, error) {
@@ -520,13 +1458,7 @@ func (attrs Attrs) GetOrderedAttrs(typ uint16) ([]Attr, error) {
 		return nil, err
 	}
 
-	parser := NlMsgParser{data: val, pos: 0}
-	res := make([]Attr, 0)
-	err = parser.parseAttrs(func(typ uint16, val []byte) {
-		res = append(res, Attr{typ, val})
-	})
-
-	return res, err
+	return ParseOrderedAttrs(val)
 }
 
 func (s *NetlinkSocket) send(msg *NlMsgBuilder) (uint32, error) {
@@ -537,37 +1469,197 @@ func (s *NetlinkSocket) send(msg *NlMsgBuilder) (uint32, error) {
 	}
 
 	data, seq := msg.Finish()
-	return seq, syscall.Sendto(s.fd, data, 0, &sa)
+	return seq, s.sendto(data, &sa)
+}
+
+func (s *NetlinkSocket) sendto(data []byte, sa *syscall.SockaddrNetlink) error {
+	if err := syscall.Sendto(s.fd, data, 0, sa); err != nil {
+		return err
+	}
+
+	atomic.AddUint64(&s.stats.Sent, 1)
+	return nil
+}
+
+// Send and Recv are an escape hatch for netlink protocols that this
+// package doesn't model.  Send sends data, which should hold one or
+// more complete netlink messages (e.g. from NlMsgBuilder.Finish), to
+// the kernel.  Unlike the Request methods, it doesn't take the
+// socket's lock, so the caller must not use Send and Recv
+// concurrently with other requests on the same socket.
+func (s *NetlinkSocket) Send(data []byte) error {
+	sa := syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	return s.sendto(data, &sa)
+}
+
+// Recv receives a single datagram, which may hold several netlink
+// messages, checking that it came from peer (0 for the kernel).
+func (s *NetlinkSocket) Recv(peer uint32) ([]byte, error) {
+	msg, err := s.recv(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg.data, nil
+}
+
+// Like Recv, but receiving into buf if the datagram fits, to avoid
+// allocating a buffer for every call.  The result is a prefix of buf
+// in that case, otherwise a newly allocated buffer large enough for
+// the datagram, which the caller may keep for later calls.  Either
+// way, the result (and anything parsed from it, such as attribute
+// values) is only valid until the buffer is next reused.  buf should
+// come from MakeAlignedByteSlice.
+func (s *NetlinkSocket) RecvInto(buf []byte, peer uint32) ([]byte, error) {
+	msg, from, err := s.recvWithSourceInto(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkPeer(from, peer); err != nil {
+		return nil, err
+	}
+
+	return msg.data, nil
 }
 
 func (s *NetlinkSocket) recv(peer uint32) (*NlMsgParser, error) {
-	buf := MakeAlignedByteSlice(syscall.Getpagesize())
-	nr, from, err := syscall.Recvfrom(s.fd, buf, 0)
+	msg, from, err := s.recvWithSource()
 	if err != nil {
 		return nil, err
 	}
 
-	switch nlfrom := from.(type) {
-	case *syscall.SockaddrNetlink:
-		if nlfrom.Pid != peer {
-			return nil, fmt.Errorf("wrong netlink peer pid (expected %d, got %d)", peer, nlfrom.Pid)
+	if err := checkPeer(from, peer); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func checkPeer(from *syscall.SockaddrNetlink, peer uint32) error {
+	if from.Pid != peer {
+		return fmt.Errorf("wrong netlink peer pid (expected %d, got %d)", peer, from.Pid)
+	}
+
+	return nil
+}
+
+// Receive a message, along with its source address.  A non-zero
+// Groups in the source address means that the message was multicast
+// (to those groups).
+func (s *NetlinkSocket) recvWithSource() (*NlMsgParser, *syscall.SockaddrNetlink, error) {
+	return s.recvWithSourceInto(MakeAlignedByteSlice(syscall.Getpagesize()))
+}
+
+func (s *NetlinkSocket) recvWithSourceInto(buf []byte) (*NlMsgParser, *syscall.SockaddrNetlink, error) {
+	// Peek at the message with MSG_TRUNC, so that we learn its
+	// real length even if it doesn't fit in the buffer (e.g. a
+	// flow dump or a miss upcall carrying a big packet).  Then
+	// allocate a buffer large enough to receive it whole.
+	nr, _, err := syscall.Recvfrom(s.fd, buf, syscall.MSG_PEEK|syscall.MSG_TRUNC)
+	if err != nil {
+		if err == syscall.EAGAIN && !s.nonblock {
+			err = recvTimeoutError{}
+		} else if err == syscall.ENOBUFS {
+			atomic.AddUint64(&s.stats.Overruns, 1)
 		}
+		return nil, nil, err
+	}
+
+	if nr > len(buf) {
+		buf = MakeAlignedByteSlice(nr)
+	}
+
+	nr, from, err := syscall.Recvfrom(s.fd, buf, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	atomic.AddUint64(&s.stats.Received, 1)
 
-		return &NlMsgParser{data: buf[:nr], pos: 0}, nil
+	switch nlfrom := from.(type) {
+	case *syscall.SockaddrNetlink:
+		return &NlMsgParser{data: buf[:nr], pos: 0}, nlfrom, nil
 
 	default:
-		return nil, fmt.Errorf("Expected netlink sockaddr, got %s", reflect.TypeOf(from))
+		return nil, nil, fmt.Errorf("Expected netlink sockaddr, got %s", reflect.TypeOf(from))
+	}
+}
+
+// Like NlMsgParser.nextNlMsg, but counting truncated messages
+func (s *NetlinkSocket) nextNlMsg(resp *NlMsgParser) (*NlMsgParser, error) {
+	msg, err := resp.nextNlMsg()
+	if IsTruncationError(err) {
+		atomic.AddUint64(&s.stats.Truncated, 1)
 	}
+	return msg, err
 }
 
 func (s *NetlinkSocket) Receive(consumer func(*NlMsgParser) (bool, error)) error {
+	return s.receive(context.Background(), false, nil, consumer)
+}
+
+// Like Receive, but giving up with ctx.Err() if ctx is done while
+// waiting for a message.  If replies is set, multicast messages are
+// skipped, so that a socket can be used for requests while it is
+// subscribed to multicast groups.  If buf is non-nil, datagrams are
+// received into it (see RecvInto) rather than into a new buffer
+// each, so messages are only valid until consumer returns.
+func (s *NetlinkSocket) receive(ctx context.Context, replies bool, buf []byte, consumer func(*NlMsgParser) (bool, error)) error {
+	var waiter *contextWaiter
+	if ctx.Done() != nil {
+		w, err := newContextWaiter(ctx, s.fd)
+		if err != nil {
+			return err
+		}
+
+		defer w.close()
+		waiter = w
+	}
+
 	for {
-		resp, err := s.recv(0)
+		if waiter != nil {
+			// recv blocks, so wait for the socket to
+			// become readable first.
+			if err := waiter.wait(); err != nil {
+				return err
+			}
+		}
+
+		recvBuf := buf
+		if recvBuf == nil {
+			recvBuf = MakeAlignedByteSlice(syscall.Getpagesize())
+		}
+
+		resp, from, err := s.recvWithSourceInto(recvBuf)
+		if err == syscall.EAGAIN && replies {
+			// Requests wait for their responses even on a
+			// non-blocking socket
+			if waiter == nil {
+				if err := s.waitReadable(); err != nil {
+					return err
+				}
+			}
+			continue
+		}
 		if err != nil {
 			return err
 		}
 
-		msg, err := resp.nextNlMsg()
+		if buf != nil {
+			// Keep any larger buffer for the next datagram
+			buf = resp.data[:cap(resp.data)]
+		}
+
+		if replies && from.Groups != 0 {
+			continue
+		}
+
+		if err := checkPeer(from, 0); err != nil {
+			return err
+		}
+
+		msg, err := s.nextNlMsg(resp)
 		if err != nil {
 			return err
 		}
@@ -581,7 +1673,7 @@ func (s *NetlinkSocket) Receive(consumer func(*NlMsgParser) (bool, error)) error
 				return err
 			}
 
-			msg, err = resp.nextNlMsg()
+			msg, err = s.nextNlMsg(resp)
 			if err != nil {
 				return err
 			}
@@ -592,39 +1684,215 @@ func (s *NetlinkSocket) Receive(consumer func(*NlMsgParser) (bool, error)) error
 	}
 }
 
+// Wait for the socket to become readable, for at most the receive
+// timeout, as a blocking recv would.  Called with the lock held.
+func (s *NetlinkSocket) waitReadable() error {
+	var timeout *syscall.Timespec
+	if s.recvTimeout != 0 {
+		ts := syscall.NsecToTimespec(s.recvTimeout.Nanoseconds())
+		timeout = &ts
+	}
+
+	fds := []pollFd{{fd: int32(s.fd), events: POLLIN}}
+	for {
+		n, err := ppoll(fds, timeout)
+		switch {
+		case err == syscall.EINTR:
+			continue
+		case err != nil:
+			return err
+		case n == 0:
+			return recvTimeoutError{}
+		default:
+			return nil
+		}
+	}
+}
+
 // Some generic netlink operations always return a reply message (e.g
 // *_GET), others don't by default (e.g. *_NEW).  In the latter case,
 // NLM_F_ECHO forces a reply.  This is undocumented AFAICT.
+//
+// For operations that also multicast a notification (e.g. creating
+// a flow or vport), the echoed reply is that notification, unicast
+// to the requesting socket, and the multicast excludes the
+// requesting socket.  So a socket that is both making requests and
+// subscribed to the group sees its own changes only as replies,
+// which Request matches up by sequence number, while receive skips
+// the multicast notifications.  Other sockets subscribed to the
+// group do see the notification, with the nlmsghdr carrying the
+// port id and sequence number of the request that caused it; see
+// ConsumeVportEventsIgnoring and ConsumeFlowEvents.  CreateFlowEcho
+// and SetFlow return the echoed flow.
 const RequestFlags = syscall.NLM_F_REQUEST | syscall.NLM_F_ECHO
 
 // Do a netlink request that yields a single response message.
 func (s *NetlinkSocket) Request(req *NlMsgBuilder) (resp *NlMsgParser, err error) {
+	return s.RequestContext(context.Background(), req)
+}
+
+// Like Request, but giving up with ctx.Err() if ctx is done before
+// the response arrives.  The socket remains usable after that: A late
+// response will be discarded due to its sequence number.
+func (s *NetlinkSocket) RequestContext(ctx context.Context, req *NlMsgBuilder) (resp *NlMsgParser, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	seq, err := s.send(req)
 	if err != nil {
 		return nil, err
 	}
 
-	err = s.Receive(func(msg *NlMsgParser) (bool, error) {
-		relevant, err := msg.checkResponseHeader(s.PortId(), seq)
+	err = s.receive(ctx, true, nil, func(msg *NlMsgParser) (bool, error) {
+		relevant, err := s.checkResponseHeader(msg, seq)
 		if relevant && err == nil {
 			resp = msg
 		}
-		return true, err
+
+		// Keep going past stale responses to earlier requests
+		return relevant, err
 	})
 	return
 }
 
+// Requests that have side-effects but produce no reply message (e.g
+// *_DEL) should ask for an ack, so that success can be distinguished
+// from a lost request.
+const AckFlags = syscall.NLM_F_REQUEST | syscall.NLM_F_ACK
+
+// Do a netlink request built with AckFlags, waiting for the ack (an
+// NLMSG_ERROR with an error code of 0) that matches its sequence
+// number.  Any other response messages before the ack are discarded.
+func (s *NetlinkSocket) RequestAck(req *NlMsgBuilder) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	seq, err := s.send(req)
+	if err != nil {
+		return err
+	}
+
+	return s.receive(context.Background(), true, nil, func(msg *NlMsgParser) (bool, error) {
+		relevant, err := s.checkResponseHeader(msg, seq)
+		if !relevant || err != nil {
+			return relevant, err
+		}
+
+		return msg.NlMsghdr().Type == syscall.NLMSG_ERROR, nil
+	})
+}
+
+// NlMsgBatch collects requests to be sent to the kernel together by
+// RequestBatch, amortizing the system call overhead across them.
+type NlMsgBatch struct {
+	buf  []byte
+	offs []int
+	seqs []uint32
+}
+
+// Add a request to the batch.  The message is finished and copied
+// into the batch, so the builder may be reused or released.
+// NLM_F_ACK is set on the request, as RequestBatch relies on acks.
+func (batch *NlMsgBatch) Add(req *NlMsgBuilder) {
+	req.AddFlags(syscall.NLM_F_ACK)
+	data, seq := req.Finish()
+
+	off := nlmsgAlign(len(batch.buf))
+	for len(batch.buf) < off {
+		batch.buf = append(batch.buf, 0)
+	}
+
+	batch.buf = append(batch.buf, data...)
+	batch.offs = append(batch.offs, off)
+	batch.seqs = append(batch.seqs, seq)
+}
+
+func (batch *NlMsgBatch) Len() int {
+	return len(batch.seqs)
+}
+
+// The number of requests sent in a single system call.  The acks for
+// failed requests echo the request, so this is limited to keep the
+// acks for a chunk well within the socket receive buffer.
+const batchChunkSize = 64
+
+// Do the requests in a batch, waiting for all of their acks.  If any
+// requests fail, the error for the first one is returned, wrapped to
+// indicate its index in the batch; the remaining requests are still
+// done.
+func (s *NetlinkSocket) RequestBatch(batch *NlMsgBatch) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var firstErr error
+	for start := 0; start < batch.Len(); start += batchChunkSize {
+		end := start + batchChunkSize
+		if end > batch.Len() {
+			end = batch.Len()
+		}
+
+		if err := s.requestBatchChunk(batch, start, end, &firstErr); err != nil {
+			return err
+		}
+	}
+
+	return firstErr
+}
+
+func (s *NetlinkSocket) requestBatchChunk(batch *NlMsgBatch, start int, end int, firstErr *error) error {
+	data := batch.buf[batch.offs[start]:]
+	if end < batch.Len() {
+		data = batch.buf[batch.offs[start]:batch.offs[end]]
+	}
+
+	pending := make(map[uint32]int, end-start)
+	for i := start; i < end; i++ {
+		pending[batch.seqs[i]] = i
+	}
+
+	sa := syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err := s.sendto(data, &sa); err != nil {
+		return err
+	}
+
+	return s.receive(context.Background(), true, nil, func(msg *NlMsgParser) (bool, error) {
+		h := msg.NlMsghdr()
+		i, ok := pending[h.Seq]
+		if !ok {
+			atomic.AddUint64(&s.stats.SeqMismatches, 1)
+		}
+		if !ok || h.Type != syscall.NLMSG_ERROR {
+			// Stale responses, or replies preceding acks
+			return false, nil
+		}
+
+		if h.Pid != s.PortId() {
+			return true, fmt.Errorf("netlink reply port id mismatch (got %d, expected %d)", h.Pid, s.PortId())
+		}
+
+		if err := msg.checkHeader(); err != nil && *firstErr == nil {
+			*firstErr = fmt.Errorf("batch request %d: %w", i, err)
+		}
+
+		delete(pending, h.Seq)
+		return len(pending) == 0, nil
+	})
+}
+
 const DumpFlags = syscall.NLM_F_DUMP | syscall.NLM_F_REQUEST
 
 // Do a netlink request that yield multiple response messages.
 func (s *NetlinkSocket) RequestMulti(req *NlMsgBuilder, consumer func(*NlMsgParser) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	seq, err := s.send(req)
 	if err != nil {
 		return err
 	}
 
-	return s.Receive(func(msg *NlMsgParser) (bool, error) {
-		relevant, err := msg.checkResponseHeader(s.PortId(), seq)
+	return s.receive(context.Background(), true, nil, func(msg *NlMsgParser) (bool, error) {
+		relevant, err := s.checkResponseHeader(msg, seq)
 		if !relevant || err != nil {
 			return false, err
 		}
@@ -661,13 +1929,94 @@ func processNlMsgDone(msg *NlMsgParser) error {
 	}
 }
 
+// Waits for a socket to become readable, or for a context to be
+// done.  poll can't wait on a channel, so a goroutine watching the
+// context wakes it up via a pipe.
+type contextWaiter struct {
+	ctx      context.Context
+	fd       int
+	pipe     [2]int
+	stop     chan struct{}
+	finished chan struct{}
+}
+
+func newContextWaiter(ctx context.Context, fd int) (*contextWaiter, error) {
+	w := &contextWaiter{
+		ctx:      ctx,
+		fd:       fd,
+		stop:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+
+	if err := syscall.Pipe2(w.pipe[:], syscall.O_CLOEXEC); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		defer close(w.finished)
+		select {
+		case <-ctx.Done():
+			syscall.Write(w.pipe[1], []byte{0})
+		case <-w.stop:
+		}
+	}()
+
+	return w, nil
+}
+
+func (w *contextWaiter) wait() error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+
+	fds := []pollFd{
+		{fd: int32(w.fd), events: POLLIN},
+		{fd: int32(w.pipe[0]), events: POLLIN},
+	}
+
+	for {
+		_, err := ppoll(fds, nil)
+		if err == nil {
+			break
+		}
+
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+
+	if fds[1].revents != 0 {
+		return w.ctx.Err()
+	}
+
+	return nil
+}
+
+func (w *contextWaiter) close() {
+	// Make sure the goroutine is finished before closing the
+	// pipe, so it can't write to a reused fd.
+	close(w.stop)
+	<-w.finished
+	syscall.Close(w.pipe[0])
+	syscall.Close(w.pipe[1])
+}
+
+// Consumers are told about errors encountered while consuming
+// messages.  stopped indicates whether consuming has stopped as a
+// result.  Socket overruns (see IsSocketOverrunError), which are only
+// reported if SetNoENOBUFS(false) was called, do not stop it: The
+// consumer should count them as dropped messages.
 type Consumer interface {
 	Error(err error, stopped bool)
 }
 
-func (s *NetlinkSocket) consume(consumer Consumer, handler func(*NlMsgParser) error) {
+// If buf is nil, each datagram is received into a new buffer, so
+// handler may keep what it parses from the messages.  Otherwise,
+// datagrams are received into buf (see RecvInto), and handler must
+// not retain anything parsed from them after it returns.
+func (s *NetlinkSocket) consume(consumer Consumer, buf []byte, handler func(*NlMsgParser) error) {
 	for {
-		err := s.Receive(func(msg *NlMsgParser) (bool, error) {
+		err := s.receive(context.Background(), false, buf, func(msg *NlMsgParser) (bool, error) {
 			err := msg.checkHeader()
 			if err == nil {
 				err = handler(msg)
@@ -681,6 +2030,13 @@ func (s *NetlinkSocket) consume(consumer Consumer, handler func(*NlMsgParser) er
 		})
 
 		if err != nil {
+			// An overrun means that messages were lost, but
+			// the socket is still usable
+			if IsSocketOverrunError(err) {
+				consumer.Error(err, false)
+				continue
+			}
+
 			consumer.Error(err, true)
 			break
 		}
@@ -0,0 +1,1655 @@
+package odp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestAlign(t *testing.T) {
+	for _, c := range []struct{ n, aligned int }{
+		{0, 0}, {1, 4}, {3, 4}, {4, 4}, {5, 8}, {8, 8}, {9, 12},
+	} {
+		if a := nlmsgAlign(c.n); a != c.aligned {
+			t.Errorf("nlmsgAlign(%d) = %d, expected %d", c.n, a, c.aligned)
+		}
+
+		if a := nlaAlign(c.n); a != c.aligned {
+			t.Errorf("nlaAlign(%d) = %d, expected %d", c.n, a, c.aligned)
+		}
+
+		nlmsg := NlMsgBuilder{buf: make([]byte, c.n)}
+		if pos := nlmsg.nlmsgAlignGrow(2); pos != c.aligned || len(nlmsg.buf) != c.aligned+2 {
+			t.Errorf("nlmsgAlignGrow at %d = %d, length %d", c.n, pos, len(nlmsg.buf))
+		}
+	}
+}
+
+func openTestSocket(t *testing.T) *NetlinkSocket {
+	sock, err := OpenNetlinkSocket(syscall.NETLINK_GENERIC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sock
+}
+
+func checkedCloseSocket(sock *NetlinkSocket, t *testing.T) {
+	if err := sock.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Send a message directly from one netlink socket to another
+func sendToSocket(from *NetlinkSocket, to *NetlinkSocket, msg *NlMsgBuilder) error {
+	sa := syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Pid:    to.PortId(),
+	}
+
+	data, _ := msg.Finish()
+	return syscall.Sendto(from.fd, data, 0, &sa)
+}
+
+func TestRecvLargeMessage(t *testing.T) {
+	a := openTestSocket(t)
+	defer checkedCloseSocket(a, t)
+	b := openTestSocket(t)
+	defer checkedCloseSocket(b, t)
+
+	payload := make([]byte, 3*syscall.Getpagesize()+123)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	req := NewNlMsgBuilder(syscall.NLM_F_REQUEST, GENL_ID_CTRL)
+	req.PutSliceAttr(1, payload)
+	if err := sendToSocket(a, b, req); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := b.recv(a.PortId())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := resp.nextNlMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := msg.ExpectNlMsghdr(GENL_ID_CTRL); err != nil {
+		t.Fatal(err)
+	}
+
+	attrs, err := msg.TakeAttrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(attrs[1], payload) {
+		t.Fatal("payload mismatch")
+	}
+}
+
+func TestFd(t *testing.T) {
+	sock := openTestSocket(t)
+	defer checkedCloseSocket(sock, t)
+
+	sa, err := syscall.Getsockname(sock.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nlsa, ok := sa.(*syscall.SockaddrNetlink)
+	if !ok || nlsa.Pid != sock.PortId() {
+		t.Fatalf("unexpected socket address %v", sa)
+	}
+}
+
+func TestSendRecv(t *testing.T) {
+	sock := openTestSocket(t)
+	defer checkedCloseSocket(sock, t)
+
+	req := NewNlMsgBuilder(RequestFlags, GENL_ID_CTRL)
+	req.PutGenlMsghdr(CTRL_CMD_GETFAMILY, 0)
+	req.PutStringAttr(CTRL_ATTR_FAMILY_NAME, "nlctrl")
+	data, seq := req.Finish()
+
+	if err := sock.Send(data); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := sock.Recv(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := NewNlMsgParser(data)
+	if resp.NlMsghdr().Seq != seq {
+		t.Fatal(resp.NlMsghdr())
+	}
+
+	if _, err := resp.ExpectGenlResponse(GENL_ID_CTRL, CTRL_CMD_NEWFAMILY); err != nil {
+		t.Fatal(err)
+	}
+
+	attrs, err := resp.TakeAttrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id, err := attrs.GetUint16(CTRL_ATTR_FAMILY_ID); err != nil || id != GENL_ID_CTRL {
+		t.Fatal(id, err)
+	}
+}
+
+func TestSocketStats(t *testing.T) {
+	sock := openTestSocket(t)
+	defer checkedCloseSocket(sock, t)
+
+	// A request whose response is never consumed, so that it
+	// shows up as a sequence number mismatch for the next request
+	stale := NewNlMsgBuilder(RequestFlags, GENL_ID_CTRL)
+	stale.PutGenlMsghdr(CTRL_CMD_GETFAMILY, 0)
+	stale.PutStringAttr(CTRL_ATTR_FAMILY_NAME, "nlctrl")
+	data, _ := stale.Finish()
+	if err := sock.Send(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sock.LookupGenlFamily("nlctrl"); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := sock.Stats()
+	if stats.Sent != 2 || stats.Received != 2 || stats.SeqMismatches != 1 ||
+		stats.Overruns != 0 || stats.Truncated != 0 {
+		t.Fatal(stats)
+	}
+}
+
+func TestSetNoENOBUFS(t *testing.T) {
+	sock := openTestSocket(t)
+	defer checkedCloseSocket(sock, t)
+
+	for _, on := range []bool{false, true} {
+		if err := sock.SetNoENOBUFS(on); err != nil {
+			t.Fatal(err)
+		}
+
+		val, err := syscall.GetsockoptInt(sock.fd, SOL_NETLINK, syscall.NETLINK_NO_ENOBUFS)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if (val != 0) != on {
+			t.Fatalf("NETLINK_NO_ENOBUFS is %d, expected %t", val, on)
+		}
+	}
+}
+
+func TestSetRecvbufSize(t *testing.T) {
+	sock := openTestSocket(t)
+	defer checkedCloseSocket(sock, t)
+
+	if err := sock.SetRecvbufSize(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := sock.RecvbufSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if size <= 0 {
+		t.Fatalf("bad receive buffer size %d", size)
+	}
+
+	if err := sock.SetRecvbufSize(-1); err == nil {
+		t.Fatal("negative receive buffer size accepted")
+	}
+}
+
+func TestLookupGenlFamily(t *testing.T) {
+	sock := openTestSocket(t)
+	defer checkedCloseSocket(sock, t)
+
+	family, err := sock.LookupGenlFamily("nlctrl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if family.ID() != GENL_ID_CTRL {
+		t.Fatalf("nlctrl family id is %d, expected %d", family.ID(), GENL_ID_CTRL)
+	}
+
+	if _, ok := family.MCGroups()["notify"]; !ok {
+		t.Fatal("nlctrl family lacks notify multicast group")
+	}
+
+	_, err = sock.LookupGenlFamily("no_such_family")
+	if err != NetlinkError(syscall.ENOENT) {
+		t.Fatal(err)
+	}
+}
+
+func TestJoinMulticastGroup(t *testing.T) {
+	sock := openTestSocket(t)
+	defer checkedCloseSocket(sock, t)
+
+	family, err := sock.LookupGenlFamily("nlctrl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	group, ok := family.MCGroups()["notify"]
+	if !ok {
+		t.Fatal("nlctrl family lacks notify multicast group")
+	}
+
+	if err := sock.JoinMulticastGroup(group); err != nil {
+		t.Fatal(err)
+	}
+
+	// Joining again is harmless
+	if err := sock.JoinMulticastGroup(group); err != nil {
+		t.Fatal(err)
+	}
+
+	if groups := sock.JoinedGroups(); len(groups) != 1 || groups[0] != group {
+		t.Fatal(groups)
+	}
+
+	if err := sock.LeaveMulticastGroup(group); err != nil {
+		t.Fatal(err)
+	}
+
+	if groups := sock.JoinedGroups(); len(groups) != 0 {
+		t.Fatal(groups)
+	}
+}
+
+// Finish a message built with NewNlMsgBuilder(_, GENL_ID_CTRL) and
+// parse its attributes
+func finishAndTakeAttrs(t *testing.T, req *NlMsgBuilder) Attrs {
+	data, _ := req.Finish()
+
+	msg := &NlMsgParser{data: data, pos: 0}
+	if _, err := msg.ExpectNlMsghdr(GENL_ID_CTRL); err != nil {
+		t.Fatal(err)
+	}
+
+	attrs, err := msg.TakeAttrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return attrs
+}
+
+// Join the nlctrl notify group, which multicastToGroup can send to
+func joinTestGroup(t *testing.T, sock *NetlinkSocket) uint32 {
+	family, err := sock.LookupGenlFamily("nlctrl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	group := family.MCGroups()["notify"]
+	if err := sock.JoinMulticastGroup(group); err != nil {
+		t.Fatal(err)
+	}
+
+	return group
+}
+
+// Multicast a message from a socket to a group.  This needs
+// CAP_NET_ADMIN.
+func multicastToGroup(t *testing.T, from *NetlinkSocket, group uint32) {
+	// A message without NLM_F_REQUEST, which the kernel ignores
+	sa := syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: 1 << (group - 1),
+	}
+	data, _ := NewNlMsgBuilder(0, GENL_ID_CTRL).Finish()
+	if err := syscall.Sendto(from.fd, data, 0, &sa); err != nil {
+		if err == syscall.EPERM {
+			t.Skip("cannot send netlink multicast messages")
+		}
+		t.Fatal(err)
+	}
+}
+
+func multicastToSocket(t *testing.T, from *NetlinkSocket, to *NetlinkSocket) {
+	multicastToGroup(t, from, joinTestGroup(t, to))
+}
+
+func TestMulticastSource(t *testing.T) {
+	sock := openTestSocket(t)
+	defer checkedCloseSocket(sock, t)
+	from := openTestSocket(t)
+	defer checkedCloseSocket(from, t)
+
+	multicastToSocket(t, from, sock)
+
+	_, nlfrom, err := sock.recvWithSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if nlfrom.Groups == 0 || nlfrom.Pid != from.PortId() {
+		t.Fatalf("unexpected source %v", nlfrom)
+	}
+}
+
+func TestRequestSkipsMulticast(t *testing.T) {
+	sock := openTestSocket(t)
+	defer checkedCloseSocket(sock, t)
+	from := openTestSocket(t)
+	defer checkedCloseSocket(from, t)
+
+	multicastToSocket(t, from, sock)
+
+	// The multicast message is queued ahead of the response
+	if _, err := sock.LookupGenlFamily("nlctrl"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenNetlinkSocketInNetns(t *testing.T) {
+	nsFd, err := syscall.Open("/proc/self/ns/net", syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+
+	sock, err := OpenNetlinkSocketInNetns(syscall.NETLINK_GENERIC, nsFd)
+	syscall.Close(nsFd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkedCloseSocket(sock, t)
+
+	if _, err := sock.LookupGenlFamily("nlctrl"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen uses the socket's own copy of the namespace fd
+	if _, err := sock.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sock.LookupGenlFamily("nlctrl"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenNetlinkSocketInNetns(syscall.NETLINK_GENERIC, -1); err == nil {
+		t.Fatal("expected error for bad namespace fd")
+	}
+}
+
+func TestReopen(t *testing.T) {
+	sock := openTestSocket(t)
+	defer checkedCloseSocket(sock, t)
+	from := openTestSocket(t)
+	defer checkedCloseSocket(from, t)
+
+	if err := sock.SetNoENOBUFS(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sock.SetRecvTimeout(10 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	group := joinTestGroup(t, sock)
+	multicastToGroup(t, from, group)
+
+	oldPortId := sock.PortId()
+	portId, err := sock.Reopen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if portId != sock.PortId() || portId == oldPortId {
+		t.Fatal(portId, oldPortId)
+	}
+
+	val, err := syscall.GetsockoptInt(sock.fd, SOL_NETLINK, syscall.NETLINK_NO_ENOBUFS)
+	if err != nil || val != 0 {
+		t.Fatal(val, err)
+	}
+
+	// The queued message went with the old socket
+	if _, err := sock.recv(from.PortId()); !IsRecvTimeoutError(err) {
+		t.Fatal(err)
+	}
+
+	// But the new socket is still in the group
+	multicastToGroup(t, from, group)
+	if _, err := sock.recv(from.PortId()); err != nil {
+		t.Fatal(err)
+	}
+
+	// And usable for requests
+	if _, err := sock.LookupGenlFamily("nlctrl"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReopenFailureKeepsSocket(t *testing.T) {
+	sock := openTestSocket(t)
+	defer checkedCloseSocket(sock, t)
+
+	// Group 0 can't be joined, so configuring the new socket fails
+	sock.groups[0] = struct{}{}
+	fd, portId := sock.fd, sock.PortId()
+	if _, err := sock.Reopen(); err == nil {
+		t.Fatal("Reopen succeeded")
+	}
+
+	if sock.fd != fd || sock.PortId() != portId {
+		t.Fatal(sock.fd, fd)
+	}
+
+	delete(sock.groups, 0)
+	if _, err := sock.LookupGenlFamily("nlctrl"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScalarAttrs(t *testing.T) {
+	req := NewNlMsgBuilder(syscall.NLM_F_REQUEST, GENL_ID_CTRL)
+	req.PutUint16Attr(1, 0x1234)
+	req.PutUint32Attr(2, 0x12345678)
+	req.PutUint64Attr(3, 0x123456789abcdef0)
+	req.PutUint8Attr(5, 0x12)
+	attrs := finishAndTakeAttrs(t, req)
+
+	if v, err := attrs.GetUint16(1); err != nil || v != 0x1234 {
+		t.Fatal(v, err)
+	}
+
+	if v, err := attrs.GetUint32(2); err != nil || v != 0x12345678 {
+		t.Fatal(v, err)
+	}
+
+	if v, err := attrs.GetUint64(3); err != nil || v != 0x123456789abcdef0 {
+		t.Fatal(v, err)
+	}
+
+	if v, present, err := attrs.GetOptionalUint8(5); err != nil || !present || v != 0x12 {
+		t.Fatal(v, present, err)
+	}
+
+	if _, present, err := attrs.GetOptionalUint32(4); err != nil || present {
+		t.Fatal(present, err)
+	}
+
+	if _, err := attrs.GetUint32(4); err == nil {
+		t.Fatal("missing attribute not reported")
+	}
+
+	// Wrong lengths
+	if _, err := attrs.GetUint16(2); err == nil {
+		t.Fatal("wrong length uint16 attribute not reported")
+	}
+
+	if _, _, err := attrs.GetOptionalUint16(2); err == nil {
+		t.Fatal("wrong length uint16 attribute not reported")
+	}
+
+	if _, err := attrs.GetUint32(1); err == nil {
+		t.Fatal("wrong length uint32 attribute not reported")
+	}
+
+	if _, err := attrs.GetUint64(2); err == nil {
+		t.Fatal("wrong length uint64 attribute not reported")
+	}
+}
+
+func TestUnknownAttrTypes(t *testing.T) {
+	req := NewNlMsgBuilder(syscall.NLM_F_REQUEST, GENL_ID_CTRL)
+	for _, typ := range []uint16{5, 1, 3, 2} {
+		req.PutUint8Attr(typ, 0)
+	}
+	attrs := finishAndTakeAttrs(t, req)
+
+	if unknown := attrs.UnknownTypes(1, 2, 4); len(unknown) != 2 || unknown[0] != 3 || unknown[1] != 5 {
+		t.Fatal(unknown)
+	}
+
+	if err := attrs.CheckKnown(1, 2, 3, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := attrs.CheckKnown(1, 2, 3); err == nil {
+		t.Fatal("unknown attribute type not reported")
+	}
+}
+
+func TestForEachAttr(t *testing.T) {
+	req := NewNlMsgBuilder(syscall.NLM_F_REQUEST, GENL_ID_CTRL)
+	for typ := uint16(1); typ <= 4; typ++ {
+		req.PutUint16Attr(typ, typ*10)
+	}
+	data, _ := req.Finish()
+
+	var seen []uint16
+	stop := fmt.Errorf("stop")
+	msg := &NlMsgParser{data: data, pos: syscall.NLMSG_HDRLEN}
+	err := msg.ForEachAttr(func(typ uint16, val []byte) error {
+		if len(val) != 2 || *uint16At(val, 0) != typ*10 {
+			t.Fatal(typ, val)
+		}
+
+		seen = append(seen, typ)
+		if typ == 3 {
+			return stop
+		}
+
+		return nil
+	})
+
+	if err != stop || len(seen) != 3 {
+		t.Fatal(err, seen)
+	}
+}
+
+func TestNestedAttrs(t *testing.T) {
+	req := NewNlMsgBuilder(syscall.NLM_F_REQUEST, GENL_ID_CTRL)
+	req.PutNestedAttrs(1, func() {
+		req.PutUint8Attr(1, 42)
+		req.PutNestedAttrs(2, func() {
+			req.PutStringAttr(1, "a")
+			req.PutNestedAttrs(2, func() {
+				req.PutUint16Attr(1, 1234)
+			})
+		})
+		req.PutStringAttr(3, "abc")
+	})
+	req.PutUint32Attr(2, 99)
+
+	attrs := finishAndTakeAttrs(t, req)
+
+	outer, err := attrs.GetNestedAttrs(1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _, err := outer.GetOptionalUint8(1); err != nil || v != 42 {
+		t.Fatal(v, err)
+	}
+
+	if v, err := outer.GetString(3); err != nil || v != "abc" {
+		t.Fatal(v, err)
+	}
+
+	middle, err := outer.GetNestedAttrs(2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := middle.GetString(1); err != nil || v != "a" {
+		t.Fatal(v, err)
+	}
+
+	inner, err := middle.GetNestedAttrs(2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := inner.GetUint16(1); err != nil || v != 1234 {
+		t.Fatal(v, err)
+	}
+
+	// The attribute following the nested attributes is intact
+	if v, err := attrs.GetUint32(2); err != nil || v != 99 {
+		t.Fatal(v, err)
+	}
+}
+
+func TestTruncatedNestedAttrs(t *testing.T) {
+	// A nested attribute containing an attribute header that
+	// claims more data than is present
+	inner := MakeAlignedByteSlice(8)
+	nla := nlAttrAt(inner, 0)
+	nla.Len = 100
+	nla.Type = 1
+
+	req := NewNlMsgBuilder(syscall.NLM_F_REQUEST, GENL_ID_CTRL)
+	req.PutSliceAttr(1, inner)
+	attrs := finishAndTakeAttrs(t, req)
+
+	_, err := attrs.GetNestedAttrs(1, false)
+	var terr TruncationError
+	if !errors.As(err, &terr) {
+		t.Fatal("truncated nested attribute not reported")
+	}
+
+	if terr.At != 0 || terr.Need != 100 || terr.Have != 8 {
+		t.Fatal(terr)
+	}
+}
+
+func TestTruncatedNlMsg(t *testing.T) {
+	data, _ := NewNlMsgBuilder(syscall.NLM_F_REQUEST, GENL_ID_CTRL).Finish()
+	nlMsghdrAt(data, 0).Len = 100
+
+	resp := &NlMsgParser{data: data, pos: 0}
+	_, err := resp.nextNlMsg()
+	if !IsTruncationError(err) {
+		t.Fatal(err)
+	}
+
+	if err.(TruncationError).Need != 100 {
+		t.Fatal(err)
+	}
+
+	resp = &NlMsgParser{data: data[:8], pos: 0}
+	if _, err := resp.nextNlMsg(); !IsTruncationError(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestShortAttrLength(t *testing.T) {
+	// Attribute lengths that don't even cover the attribute
+	// header, including zero which would never advance
+	for l := uint16(0); l < syscall.SizeofNlAttr; l++ {
+		data := MakeAlignedByteSlice(8)
+		nla := nlAttrAt(data, 0)
+		nla.Len = l
+		nla.Type = 1
+
+		if _, err := ParseNestedAttrs(data); err == nil {
+			t.Fatalf("attribute length %d not reported", l)
+		}
+	}
+}
+
+func TestShortNlMsgLength(t *testing.T) {
+	for l := uint32(0); l < syscall.NLMSG_HDRLEN; l++ {
+		data, _ := NewNlMsgBuilder(syscall.NLM_F_REQUEST, GENL_ID_CTRL).Finish()
+		nlMsghdrAt(data, 0).Len = l
+
+		resp := &NlMsgParser{data: data, pos: 0}
+		if _, err := resp.nextNlMsg(); err == nil {
+			t.Fatalf("message length %d not reported", l)
+		}
+	}
+}
+
+func TestOrderedAttrs(t *testing.T) {
+	req := NewNlMsgBuilder(syscall.NLM_F_REQUEST, GENL_ID_CTRL)
+	req.PutNestedAttrs(1, func() {
+		req.PutUint32Attr(3, 1)
+		req.PutUint32Attr(1, 2)
+		req.PutUint32Attr(3, 3)
+	})
+	attrs := finishAndTakeAttrs(t, req)
+
+	ordered, err := attrs.GetOrderedAttrs(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []uint16{3, 1, 3}
+	if len(ordered) != len(expect) {
+		t.Fatalf("got %d attributes, expected %d", len(ordered), len(expect))
+	}
+
+	for i, attr := range ordered {
+		if attr.Type != expect[i] || *uint32At(attr.Value, 0) != uint32(i+1) {
+			t.Fatalf("attribute %d is %v", i, attr)
+		}
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	sock := openTestSocket(t)
+	defer checkedCloseSocket(sock, t)
+
+	lookupReq := func() *NlMsgBuilder {
+		req := NewNlMsgBuilder(RequestFlags, GENL_ID_CTRL)
+		req.PutGenlMsghdr(CTRL_CMD_GETFAMILY, 0)
+		req.PutStringAttr(CTRL_ATTR_FAMILY_NAME, "nlctrl")
+		return req
+	}
+
+	// The kernel ignores messages lacking NLM_F_REQUEST, so this
+	// never gets a response
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := sock.RequestContext(ctx, NewNlMsgBuilder(0, GENL_ID_CTRL))
+	if err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+
+	// A request with a context that is already done gives up,
+	// leaving the response unread on the socket
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = sock.RequestContext(ctx, lookupReq())
+	if err != context.Canceled {
+		t.Fatal(err)
+	}
+
+	// The socket remains usable
+	resp, err := sock.RequestContext(context.Background(), lookupReq())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := resp.ExpectNlMsghdr(GENL_ID_CTRL); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecvTimeout(t *testing.T) {
+	sock := openTestSocket(t)
+	defer checkedCloseSocket(sock, t)
+
+	if err := sock.SetRecvTimeout(10 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := sock.recv(0)
+	if !IsRecvTimeoutError(err) {
+		t.Fatal(err)
+	}
+
+	// A sub-microsecond timeout is still a timeout, not a
+	// blocking receive
+	if err := sock.SetRecvTimeout(time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+
+	if sock.recvTimeout != time.Microsecond {
+		t.Fatal(sock.recvTimeout)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := sock.recv(0)
+		errs <- err
+	}()
+
+	select {
+	case err := <-errs:
+		if !IsRecvTimeoutError(err) {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("receive with a 1ns timeout blocked")
+	}
+
+	if err := sock.SetRecvTimeout(0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetNonblock(t *testing.T) {
+	sock := openTestSocket(t)
+	defer checkedCloseSocket(sock, t)
+	from := openTestSocket(t)
+	defer checkedCloseSocket(from, t)
+
+	if err := sock.SetNonblock(true); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sock.recv(from.PortId()); err != syscall.EAGAIN {
+		t.Fatal(err)
+	}
+
+	msg := NewNlMsgBuilder(RequestFlags, 0)
+	if err := sendToSocket(from, sock, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sock.recv(from.PortId()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests still wait for their responses
+	if _, err := sock.LookupGenlFamily("nlctrl"); err != nil {
+		t.Fatal(err)
+	}
+
+	// For no longer than the receive timeout
+	if err := sock.SetRecvTimeout(10 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sock.waitReadable(); !IsRecvTimeoutError(err) {
+		t.Fatal(err)
+	}
+
+	// Back in blocking mode, EAGAIN means a receive timeout again
+	if err := sock.SetNonblock(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sock.recv(from.PortId()); !IsRecvTimeoutError(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	sock := openTestSocket(t)
+	defer checkedCloseSocket(sock, t)
+
+	const n = 8
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			for j := 0; j < 50; j++ {
+				family, err := sock.LookupGenlFamily("nlctrl")
+				if err == nil && family.ID() != GENL_ID_CTRL {
+					err = fmt.Errorf("wrong family id %d", family.ID())
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMultipleMessagesInBuffer(t *testing.T) {
+	var data []byte
+	for i := 0; i < 2; i++ {
+		req := NewNlMsgBuilder(syscall.NLM_F_REQUEST, GENL_ID_CTRL+uint16(i))
+		req.PutStringAttr(1, fmt.Sprint("msg", i))
+		msg, _ := req.Finish()
+		data = append(data, msg...)
+		data = data[:nlmsgAlign(len(data))]
+	}
+
+	buf := MakeAlignedByteSlice(len(data))
+	copy(buf, data)
+	resp := &NlMsgParser{data: buf, pos: 0}
+
+	for i := 0; i < 2; i++ {
+		msg, err := resp.nextNlMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := msg.ExpectNlMsghdr(GENL_ID_CTRL + uint16(i)); err != nil {
+			t.Fatal(err)
+		}
+
+		attrs, err := msg.TakeAttrs()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if s, err := attrs.GetString(1); err != nil || s != fmt.Sprint("msg", i) {
+			t.Fatal(s, err)
+		}
+	}
+
+	if msg, err := resp.nextNlMsg(); msg != nil || err != nil {
+		t.Fatal(msg, err)
+	}
+}
+
+func TestExpectGenlResponse(t *testing.T) {
+	build := func() *NlMsgParser {
+		req := NewNlMsgBuilder(syscall.NLM_F_REQUEST, GENL_ID_CTRL)
+		req.PutGenlMsghdr(CTRL_CMD_NEWFAMILY, 0)
+		data, _ := req.Finish()
+		return &NlMsgParser{data: data, pos: 0}
+	}
+
+	if _, err := build().ExpectGenlResponse(GENL_ID_CTRL, CTRL_CMD_NEWFAMILY); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := build().ExpectGenlResponse(GENL_ID_CTRL, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := build().ExpectGenlResponse(GENL_ID_CTRL+1, CTRL_CMD_NEWFAMILY); err == nil {
+		t.Fatal("wrong family not reported")
+	}
+
+	if _, err := build().ExpectGenlResponse(GENL_ID_CTRL, CTRL_CMD_GETFAMILY); err == nil {
+		t.Fatal("wrong command not reported")
+	}
+}
+
+func buildExtAckError(flags uint16, errno syscall.Errno, payload []byte) *NlMsgParser {
+	msg := NewNlMsgBuilder(flags, syscall.NLMSG_ERROR)
+	pos := msg.Grow(syscall.SizeofNlMsgerr)
+	nlerr := nlMsgerrAt(msg.buf, pos)
+	nlerr.Error = -int32(errno)
+	nlerr.Msg.Len = uint32(syscall.NLMSG_HDRLEN + len(payload))
+	copy(msg.buf[msg.Grow(uintptr(len(payload))):], payload)
+	msg.PutStringAttr(NLMSGERR_ATTR_MSG, "unknown flow key")
+	msg.PutUint32Attr(NLMSGERR_ATTR_OFFS, 32)
+	data, _ := msg.Finish()
+	return &NlMsgParser{data: data, pos: 0}
+}
+
+func TestNetlinkErrorIs(t *testing.T) {
+	err := fmt.Errorf("deleting vport: %w", NetlinkError(syscall.ENODEV))
+	if !errors.Is(err, syscall.ENODEV) || errors.Is(err, syscall.ENOENT) {
+		t.Fatal(err)
+	}
+
+	if !IsNoSuchDatapathError(err) || IsNoSuchFlowError(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestExtAckError(t *testing.T) {
+	check := func(msg *NlMsgParser) {
+		err := msg.checkHeader()
+		ackerr, ok := err.(NetlinkExtAckError)
+		if !ok {
+			t.Fatal(err)
+		}
+
+		if ackerr.NetlinkError != NetlinkError(syscall.EINVAL) || ackerr.Msg != "unknown flow key" || !ackerr.HaveOffset || ackerr.Offset != 32 {
+			t.Fatal(ackerr)
+		}
+
+		if !isNetlinkError(err, syscall.EINVAL) || !errors.Is(err, syscall.EINVAL) {
+			t.Fatal(err)
+		}
+	}
+
+	check(buildExtAckError(NLM_F_ACK_TLVS|NLM_F_CAPPED, syscall.EINVAL, nil))
+	check(buildExtAckError(NLM_F_ACK_TLVS, syscall.EINVAL, []byte{1, 2, 3, 4, 5, 6, 7, 8}))
+
+	// Without NLM_F_ACK_TLVS, the trailing data is not examined
+	err := buildExtAckError(0, syscall.EINVAL, nil).checkHeader()
+	if err != NetlinkError(syscall.EINVAL) {
+		t.Fatal(err)
+	}
+}
+
+func TestSetExtAck(t *testing.T) {
+	sock := openTestSocket(t)
+	defer checkedCloseSocket(sock, t)
+
+	// A family name that is too long fails policy validation
+	badReq := func() *NlMsgBuilder {
+		req := NewNlMsgBuilder(RequestFlags, GENL_ID_CTRL)
+		req.PutGenlMsghdr(CTRL_CMD_GETFAMILY, 0)
+		req.PutStringAttr(CTRL_ATTR_FAMILY_NAME, strings.Repeat("x", 40))
+		return req
+	}
+
+	_, err := sock.Request(badReq())
+	if err != NetlinkError(syscall.EINVAL) {
+		t.Fatal(err)
+	}
+
+	if err := sock.SetExtAck(true); err != nil {
+		if err == syscall.ENOPROTOOPT {
+			t.Skip("kernel lacks NETLINK_EXT_ACK")
+		}
+		t.Fatal(err)
+	}
+
+	_, err = sock.Request(badReq())
+	ackerr, ok := err.(NetlinkExtAckError)
+	if !ok {
+		t.Fatal(err)
+	}
+
+	// The offset is that of the family name attribute
+	if ackerr.NetlinkError != NetlinkError(syscall.EINVAL) || ackerr.Msg == "" || !ackerr.HaveOffset || ackerr.Offset != syscall.NLMSG_HDRLEN+SizeofGenlMsghdr {
+		t.Fatal(ackerr)
+	}
+
+	if err := sock.SetExtAck(false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRequestAck(t *testing.T) {
+	sock := openTestSocket(t)
+	defer checkedCloseSocket(sock, t)
+
+	lookupReq := func(flags uint16, name string) *NlMsgBuilder {
+		req := NewNlMsgBuilder(flags, GENL_ID_CTRL)
+		req.PutGenlMsghdr(CTRL_CMD_GETFAMILY, 0)
+		req.PutStringAttr(CTRL_ATTR_FAMILY_NAME, name)
+		return req
+	}
+
+	// GETFAMILY sends a reply message before the ack
+	if err := sock.RequestAck(lookupReq(AckFlags, "nlctrl")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sock.RequestAck(lookupReq(AckFlags, "no_such_family")); !isNetlinkError(err, syscall.ENOENT) {
+		t.Fatal(err)
+	}
+
+	// Nothing should be left over on the socket to confuse
+	// a later request
+	if _, err := sock.Request(lookupReq(RequestFlags, "nlctrl")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSeqNoWrap(t *testing.T) {
+	// Put the shared sequence back afterwards, so that other tests
+	// don't depend on running before or after this one
+	saved := atomic.LoadUint32(&nextSeqNo)
+	defer atomic.StoreUint32(&nextSeqNo, saved)
+
+	atomic.StoreUint32(&nextSeqNo, math.MaxUint32-1)
+	if seq := NextSeqNo(); seq != math.MaxUint32 {
+		t.Fatal(seq)
+	}
+
+	sock := openTestSocket(t)
+	defer checkedCloseSocket(sock, t)
+
+	// The request after the wrap gets sequence number 1
+	req := NewNlMsgBuilder(RequestFlags, GENL_ID_CTRL)
+	req.PutGenlMsghdr(CTRL_CMD_GETFAMILY, 0)
+	req.PutStringAttr(CTRL_ATTR_FAMILY_NAME, "nlctrl")
+	resp, err := sock.Request(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if seq := resp.NlMsghdr().Seq; seq != 1 {
+		t.Fatal(seq)
+	}
+}
+
+func TestRequestBatch(t *testing.T) {
+	sock := openTestSocket(t)
+	defer checkedCloseSocket(sock, t)
+
+	// Enough requests to span several chunks, with one failure
+	var batch NlMsgBatch
+	for i := 0; i < 150; i++ {
+		name := "nlctrl"
+		if i == 100 {
+			name = "no_such_family"
+		}
+
+		req := GetBuilder(syscall.NLM_F_REQUEST, GENL_ID_CTRL)
+		req.PutGenlMsghdr(CTRL_CMD_GETFAMILY, 0)
+		req.PutStringAttr(CTRL_ATTR_FAMILY_NAME, name)
+		batch.Add(req)
+		req.Release()
+	}
+
+	err := sock.RequestBatch(&batch)
+	if !isNetlinkError(err, syscall.ENOENT) || err.Error() != "batch request 100: netlink error response: no such file or directory" {
+		t.Fatal(err)
+	}
+
+	// All the acks were consumed
+	if _, err := sock.LookupGenlFamily("nlctrl"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuilderFlags(t *testing.T) {
+	req := NewNlMsgBuilder(syscall.NLM_F_REQUEST, GENL_ID_CTRL)
+	req.PutGenlMsghdr(CTRL_CMD_GETFAMILY, 0)
+	req.AddFlags(syscall.NLM_F_DUMP)
+	data, seq := req.Finish()
+
+	h := nlMsghdrAt(data, 0)
+	if h.Flags != syscall.NLM_F_REQUEST|syscall.NLM_F_DUMP || h.Len != uint32(len(data)) || h.Seq != seq {
+		t.Fatal(h)
+	}
+
+	req = NewNlMsgBuilder(syscall.NLM_F_REQUEST, GENL_ID_CTRL)
+	req.SetFlags(syscall.NLM_F_ECHO)
+	data, _ = req.Finish()
+	if h := nlMsghdrAt(data, 0); h.Flags != syscall.NLM_F_ECHO {
+		t.Fatal(h)
+	}
+}
+
+func TestFinishWithSeq(t *testing.T) {
+	data := NewNlMsgBuilder(syscall.NLM_F_REQUEST, GENL_ID_CTRL).FinishWithSeq(1234)
+	if h := nlMsghdrAt(data, 0); h.Seq != 1234 || h.Len != syscall.NLMSG_HDRLEN {
+		t.Fatal(h)
+	}
+
+	seq := NextSeqNo()
+	if _, next := NewNlMsgBuilder(syscall.NLM_F_REQUEST, GENL_ID_CTRL).Finish(); next == seq {
+		t.Fatal("Finish reused sequence number", seq)
+	}
+}
+
+func TestBuilderReset(t *testing.T) {
+	req := NewNlMsgBuilder(syscall.NLM_F_REQUEST, GENL_ID_CTRL)
+	req.PutGenlMsghdr(CTRL_CMD_GETFAMILY, 0)
+	req.PutStringAttr(CTRL_ATTR_FAMILY_NAME, "nlctrl")
+	data, _ := req.Finish()
+
+	req.Reset(syscall.NLM_F_ECHO, GENL_ID_CTRL+1)
+	req.PutUint8Attr(1, 42)
+	reused, _ := req.Finish()
+
+	if &reused[0] != &data[0] {
+		t.Fatal("buffer was not reused")
+	}
+
+	h := nlMsghdrAt(reused, 0)
+	if h.Flags != syscall.NLM_F_ECHO || h.Type != GENL_ID_CTRL+1 || h.Len != syscall.NLMSG_HDRLEN+5 {
+		t.Fatal(h)
+	}
+
+	msg := &NlMsgParser{data: reused, pos: 0}
+	if _, err := msg.ExpectNlMsghdr(GENL_ID_CTRL + 1); err != nil {
+		t.Fatal(err)
+	}
+
+	attrs, err := msg.TakeAttrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(attrs) != 1 || !bytes.Equal(attrs[1], []byte{42}) {
+		t.Fatal(attrs)
+	}
+}
+
+func buildBenchmarkMsg(req *NlMsgBuilder) {
+	req.PutGenlMsghdr(CTRL_CMD_GETFAMILY, 0)
+	req.PutStringAttr(CTRL_ATTR_FAMILY_NAME, "ovs_flow")
+	req.PutNestedAttrs(CTRL_ATTR_OPS, func() {
+		for i := uint16(0); i < 8; i++ {
+			req.PutUint32Attr(i, uint32(i))
+		}
+	})
+	req.Finish()
+}
+
+func TestRecvInto(t *testing.T) {
+	a := openTestSocket(t)
+	defer checkedCloseSocket(a, t)
+	b := openTestSocket(t)
+	defer checkedCloseSocket(b, t)
+
+	buf := MakeAlignedByteSlice(syscall.Getpagesize())
+	for _, size := range []int{100, 2 * syscall.Getpagesize()} {
+		req := NewNlMsgBuilder(syscall.NLM_F_REQUEST, GENL_ID_CTRL)
+		req.PutSliceAttr(1, make([]byte, size))
+		if err := sendToSocket(a, b, req); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := b.RecvInto(buf, a.PortId())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Small datagrams land in buf, big ones get a new
+		// buffer
+		fits := len(req.finished) <= len(buf)
+		if !bytes.Equal(data, req.finished) || (&data[0] == &buf[0]) != fits {
+			t.Fatal(size, len(data))
+		}
+	}
+}
+
+func TestReceiveReusesBuffer(t *testing.T) {
+	sock := openTestSocket(t)
+	defer checkedCloseSocket(sock, t)
+
+	for i := 0; i < 2; i++ {
+		req := NewNlMsgBuilder(RequestFlags, GENL_ID_CTRL)
+		req.PutGenlMsghdr(CTRL_CMD_GETFAMILY, 0)
+		req.PutStringAttr(CTRL_ATTR_FAMILY_NAME, "nlctrl")
+		data, _ := req.Finish()
+		if err := sock.Send(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := MakeAlignedByteSlice(syscall.Getpagesize())
+	n := 0
+	err := sock.receive(context.Background(), false, buf, func(msg *NlMsgParser) (bool, error) {
+		if &msg.data[0] != &buf[0] {
+			t.Fatal("message not received into buf")
+		}
+
+		n++
+		return n == 2, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Send a datagram from a to b and receive it, b.N times
+func benchmarkRecv(b *testing.B, recv func(*NetlinkSocket, uint32) error) {
+	from, err := OpenNetlinkSocket(syscall.NETLINK_GENERIC)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer from.Close()
+	to, err := OpenNetlinkSocket(syscall.NETLINK_GENERIC)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer to.Close()
+
+	req := NewNlMsgBuilder(syscall.NLM_F_REQUEST, GENL_ID_CTRL)
+	buildBenchmarkMsg(req)
+	data := req.finished
+	sa := syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Pid: to.PortId()}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := syscall.Sendto(from.fd, data, 0, &sa); err != nil {
+			b.Fatal(err)
+		}
+
+		if err := recv(to, from.PortId()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRecv(b *testing.B) {
+	benchmarkRecv(b, func(s *NetlinkSocket, peer uint32) error {
+		_, err := s.Recv(peer)
+		return err
+	})
+}
+
+func BenchmarkRecvInto(b *testing.B) {
+	buf := MakeAlignedByteSlice(syscall.Getpagesize())
+	benchmarkRecv(b, func(s *NetlinkSocket, peer uint32) error {
+		_, err := s.RecvInto(buf, peer)
+		return err
+	})
+}
+
+func BenchmarkNewBuilder(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buildBenchmarkMsg(NewNlMsgBuilder(RequestFlags, GENL_ID_CTRL))
+	}
+}
+
+func BenchmarkResetBuilder(b *testing.B) {
+	b.ReportAllocs()
+	req := NewNlMsgBuilder(RequestFlags, GENL_ID_CTRL)
+	for i := 0; i < b.N; i++ {
+		req.Reset(RequestFlags, GENL_ID_CTRL)
+		buildBenchmarkMsg(req)
+	}
+}
+
+func BenchmarkTakeAttrs(b *testing.B) {
+	req := NewNlMsgBuilder(RequestFlags, GENL_ID_CTRL)
+	buildBenchmarkMsg(req)
+	data := req.finished
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		msg := &NlMsgParser{data: data, pos: syscall.NLMSG_HDRLEN + SizeofGenlMsghdr}
+		attrs, _ := msg.TakeAttrs()
+		_ = attrs[CTRL_ATTR_FAMILY_NAME]
+	}
+}
+
+func BenchmarkForEachAttr(b *testing.B) {
+	req := NewNlMsgBuilder(RequestFlags, GENL_ID_CTRL)
+	buildBenchmarkMsg(req)
+	data := req.finished
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		msg := NlMsgParser{data: data, pos: syscall.NLMSG_HDRLEN + SizeofGenlMsghdr}
+		var name []byte
+		msg.ForEachAttr(func(typ uint16, val []byte) error {
+			if typ == CTRL_ATTR_FAMILY_NAME {
+				name = val
+			}
+			return nil
+		})
+		_ = name
+	}
+}
+
+func BenchmarkNewBuilderSize(b *testing.B) {
+	req := NewNlMsgBuilder(RequestFlags, GENL_ID_CTRL)
+	buildBenchmarkMsg(req)
+	hint := len(req.finished)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buildBenchmarkMsg(NewNlMsgBuilderSize(RequestFlags, GENL_ID_CTRL, hint))
+	}
+}
+
+func TestNewBuilderSize(t *testing.T) {
+	req := NewNlMsgBuilderSize(RequestFlags, GENL_ID_CTRL, 100)
+	if len(req.buf) != syscall.NLMSG_HDRLEN || cap(req.buf) < 100 {
+		t.Fatal(len(req.buf), cap(req.buf))
+	}
+
+	// Building a message within the hint doesn't reallocate
+	start := &req.buf[0]
+	req.PutSliceAttr(1, make([]byte, 100-syscall.NLMSG_HDRLEN-syscall.SizeofNlAttr))
+	if &req.buf[0] != start {
+		t.Fatal("buffer reallocated")
+	}
+
+	// A hint smaller than the header is ignored
+	req = NewNlMsgBuilderSize(RequestFlags, GENL_ID_CTRL, 0)
+	if len(req.buf) != syscall.NLMSG_HDRLEN {
+		t.Fatal(len(req.buf))
+	}
+}
+
+func TestReleaseBuilder(t *testing.T) {
+	req := GetBuilder(RequestFlags, GENL_ID_CTRL)
+	if h := nlMsghdrAt(req.buf, 0); h.Flags != RequestFlags || h.Type != GENL_ID_CTRL {
+		t.Fatal(h)
+	}
+
+	req.PutStringAttr(1, "stale data")
+	req.Finish()
+	req.Release()
+
+	// The retained buffer is zeroed, up to its capacity
+	if len(req.buf) != syscall.NLMSG_HDRLEN {
+		t.Fatal(len(req.buf))
+	}
+
+	buf := req.buf[:cap(req.buf)]
+	if !AllBytes(buf, 0) {
+		t.Fatal(buf)
+	}
+
+	req = GetBuilder(AckFlags, GENL_ID_CTRL)
+	defer req.Release()
+	if h := nlMsghdrAt(req.buf, 0); h.Flags != AckFlags || len(req.buf) != syscall.NLMSG_HDRLEN {
+		t.Fatal(h)
+	}
+}
+
+func TestReleaseBuilderTwice(t *testing.T) {
+	req := GetBuilder(RequestFlags, GENL_ID_CTRL)
+	req.Release()
+	req.Release()
+
+	// The builder went into the pool only once
+	a := GetBuilder(RequestFlags, GENL_ID_CTRL)
+	defer a.Release()
+	b := GetBuilder(RequestFlags, GENL_ID_CTRL)
+	defer b.Release()
+	if a == b {
+		t.Fatal("builder handed out twice")
+	}
+}
+
+func TestEmptyAttrs(t *testing.T) {
+	req := NewNlMsgBuilder(syscall.NLM_F_REQUEST, GENL_ID_CTRL)
+	req.PutEmptyAttr(1)
+	req.PutUint8Attr(2, 1)
+	req.PutEmptyAttr(3)
+	attrs := finishAndTakeAttrs(t, req)
+
+	// A flag at the end of the message, as well as one before
+	// other attributes, should be present
+	for _, typ := range []uint16{1, 3} {
+		if present, err := attrs.GetEmpty(typ); !present || err != nil {
+			t.Fatal(typ, present, err)
+		}
+	}
+
+	if present, err := attrs.GetEmpty(4); present || err != nil {
+		t.Fatal(present, err)
+	}
+
+	if _, err := attrs.GetEmpty(2); err == nil {
+		t.Fatal("non-empty attribute accepted as a flag")
+	}
+}
+
+func TestFlagAttrs(t *testing.T) {
+	req := NewNlMsgBuilder(syscall.NLM_F_REQUEST, GENL_ID_CTRL)
+	req.PutFlagRtAttr(1)
+	req.PutUint8Attr(2, 1)
+	attrs := finishAndTakeAttrs(t, req)
+
+	if v := attrs[1]; v == nil || len(v) != 0 {
+		t.Fatal(v)
+	}
+
+	// HasFlag only cares about presence
+	if !attrs.HasFlag(1) || !attrs.HasFlag(2) || attrs.HasFlag(3) {
+		t.Fatal(attrs)
+	}
+}
+
+func TestBigEndianAttrs(t *testing.T) {
+	req := NewNlMsgBuilder(syscall.NLM_F_REQUEST, GENL_ID_CTRL)
+	req.PutSliceAttr(1, []byte{0x12, 0x34})
+	req.PutSliceAttr(2, []byte{0x12, 0x34, 0x56, 0x78})
+	req.PutSliceAttr(3, []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0})
+	attrs := finishAndTakeAttrs(t, req)
+
+	if v, err := attrs.GetUint16BE(1); err != nil || v != 0x1234 {
+		t.Fatal(v, err)
+	}
+
+	if v, err := attrs.GetUint32BE(2); err != nil || v != 0x12345678 {
+		t.Fatal(v, err)
+	}
+
+	if v, err := attrs.GetUint64BE(3); err != nil || v != 0x123456789abcdef0 {
+		t.Fatal(v, err)
+	}
+
+	if v, present, err := attrs.GetOptionalUint32BE(2); err != nil || !present || v != 0x12345678 {
+		t.Fatal(v, present, err)
+	}
+
+	if _, present, err := attrs.GetOptionalUint16BE(4); err != nil || present {
+		t.Fatal(present, err)
+	}
+
+	if _, err := attrs.GetUint32BE(1); err == nil {
+		t.Fatal("wrong length accepted")
+	}
+}
+
+func FuzzScalarAttrs(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{1})
+	f.Add([]byte{1, 2, 3})
+	f.Add([]byte{1, 2, 3, 4, 5, 6, 7, 8})
+
+	f.Fuzz(func(t *testing.T, val []byte) {
+		attrs := Attrs{1: val}
+		check := func(size int, err error) {
+			if (err == nil) != (len(val) == size) {
+				t.Fatalf("%d-byte attribute read as %d bytes: %v", len(val), size, err)
+			}
+		}
+
+		_, _, err := attrs.GetOptionalUint8(1)
+		check(1, err)
+		_, err = attrs.GetUint16(1)
+		check(2, err)
+		_, err = attrs.GetUint32(1)
+		check(4, err)
+		_, err = attrs.GetUint64(1)
+		check(8, err)
+		_, err = attrs.GetUint64BE(1)
+		check(8, err)
+	})
+}
+
+func FuzzParseAttrs(f *testing.F) {
+	req := NewNlMsgBuilder(syscall.NLM_F_REQUEST, GENL_ID_CTRL)
+	req.PutUint8Attr(1, 42)
+	req.PutNestedAttrs(2, func() {
+		req.PutStringAttr(1, "abc")
+	})
+	data, _ := req.Finish()
+	f.Add(data[syscall.NLMSG_HDRLEN:])
+	f.Add([]byte{})
+	f.Add([]byte{4, 0, 1})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		attrs, err := ParseNestedAttrs(data)
+		if err != nil {
+			return
+		}
+
+		for typ, val := range attrs {
+			attrs.GetNestedAttrs(typ, false)
+			attrs.GetString(typ)
+			ParseOrderedAttrs(val)
+		}
+	})
+}
+
+func FuzzNlMsghdr(f *testing.F) {
+	req := NewNlMsgBuilder(syscall.NLM_F_REQUEST, GENL_ID_CTRL)
+	req.PutGenlMsghdr(CTRL_CMD_NEWFAMILY, 0)
+	req.PutUint8Attr(1, 42)
+	data, _ := req.Finish()
+	f.Add(data)
+	f.Add(buildExtAckError(NLM_F_ACK_TLVS, syscall.EINVAL, []byte{1, 2, 3, 4}).data)
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		resp := &NlMsgParser{data: data, pos: 0}
+		for {
+			msg, err := resp.nextNlMsg()
+			if msg == nil || err != nil {
+				return
+			}
+
+			if err := msg.checkHeader(); err != nil {
+				continue
+			}
+
+			if _, err := msg.ExpectGenlResponse(GENL_ID_CTRL, CTRL_CMD_NEWFAMILY); err != nil {
+				continue
+			}
+
+			msg.TakeAttrs()
+		}
+	})
+}
+
+func TestMACAttrs(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0x00, 0x5e, 0x10, 0x00, 0x01}
+
+	req := NewNlMsgBuilder(syscall.NLM_F_REQUEST, GENL_ID_CTRL)
+	if err := req.PutMACAttr(1, mac); err != nil {
+		t.Fatal(err)
+	}
+	if err := req.PutMACAttr(2, mac[:4]); err == nil {
+		t.Fatal("short MAC address accepted")
+	}
+	req.PutSliceAttr(3, mac[:4])
+	attrs := finishAndTakeAttrs(t, req)
+
+	if v, err := attrs.GetMAC(1); err != nil || !bytes.Equal(v, mac) {
+		t.Fatal(v, err)
+	}
+
+	if _, err := attrs.GetMAC(2); err == nil {
+		t.Fatal("missing MAC address not reported")
+	}
+
+	if _, err := attrs.GetMAC(3); err == nil {
+		t.Fatal("short MAC address accepted")
+	}
+}
+
+func TestIPAttrs(t *testing.T) {
+	ip4 := net.ParseIP("192.0.2.1")
+	ip6 := net.ParseIP("2001:db8::1")
+
+	req := NewNlMsgBuilder(syscall.NLM_F_REQUEST, GENL_ID_CTRL)
+	if err := req.PutIPv4Attr(1, ip4); err != nil {
+		t.Fatal(err)
+	}
+	if err := req.PutIPv6Attr(2, ip6); err != nil {
+		t.Fatal(err)
+	}
+	if err := req.PutIPv4Attr(3, ip6); err == nil {
+		t.Fatal("IPv6 address accepted as IPv4")
+	}
+	if err := req.PutIPv6Attr(4, ip4); err == nil {
+		t.Fatal("IPv4 address accepted as IPv6")
+	}
+	attrs := finishAndTakeAttrs(t, req)
+
+	// Network byte order, whatever the host byte order
+	if v := attrs[1]; !bytes.Equal(v, []byte{192, 0, 2, 1}) {
+		t.Fatal(v)
+	}
+
+	if v, err := attrs.GetUint32BE(1); err != nil || v != 0xc0000201 {
+		t.Fatal(v, err)
+	}
+
+	if v, err := attrs.GetIPv4(1); err != nil || !v.Equal(ip4) {
+		t.Fatal(v, err)
+	}
+
+	if v := attrs[2]; v[0] != 0x20 || v[1] != 0x01 || v[15] != 1 {
+		t.Fatal(v)
+	}
+
+	if v, err := attrs.GetIPv6(2); err != nil || !v.Equal(ip6) {
+		t.Fatal(v, err)
+	}
+
+	if _, err := attrs.GetIPv4(2); err == nil {
+		t.Fatal("IPv6 address accepted as IPv4")
+	}
+
+	if _, err := attrs.GetIPv6(1); err == nil {
+		t.Fatal("IPv4 address accepted as IPv6")
+	}
+}
+
+func TestGenlFamilyVersion(t *testing.T) {
+	sock := openTestSocket(t)
+	defer checkedCloseSocket(sock, t)
+
+	family, err := sock.LookupGenlFamily("nlctrl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if family.Version() < 1 {
+		t.Fatal(family.Version())
+	}
+}
@@ -1,7 +1,10 @@
 package odp
 
 import (
+	"fmt"
 	"sync"
+	"sync/atomic"
+	"syscall"
 )
 
 type MissConsumer interface {
@@ -9,7 +12,30 @@ type MissConsumer interface {
 	Error(err error, stopped bool)
 }
 
-func (origDP DatapathHandle) ConsumeMisses(consumer MissConsumer) (Cancelable, error) {
+// A MissConsumer that also implements ActionUpcallConsumer receives
+// the upcalls produced by UserspaceActions, along with their
+// userdata.  Otherwise, those upcalls are discarded.
+type ActionUpcallConsumer interface {
+	ActionUpcall(packet []byte, flowKeys FlowKeys, userdata []byte) error
+}
+
+type Upcall struct {
+	// OVS_PACKET_CMD_MISS or OVS_PACKET_CMD_ACTION
+	Cmd      uint8
+	Packet   []byte
+	FlowKeys FlowKeys
+
+	// Only present for OVS_PACKET_CMD_ACTION upcalls
+	Userdata []byte
+}
+
+func (origDP DatapathHandle) ConsumeMisses(consumer MissConsumer) (MissConsumerHandle, error) {
+	return origDP.consumeMissesWith(consumer, nil)
+}
+
+// Like ConsumeMisses, but calling setup, if non-nil, on the socket
+// that receives the upcalls before consuming starts.
+func (origDP DatapathHandle) consumeMissesWith(consumer MissConsumer, setup func(*NetlinkSocket) error) (MissConsumerHandle, error) {
 	// We end up needing 3 netlink sockets: one to consume
 	// misses, one to consume vport events, and one for general
 	// use.
@@ -36,6 +62,12 @@ func (origDP DatapathHandle) ConsumeMisses(consumer MissConsumer) (Cancelable, e
 		}
 	}()
 
+	if setup != nil {
+		if err := setup(missDP.dpif.sock); err != nil {
+			return nil, err
+		}
+	}
+
 	// We need to set the upcall port ID on all vports.  That
 	// includes vports that get added while we are listening, so
 	// we need to listen for them too.
@@ -120,40 +152,309 @@ func (c *missVportConsumer) Error(err error, stopped bool) {
 	c.missConsumer.Error(err, stopped)
 }
 
+func (dp DatapathHandle) parseUpcall(msg *NlMsgParser) (res Upcall, err error) {
+	genlhdr, ovshdr, err := dp.dpif.checkNlMsgHeaders(msg, PACKET, -1)
+	if err != nil {
+		return
+	}
+
+	if ovshdr.DpIfIndex != dp.ifindex {
+		err = fmt.Errorf("wrong datapath ifindex received (got %d, expected %d)", ovshdr.DpIfIndex, dp.ifindex)
+		return
+	}
+
+	res.Cmd = genlhdr.Cmd
+	if res.Cmd != OVS_PACKET_CMD_MISS && res.Cmd != OVS_PACKET_CMD_ACTION {
+		err = fmt.Errorf("unexpected packet command %d", res.Cmd)
+		return
+	}
+
+	attrs, err := msg.TakeAttrs()
+	if err != nil {
+		return
+	}
+
+	res.Packet, err = attrs.Get(OVS_PACKET_ATTR_PACKET, false)
+	if err != nil {
+		return
+	}
+
+	fkattrs, err := attrs.GetNestedAttrs(OVS_PACKET_ATTR_KEY, false)
+	if err != nil {
+		return
+	}
+
+	res.FlowKeys, err = ParseFlowKeys(fkattrs, nil)
+	if err != nil {
+		return
+	}
+
+	res.Userdata, err = attrs.Get(OVS_PACKET_ATTR_USERDATA, true)
+	return
+}
+
+// Implemented by consumers that take whole upcalls, such as the one
+// behind UpcallReader.  Their upcalls are received into a reused
+// buffer, and each message is copied out of it before being parsed
+// and delivered to upcall rather than to Miss or ActionUpcall.
+type upcallKeeper interface {
+	upcall(Upcall) error
+}
+
+// Decode a packet upcall (OVS_PACKET_CMD_MISS or
+// OVS_PACKET_CMD_ACTION) for the datapath, for callers that receive
+// upcalls themselves, e.g. with Recv on a socket whose port id they
+// set with SetVportUpcallPortIds.  data is the received datagram; only
+// its first message is decoded.  The Upcall's slices refer to data.
+func (dp DatapathHandle) ConsumePacket(data []byte) (*Upcall, error) {
+	msg, err := (&NlMsgParser{data: data, pos: 0}).nextNlMsg()
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, fmt.Errorf("netlink upcall message missing")
+	}
+
+	if err := msg.checkHeader(); err != nil {
+		return nil, err
+	}
+
+	upcall, err := dp.parseUpcall(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &upcall, nil
+}
+
 func (dp DatapathHandle) consumeMisses(consumer MissConsumer, vportConsumer *missVportConsumer) {
-	dp.dpif.sock.consume(consumer, func(msg *NlMsgParser) error {
-		if err := dp.checkNlMsgHeaders(msg, PACKET, OVS_PACKET_CMD_MISS); err != nil {
-			return err
-		}
+	actionConsumer, _ := consumer.(ActionUpcallConsumer)
+	keeper, _ := consumer.(upcallKeeper)
+
+	// Keepers get a copy of each message, so only they can share
+	// a receive buffer.  Other consumers may hold on to the
+	// slices passed to them.
+	var buf []byte
+	if keeper != nil {
+		buf = MakeAlignedByteSlice(syscall.Getpagesize())
+	}
 
-		attrs, err := msg.TakeAttrs()
-		if err != nil {
-			return err
+	dp.dpif.sock.consume(consumer, buf, func(msg *NlMsgParser) error {
+		if keeper != nil {
+			data := MakeAlignedByteSlice(len(msg.data) - msg.pos)
+			copy(data, msg.data[msg.pos:])
+			msg = &NlMsgParser{data: data, pos: 0}
 		}
 
-		fkattrs, err := attrs.GetNestedAttrs(OVS_PACKET_ATTR_KEY, false)
+		upcall, err := dp.parseUpcall(msg)
 		if err != nil {
 			return err
 		}
 
-		fks, err := ParseFlowKeys(fkattrs, nil)
-		if err != nil {
-			return err
+		if keeper != nil {
+			return keeper.upcall(upcall)
 		}
 
-		return consumer.Miss(attrs[OVS_PACKET_ATTR_PACKET], fks)
+		switch upcall.Cmd {
+		case OVS_PACKET_CMD_ACTION:
+			if actionConsumer == nil {
+				return nil
+			}
+
+			return actionConsumer.ActionUpcall(upcall.Packet, upcall.FlowKeys, upcall.Userdata)
+
+		default:
+			return consumer.Miss(upcall.Packet, upcall.FlowKeys)
+		}
 	})
 
 	vportConsumer.cancel.Cancel()
 	vportConsumer.dp.dpif.Close()
 }
 
+// An UpcallReader receives a datapath's upcalls on a socket of its
+// own, served by its own goroutine, and delivers them on a channel.
+// The kernel doesn't multicast packet upcalls, so there is no group
+// to join: They are unicast to the upcall port ids of the vports the
+// packets arrived on, so the reader sets its socket's port id on all
+// the datapath's vports, including ones added later, as
+// ConsumeMisses does.
+//
+// If the reader falls behind, the socket's receive buffer fills up
+// and the kernel drops upcalls.  The reader counts those drops (see
+// Stats) and carries on.
+type UpcallReader struct {
+	// Accessed atomically, so kept first for 64-bit alignment
+	drops  uint64
+	errors uint64
+
+	packets   chan *Upcall
+	done      chan struct{}
+	closeDone sync.Once
+
+	lock    sync.Mutex
+	handle  MissConsumerHandle
+	stopped bool
+	err     error
+}
+
+// How many upcalls the Packets channel buffers
+const upcallReaderQueue = 64
+
+// Counters for an UpcallReader.  Drops counts the socket overruns
+// reported by the kernel, each of which means that one or more
+// upcalls were lost.  Errors counts upcalls that could not be
+// parsed, and other errors that did not stop the reader.  Socket
+// holds the counters of the reader's socket.
+type UpcallReaderStats struct {
+	Drops  uint64
+	Errors uint64
+	Socket SocketStats
+}
+
+func newUpcallReader() *UpcallReader {
+	return &UpcallReader{
+		packets: make(chan *Upcall, upcallReaderQueue),
+		done:    make(chan struct{}),
+	}
+}
+
+func (dp DatapathHandle) NewUpcallReader() (*UpcallReader, error) {
+	r := newUpcallReader()
+	handle, err := dp.consumeMissesWith(upcallReaderConsumer{r}, func(sock *NetlinkSocket) error {
+		// Have the kernel report overruns, so they can be
+		// counted
+		return sock.SetNoENOBUFS(false)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	r.handle = handle
+	stopped := r.stopped
+	r.lock.Unlock()
+
+	if stopped {
+		// A fatal error arrived before we got the handle
+		handle.Cancel()
+	}
+
+	return r, nil
+}
+
+// The channel on which upcalls are delivered.  It is closed when the
+// reader stops, either due to Close or to an error (see Err).
+func (r *UpcallReader) Packets() <-chan *Upcall {
+	return r.packets
+}
+
+func (r *UpcallReader) Close() error {
+	return r.stop(nil)
+}
+
+// The error that stopped the reader, or nil if it was stopped by
+// Close or is still running.
+func (r *UpcallReader) Err() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.err
+}
+
+func (r *UpcallReader) Stats() UpcallReaderStats {
+	stats := UpcallReaderStats{
+		Drops:  atomic.LoadUint64(&r.drops),
+		Errors: atomic.LoadUint64(&r.errors),
+	}
+
+	r.lock.Lock()
+	handle := r.handle
+	r.lock.Unlock()
+
+	if handle != nil {
+		stats.Socket = handle.SocketStats()
+	}
+
+	return stats
+}
+
+func (r *UpcallReader) stop(err error) error {
+	// Wake up a deliver blocked on a full channel, so that it
+	// releases the lock
+	r.closeDone.Do(func() { close(r.done) })
+
+	r.lock.Lock()
+	if r.stopped {
+		r.lock.Unlock()
+		return nil
+	}
+
+	r.stopped = true
+	r.err = err
+	close(r.packets)
+	handle := r.handle
+	r.lock.Unlock()
+
+	if handle == nil {
+		return nil
+	}
+
+	return handle.Cancel()
+}
+
+func (r *UpcallReader) deliver(upcall *Upcall) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.stopped {
+		return
+	}
+
+	select {
+	case r.packets <- upcall:
+	case <-r.done:
+	}
+}
+
+// The consumer behind an UpcallReader, kept separate so that its
+// methods are not part of UpcallReader's API.
+type upcallReaderConsumer struct {
+	r *UpcallReader
+}
+
+func (c upcallReaderConsumer) upcall(upcall Upcall) error {
+	c.r.deliver(&upcall)
+	return nil
+}
+
+// Not called, as consumeMisses delivers to upcall instead, but
+// needed to be a MissConsumer.
+func (c upcallReaderConsumer) Miss(packet []byte, flowKeys FlowKeys) error {
+	return c.upcall(Upcall{Cmd: OVS_PACKET_CMD_MISS, Packet: packet, FlowKeys: flowKeys})
+}
+
+func (c upcallReaderConsumer) Error(err error, stopped bool) {
+	switch {
+	case IsSocketOverrunError(err):
+		atomic.AddUint64(&c.r.drops, 1)
+
+	case !stopped:
+		atomic.AddUint64(&c.r.errors, 1)
+
+	default:
+		c.r.stop(err)
+	}
+}
+
+// Execute actions on a packet, e.g. to re-inject a packet received
+// in an upcall.  This waits for the kernel's ack, so errors in the
+// packet, keys or actions are reported.
 func (dp DatapathHandle) Execute(packet []byte, keys FlowKeys, actions []Action) error {
 	dpif := dp.dpif
 
-	req := NewNlMsgBuilder(RequestFlags, dpif.families[PACKET].id)
+	req := NewNlMsgBuilder(AckFlags, dpif.families[PACKET].id)
 	req.PutGenlMsghdr(OVS_PACKET_CMD_EXECUTE, OVS_PACKET_VERSION)
-	req.putOvsHeader(dp.ifindex)
+	req.PutOvsHeader(dp.ifindex)
 	req.PutSliceAttr(OVS_PACKET_ATTR_PACKET, packet)
 
 	req.PutNestedAttrs(OVS_PACKET_ATTR_KEY, func() {
@@ -168,6 +469,5 @@ func (dp DatapathHandle) Execute(packet []byte, keys FlowKeys, actions []Action)
 		}
 	})
 
-	_, err := dpif.sock.send(req)
-	return err
+	return dpif.sock.RequestAck(req)
 }
@@ -0,0 +1,154 @@
+package odp
+
+import (
+	"bytes"
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func buildUpcall(cmd uint8, ifindex int32, packet []byte, fks FlowKeys, userdata []byte) *NlMsgParser {
+	msg := NewNlMsgBuilder(0, 0)
+	msg.PutGenlMsghdr(cmd, OVS_PACKET_VERSION)
+	msg.PutOvsHeader(ifindex)
+	msg.PutSliceAttr(OVS_PACKET_ATTR_PACKET, packet)
+	msg.PutNestedAttrs(OVS_PACKET_ATTR_KEY, func() {
+		for _, k := range fks {
+			k.putKeyNlAttr(msg)
+		}
+	})
+	if userdata != nil {
+		msg.PutSliceAttr(OVS_PACKET_ATTR_USERDATA, userdata)
+	}
+	data, _ := msg.Finish()
+	return &NlMsgParser{data: data, pos: 0}
+}
+
+func TestParseUpcall(t *testing.T) {
+	dp := DatapathHandle{dpif: &Dpif{}, ifindex: 7}
+	packet := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	fks := MakeFlowKeys()
+	fks.Add(NewInPortFlowKey(3))
+	fks.Add(NewEthernetFlowKey())
+
+	upcall, err := dp.parseUpcall(buildUpcall(OVS_PACKET_CMD_ACTION, 7, packet, fks, []byte{42}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if upcall.Cmd != OVS_PACKET_CMD_ACTION || !bytes.Equal(upcall.Packet, packet) || !upcall.FlowKeys.Equals(fks) || !bytes.Equal(upcall.Userdata, []byte{42}) {
+		t.Fatal(upcall)
+	}
+
+	upcall, err = dp.parseUpcall(buildUpcall(OVS_PACKET_CMD_MISS, 7, packet, fks, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if upcall.Cmd != OVS_PACKET_CMD_MISS || upcall.Userdata != nil {
+		t.Fatal(upcall)
+	}
+
+	if _, err := dp.parseUpcall(buildUpcall(OVS_PACKET_CMD_MISS, 8, packet, fks, nil)); err == nil {
+		t.Fatal("upcall for another datapath accepted")
+	}
+
+	if _, err := dp.parseUpcall(buildUpcall(OVS_PACKET_CMD_EXECUTE, 7, packet, fks, nil)); err == nil {
+		t.Fatal("non-upcall packet command accepted")
+	}
+}
+
+func TestConsumePacket(t *testing.T) {
+	dp := DatapathHandle{dpif: &Dpif{}, ifindex: 7}
+	packet := []byte{1, 2, 3, 4}
+	fks := MakeFlowKeys()
+	fks.Add(NewInPortFlowKey(3))
+
+	msg := buildUpcall(OVS_PACKET_CMD_ACTION, 7, packet, fks, []byte{42})
+	upcall, err := dp.ConsumePacket(msg.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if upcall.Cmd != OVS_PACKET_CMD_ACTION || !bytes.Equal(upcall.Packet, packet) || !upcall.FlowKeys.Equals(fks) || !bytes.Equal(upcall.Userdata, []byte{42}) {
+		t.Fatal(upcall)
+	}
+
+	if _, err := dp.ConsumePacket(msg.data[:10]); err == nil {
+		t.Fatal("truncated upcall accepted")
+	}
+
+	if _, err := dp.ConsumePacket(nil); err == nil {
+		t.Fatal("empty datagram accepted")
+	}
+}
+
+func TestMissConsumerHandleStats(t *testing.T) {
+	sock := openTestSocket(t)
+	var handle MissConsumerHandle = cancelableDpif{&Dpif{sock: sock}}
+
+	if _, err := sock.LookupGenlFamily("nlctrl"); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := handle.SocketStats(); stats != sock.Stats() || stats.Sent != 1 || stats.Received != 1 {
+		t.Fatal(stats)
+	}
+
+	if err := handle.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpcallReader(t *testing.T) {
+	r := newUpcallReader()
+	c := upcallReaderConsumer{r}
+
+	if err := c.upcall(Upcall{Cmd: OVS_PACKET_CMD_MISS, Packet: []byte{1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if upcall := <-r.Packets(); upcall.Cmd != OVS_PACKET_CMD_MISS || !bytes.Equal(upcall.Packet, []byte{1}) {
+		t.Fatal(upcall)
+	}
+
+	// Overruns and other non-fatal errors are counted, and
+	// don't stop the reader
+	c.Error(syscall.ENOBUFS, false)
+	c.Error(syscall.ENOBUFS, false)
+	c.Error(errors.New("bad upcall"), false)
+	if stats := r.Stats(); stats.Drops != 2 || stats.Errors != 1 {
+		t.Fatal(stats)
+	}
+
+	// A fatal error closes the channel, even with a deliver
+	// blocked on it being full
+	for i := 0; i < upcallReaderQueue; i++ {
+		c.upcall(Upcall{})
+	}
+
+	delivered := make(chan struct{})
+	go func() {
+		c.upcall(Upcall{})
+		close(delivered)
+	}()
+
+	fatal := errors.New("fatal")
+	c.Error(fatal, true)
+	<-delivered
+
+	n := 0
+	for range r.Packets() {
+		n++
+	}
+
+	if n > upcallReaderQueue+1 || r.Err() != fatal {
+		t.Fatal(n, r.Err())
+	}
+
+	// Stopping again is harmless
+	c.Error(errors.New("later"), true)
+	if err := r.Close(); err != nil || r.Err() != fatal {
+		t.Fatal(err, r.Err())
+	}
+}
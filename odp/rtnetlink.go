@@ -0,0 +1,82 @@
+package odp
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func (nlmsg *NlMsgBuilder) putIfInfomsg(index int32, flags uint32, change uint32) {
+	pos := nlmsg.nlmsgAlignGrow(syscall.SizeofIfInfomsg)
+	ifi := ifInfomsgAt(nlmsg.buf, pos)
+	ifi.Family = syscall.AF_UNSPEC
+	ifi.Index = index
+	ifi.Flags = flags
+	ifi.Change = change
+}
+
+// Set the IFF_UP flag on the named network interface, as "ip link
+// set <ifname> up" does.
+func SetLinkUp(ifname string) error {
+	return setLinkFlags(ifname, OpenNetlinkSocket, syscall.IFF_UP, syscall.IFF_UP)
+}
+
+// Like SetLinkUp, but for an interface in the network namespace
+// referred to by nsFd (as for OpenNetlinkSocketInNetns).
+func SetLinkUpInNetns(ifname string, nsFd int) error {
+	return setLinkFlags(ifname, inNetns(nsFd), syscall.IFF_UP, syscall.IFF_UP)
+}
+
+func inNetns(nsFd int) func(int) (*NetlinkSocket, error) {
+	return func(protocol int) (*NetlinkSocket, error) {
+		return OpenNetlinkSocketInNetns(protocol, nsFd)
+	}
+}
+
+// open opens the rtnetlink socket, in the relevant network namespace
+func setLinkFlags(ifname string, open func(int) (*NetlinkSocket, error), flags uint32, change uint32) error {
+	sock, err := open(syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer sock.Close()
+
+	// With a zero ifindex, the kernel finds the interface by
+	// IFLA_IFNAME.  Without NLM_F_CREATE, RTM_NEWLINK fails with
+	// ENODEV rather than creating a missing interface.
+	req := NewNlMsgBuilder(AckFlags, syscall.RTM_NEWLINK)
+	req.putIfInfomsg(0, flags, change)
+	req.PutStringAttr(syscall.IFLA_IFNAME, ifname)
+
+	return sock.RequestAck(req)
+}
+
+func IsNoSuchLinkError(err error) bool {
+	return isNetlinkError(err, syscall.ENODEV)
+}
+
+// Bring up the network device backing the vport.  Internal vports
+// get a device named after the vport; netdev vports are attached to
+// an existing device of that name.  For vports without a device of
+// their own name, the error satisfies IsNoSuchLinkError.
+func (v Vport) SetLinkUp() error {
+	return v.setLinkUp(OpenNetlinkSocket)
+}
+
+// Like SetLinkUp, for a vport whose device is in the network namespace
+// referred to by nsFd, e.g. because the datapath was created through
+// a socket opened by OpenNetlinkSocketInNetns.
+func (v Vport) SetLinkUpInNetns(nsFd int) error {
+	return v.setLinkUp(inNetns(nsFd))
+}
+
+func (v Vport) setLinkUp(open func(int) (*NetlinkSocket, error)) error {
+	name := v.Spec.Name()
+	if err := setLinkFlags(name, open, syscall.IFF_UP, syscall.IFF_UP); err != nil {
+		if IsNoSuchLinkError(err) {
+			return fmt.Errorf("no network device for %s vport %q: %w", v.Spec.TypeName(), name, err)
+		}
+		return err
+	}
+
+	return nil
+}
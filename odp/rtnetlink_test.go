@@ -0,0 +1,42 @@
+package odp
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestSetLinkUp(t *testing.T) {
+	if err := SetLinkUp("lo"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetLinkUp("nonexistent0"); !IsNoSuchLinkError(err) {
+		t.Fatal(err)
+	}
+
+	vport := Vport{Spec: NewNetdevVportSpec("nonexistent0")}
+	if err := vport.SetLinkUp(); !IsNoSuchLinkError(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestSetLinkUpInNetns(t *testing.T) {
+	nsFd, err := syscall.Open("/proc/self/ns/net", syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer syscall.Close(nsFd)
+
+	if err := SetLinkUpInNetns("lo", nsFd); err != nil {
+		t.Fatal(err)
+	}
+
+	vport := Vport{Spec: NewNetdevVportSpec("nonexistent0")}
+	if err := vport.SetLinkUpInNetns(nsFd); !IsNoSuchLinkError(err) {
+		t.Fatal(err)
+	}
+
+	if err := SetLinkUpInNetns("lo", -1); err == nil {
+		t.Fatal("expected error for bad namespace fd")
+	}
+}
@@ -0,0 +1,4 @@
+package odp
+
+// The syscall package lacks SYS_SETNS on 386
+const sysSetns = 346
@@ -1,6 +1,9 @@
 package odp
 
-import "syscall"
+import (
+	"syscall"
+	"unsafe"
+)
 
 // from linux/include/linux/socket.h
 const SOL_NETLINK = 270
@@ -80,9 +83,30 @@ const ( // ovs_datapath_attr
 	OVS_DP_ATTR_USER_FEATURES  = 5
 )
 
+type OvsDpStats struct {
+	NHit    uint64
+	NMissed uint64
+	NLost   uint64
+	NFlows  uint64
+}
+
+const SizeofOvsDpStats = 32
+
+type OvsDpMegaflowStats struct {
+	NMaskHit  uint64
+	NMasks    uint32
+	Pad0      uint32
+	NCacheHit uint64
+	Pad1      uint64
+}
+
+const SizeofOvsDpMegaflowStats = 32
+
 const (
-	OVS_DP_F_UNALIGNED  = 1
-	OVS_DP_F_VPORT_PIDS = 2
+	OVS_DP_F_UNALIGNED               = 1
+	OVS_DP_F_VPORT_PIDS              = 2
+	OVS_DP_F_TC_RECIRC_SHARING       = 4
+	OVS_DP_F_DISPATCH_UPCALL_PER_CPU = 8
 )
 
 const ( // ovs_vport_cmd
@@ -103,12 +127,30 @@ const ( // ovs_vport_attr
 	OVS_VPORT_ATTR_STATS      = 6
 )
 
+type OvsVportStats struct {
+	RxPackets uint64
+	TxPackets uint64
+	RxBytes   uint64
+	TxBytes   uint64
+	RxErrors  uint64
+	TxErrors  uint64
+	RxDropped uint64
+	TxDropped uint64
+}
+
+const SizeofOvsVportStats = 64
+
 const ( // ovs_vport_type
 	OVS_VPORT_TYPE_UNSPEC   = 0
 	OVS_VPORT_TYPE_NETDEV   = 1
 	OVS_VPORT_TYPE_INTERNAL = 2
 	OVS_VPORT_TYPE_GRE      = 3
 	OVS_VPORT_TYPE_VXLAN    = 4
+	OVS_VPORT_TYPE_GENEVE   = 5
+
+	// Only in the out-of-tree openvswitch module
+	OVS_VPORT_TYPE_LISP = 105
+	OVS_VPORT_TYPE_STT  = 106
 )
 
 const ( // OVS_VPORT_ATTR_OPTIONS attributes for tunnels
@@ -164,8 +206,26 @@ const ( // ovs_key_attr
 	OVS_KEY_ATTR_TCP_FLAGS = 18
 	OVS_KEY_ATTR_DP_HASH   = 19
 	OVS_KEY_ATTR_RECIRC_ID = 20
+	OVS_KEY_ATTR_MPLS      = 21
+	OVS_KEY_ATTR_CT_STATE  = 22
+	OVS_KEY_ATTR_CT_ZONE   = 23
+	OVS_KEY_ATTR_CT_MARK   = 24
+	OVS_KEY_ATTR_CT_LABELS = 25
+)
+
+const ( // OVS_KEY_ATTR_CT_STATE bits
+	OVS_CS_F_NEW         = 0x01
+	OVS_CS_F_ESTABLISHED = 0x02
+	OVS_CS_F_RELATED     = 0x04
+	OVS_CS_F_REPLY_DIR   = 0x08
+	OVS_CS_F_INVALID     = 0x10
+	OVS_CS_F_TRACKED     = 0x20
+	OVS_CS_F_SRC_NAT     = 0x40
+	OVS_CS_F_DST_NAT     = 0x80
 )
 
+const OVS_CT_LABELS_LEN = 16
+
 const ( // ovs_tunnel_key_attr
 	OVS_TUNNEL_KEY_ATTR_ID            = 0
 	OVS_TUNNEL_KEY_ATTR_IPV4_SRC      = 1
@@ -189,6 +249,17 @@ type OvsKeyEthernet struct {
 
 const SizeofOvsKeyEthernet = 12
 
+type OvsKeyIPv4 struct {
+	Src   [4]byte
+	Dst   [4]byte
+	Proto uint8
+	Tos   uint8
+	Ttl   uint8
+	Frag  uint8
+}
+
+const SizeofOvsKeyIPv4 = 12
+
 const ( // ovs_action_attr
 	OVS_ACTION_ATTR_UNSPEC    = 0
 	OVS_ACTION_ATTR_OUTPUT    = 1
@@ -197,6 +268,54 @@ const ( // ovs_action_attr
 	OVS_ACTION_ATTR_PUSH_VLAN = 4
 	OVS_ACTION_ATTR_POP_VLAN  = 5
 	OVS_ACTION_ATTR_SAMPLE    = 6
+	OVS_ACTION_ATTR_RECIRC    = 7
+	OVS_ACTION_ATTR_HASH      = 8
+	OVS_ACTION_ATTR_PUSH_MPLS = 9
+	OVS_ACTION_ATTR_POP_MPLS  = 10
+	OVS_ACTION_ATTR_CT        = 12
+)
+
+const ( // ovs_userspace_attr
+	OVS_USERSPACE_ATTR_UNSPEC   = 0
+	OVS_USERSPACE_ATTR_PID      = 1
+	OVS_USERSPACE_ATTR_USERDATA = 2
+)
+
+const ( // ovs_sample_attr
+	OVS_SAMPLE_ATTR_UNSPEC      = 0
+	OVS_SAMPLE_ATTR_PROBABILITY = 1
+	OVS_SAMPLE_ATTR_ACTIONS     = 2
+)
+
+const ( // ovs_hash_alg
+	OVS_HASH_ALG_L4     = 0
+	OVS_HASH_ALG_SYM_L4 = 1
+)
+
+const ( // ovs_ct_attr
+	OVS_CT_ATTR_UNSPEC       = 0
+	OVS_CT_ATTR_COMMIT       = 1
+	OVS_CT_ATTR_ZONE         = 2
+	OVS_CT_ATTR_MARK         = 3
+	OVS_CT_ATTR_LABELS       = 4
+	OVS_CT_ATTR_HELPER       = 5
+	OVS_CT_ATTR_NAT          = 6
+	OVS_CT_ATTR_FORCE_COMMIT = 7
+	OVS_CT_ATTR_EVENTMASK    = 8
+	OVS_CT_ATTR_TIMEOUT      = 9
+)
+
+const ( // ovs_nat_attr
+	OVS_NAT_ATTR_UNSPEC       = 0
+	OVS_NAT_ATTR_SRC          = 1
+	OVS_NAT_ATTR_DST          = 2
+	OVS_NAT_ATTR_IP_MIN       = 3
+	OVS_NAT_ATTR_IP_MAX       = 4
+	OVS_NAT_ATTR_PROTO_MIN    = 5
+	OVS_NAT_ATTR_PROTO_MAX    = 6
+	OVS_NAT_ATTR_PERSISTENT   = 7
+	OVS_NAT_ATTR_PROTO_HASH   = 8
+	OVS_NAT_ATTR_PROTO_RANDOM = 9
 )
 
 const ( // ovs_packet_cmd
@@ -214,7 +333,76 @@ const ( // ovs_packet_attr
 	OVS_PACKET_ATTR_USERDATA = 4
 )
 
+// from linux/include/linux/if_vlan.h
+const (
+	VLAN_PRIO_MASK  = 0xe000
+	VLAN_PRIO_SHIFT = 13
+	VLAN_CFI_MASK   = 0x1000
+	VLAN_VID_MASK   = 0x0fff
+)
+
+// from linux/include/uapi/linux/mpls.h
+const (
+	MPLS_LS_LABEL_MASK  = 0xfffff000
+	MPLS_LS_LABEL_SHIFT = 12
+	MPLS_LS_TC_MASK     = 0x00000e00
+	MPLS_LS_TC_SHIFT    = 9
+	MPLS_LS_S_MASK      = 0x00000100
+	MPLS_LS_S_SHIFT     = 8
+	MPLS_LS_TTL_MASK    = 0x000000ff
+)
+
+// The most label stack entries an MPLS flow key can hold (from
+// linux/net/openvswitch/flow.h)
+const MPLS_LABEL_DEPTH = 3
+
+const (
+	ETH_P_8021Q   = 0x8100
+	ETH_P_MPLS_UC = 0x8847
+	ETH_P_MPLS_MC = 0x8848
+)
+
 type ifreqIfindex struct {
 	name    [syscall.IFNAMSIZ]byte
 	ifindex int32
 }
+
+// from linux/include/uapi/linux/netlink.h
+const (
+	NLM_F_CAPPED   = 0x100
+	NLM_F_ACK_TLVS = 0x200
+)
+
+const NETLINK_EXT_ACK = 11
+
+const ( // nlmsgerr_attrs
+	NLMSGERR_ATTR_UNUSED = 0
+	NLMSGERR_ATTR_MSG    = 1
+	NLMSGERR_ATTR_OFFS   = 2
+	NLMSGERR_ATTR_COOKIE = 3
+)
+
+// from linux/include/uapi/asm-generic/poll.h
+type pollFd struct {
+	fd      int32
+	events  int16
+	revents int16
+}
+
+const POLLIN = 0x1
+
+// from linux/include/uapi/linux/time.h
+const CLOCK_MONOTONIC = 1
+
+// monotonicMillis returns the current time in milliseconds on the
+// kernel's CLOCK_MONOTONIC, the clock used for OVS_FLOW_ATTR_USED.
+func monotonicMillis() (uint64, error) {
+	var ts syscall.Timespec
+	_, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME,
+		CLOCK_MONOTONIC, uintptr(unsafe.Pointer(&ts)), 0)
+	if errno != 0 {
+		return 0, errno
+	}
+
+	return uint64(ts.Sec)*1000 + uint64(ts.Nsec)/1000000, nil
+}
@@ -40,6 +40,13 @@ func int32At(data []byte, pos int) *int32 {
 	return (*int32)(unsafe.Pointer(&data[pos]))
 }
 
+// For the few multi-byte values that are handled as bytes but are
+// integers in host byte order, such as ct_label
+var hostLittleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
 func uint64At(data []byte, pos int) *uint64 {
 	return (*uint64)(unsafe.Pointer(&data[pos]))
 }
@@ -60,6 +67,10 @@ func genlMsghdrAt(data []byte, pos int) *GenlMsghdr {
 	return (*GenlMsghdr)(unsafe.Pointer(&data[pos]))
 }
 
+func ifInfomsgAt(data []byte, pos int) *syscall.IfInfomsg {
+	return (*syscall.IfInfomsg)(unsafe.Pointer(&data[pos]))
+}
+
 func ovsHeaderAt(data []byte, pos int) *OvsHeader {
 	return (*OvsHeader)(unsafe.Pointer(&data[pos]))
 }
@@ -68,6 +79,22 @@ func ovsKeyEthernetAt(data []byte, pos int) *OvsKeyEthernet {
 	return (*OvsKeyEthernet)(unsafe.Pointer(&data[pos]))
 }
 
+func ovsDpStatsAt(data []byte, pos int) *OvsDpStats {
+	return (*OvsDpStats)(unsafe.Pointer(&data[pos]))
+}
+
+func ovsDpMegaflowStatsAt(data []byte, pos int) *OvsDpMegaflowStats {
+	return (*OvsDpMegaflowStats)(unsafe.Pointer(&data[pos]))
+}
+
+func ovsVportStatsAt(data []byte, pos int) *OvsVportStats {
+	return (*OvsVportStats)(unsafe.Pointer(&data[pos]))
+}
+
+func ovsKeyIPv4At(data []byte, pos int) *OvsKeyIPv4 {
+	return (*OvsKeyIPv4)(unsafe.Pointer(&data[pos]))
+}
+
 func ovsFlowStatsAt(data []byte, pos int) *OvsFlowStats {
 	return (*OvsFlowStats)(unsafe.Pointer(&data[pos]))
 }
@@ -80,3 +107,34 @@ func uint16FromBE(n uint16) uint16 {
 func uint16ToBE(n uint16) uint16 {
 	return uint16FromBE(n)
 }
+
+func uint32FromBE(n uint32) uint32 {
+	a := (*[4]byte)(unsafe.Pointer(&n))
+	return uint32(a[0])<<24 + uint32(a[1])<<16 + uint32(a[2])<<8 + uint32(a[3])
+}
+
+func uint32ToBE(n uint32) uint32 {
+	return uint32FromBE(n)
+}
+
+func uint64FromBE(n uint64) uint64 {
+	a := (*[8]byte)(unsafe.Pointer(&n))
+	return uint64(a[0])<<56 + uint64(a[1])<<48 + uint64(a[2])<<40 + uint64(a[3])<<32 +
+		uint64(a[4])<<24 + uint64(a[5])<<16 + uint64(a[6])<<8 + uint64(a[7])
+}
+
+func uint64ToBE(n uint64) uint64 {
+	return uint64FromBE(n)
+}
+
+// A nil timeout means waiting indefinitely.  The result is the number
+// of fds with events, so 0 if the timeout expired.
+func ppoll(fds []pollFd, timeout *syscall.Timespec) (int, error) {
+	n, _, errno := syscall.Syscall6(syscall.SYS_PPOLL,
+		uintptr(unsafe.Pointer(&fds[0])), uintptr(len(fds)),
+		uintptr(unsafe.Pointer(timeout)), 0, 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
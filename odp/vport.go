@@ -5,6 +5,37 @@ import (
 	"syscall"
 )
 
+// The OVS_VPORT_TYPE_* vport types, with their names as used by OVS.
+type VportType uint32
+
+var vportTypeNames = map[VportType]string{
+	OVS_VPORT_TYPE_NETDEV:   "netdev",
+	OVS_VPORT_TYPE_INTERNAL: "internal",
+	OVS_VPORT_TYPE_GRE:      "gre",
+	OVS_VPORT_TYPE_VXLAN:    "vxlan",
+	OVS_VPORT_TYPE_GENEVE:   "geneve",
+	OVS_VPORT_TYPE_LISP:     "lisp",
+	OVS_VPORT_TYPE_STT:      "stt",
+}
+
+func (t VportType) String() string {
+	if name, ok := vportTypeNames[t]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("VportType(%d)", uint32(t))
+}
+
+func ParseVportType(name string) (VportType, error) {
+	for t, n := range vportTypeNames {
+		if n == name {
+			return t, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown vport type %q", name)
+}
+
 type VportSpec interface {
 	TypeName() string
 	Name() string
@@ -22,12 +53,11 @@ func (v VportSpecBase) Name() string {
 
 type SimpleVportSpec struct {
 	VportSpecBase
-	typ      uint32
-	typeName string
+	typ uint32
 }
 
 func (s SimpleVportSpec) TypeName() string {
-	return s.typeName
+	return VportType(s.typ).String()
 }
 
 func (s SimpleVportSpec) typeId() uint32 {
@@ -41,7 +71,6 @@ func NewNetdevVportSpec(name string) VportSpec {
 	return SimpleVportSpec{
 		VportSpecBase{name},
 		OVS_VPORT_TYPE_NETDEV,
-		"netdev",
 	}
 }
 
@@ -49,7 +78,15 @@ func NewInternalVportSpec(name string) VportSpec {
 	return SimpleVportSpec{
 		VportSpecBase{name},
 		OVS_VPORT_TYPE_INTERNAL,
-		"internal",
+	}
+}
+
+// GRE vports take no options: The tunnel endpoints and key come
+// from the tunnel flow key and set tunnel actions.
+func NewGreVportSpec(name string) VportSpec {
+	return SimpleVportSpec{
+		VportSpecBase{name},
+		OVS_VPORT_TYPE_GRE,
 	}
 }
 
@@ -59,7 +96,7 @@ type VxlanVportSpec struct {
 }
 
 func (VxlanVportSpec) TypeName() string {
-	return "vxlan"
+	return VportType(OVS_VPORT_TYPE_VXLAN).String()
 }
 
 func (VxlanVportSpec) typeId() uint32 {
@@ -83,10 +120,42 @@ func parseVxlanVportSpec(name string, opts Attrs) (VportSpec, error) {
 	return VxlanVportSpec{VportSpecBase{name}, port}, nil
 }
 
+// Geneve vports, like VXLAN vports, take the UDP destination port as
+// their only option.
+type GeneveVportSpec struct {
+	VportSpecBase
+	Port uint16
+}
+
+func (GeneveVportSpec) TypeName() string {
+	return VportType(OVS_VPORT_TYPE_GENEVE).String()
+}
+
+func (GeneveVportSpec) typeId() uint32 {
+	return OVS_VPORT_TYPE_GENEVE
+}
+
+func (v GeneveVportSpec) optionNlAttrs(req *NlMsgBuilder) {
+	req.PutUint16Attr(OVS_TUNNEL_ATTR_DST_PORT, v.Port)
+}
+
+func NewGeneveVportSpec(name string, port uint16) VportSpec {
+	return GeneveVportSpec{VportSpecBase{name}, port}
+}
+
+func parseGeneveVportSpec(name string, opts Attrs) (VportSpec, error) {
+	port, err := opts.GetUint16(OVS_TUNNEL_ATTR_DST_PORT)
+	if err != nil {
+		return nil, err
+	}
+
+	return GeneveVportSpec{VportSpecBase{name}, port}, nil
+}
+
 // Vport numbers are scoped to a particular datapath
 type VportID uint32
 
-func parseVport(msg *NlMsgParser) (id VportID, s VportSpec, err error) {
+func parseVport(msg *NlMsgParser) (res Vport, err error) {
 	attrs, err := msg.TakeAttrs()
 	if err != nil {
 		return
@@ -97,7 +166,12 @@ func parseVport(msg *NlMsgParser) (id VportID, s VportSpec, err error) {
 		return
 	}
 
-	id = VportID(rawid)
+	res.ID = VportID(rawid)
+
+	res.Stats, err = parseVportStats(attrs)
+	if err != nil {
+		return
+	}
 
 	typ, err := attrs.GetUint32(OVS_VPORT_ATTR_TYPE)
 	if err != nil {
@@ -119,36 +193,54 @@ func parseVport(msg *NlMsgParser) (id VportID, s VportSpec, err error) {
 
 	switch typ {
 	case OVS_VPORT_TYPE_NETDEV:
-		s = NewNetdevVportSpec(name)
+		res.Spec = NewNetdevVportSpec(name)
 		break
 
 	case OVS_VPORT_TYPE_INTERNAL:
-		s = NewInternalVportSpec(name)
+		res.Spec = NewInternalVportSpec(name)
+		break
+
+	case OVS_VPORT_TYPE_GRE:
+		res.Spec = NewGreVportSpec(name)
 		break
 
 	case OVS_VPORT_TYPE_VXLAN:
-		s, err = parseVxlanVportSpec(name, opts)
+		res.Spec, err = parseVxlanVportSpec(name, opts)
+		break
+
+	case OVS_VPORT_TYPE_GENEVE:
+		res.Spec, err = parseGeneveVportSpec(name, opts)
 		break
 
 	default:
-		err = fmt.Errorf("unsupported vport type %d", typ)
+		err = fmt.Errorf("unsupported vport type %s", VportType(typ))
 	}
 
 	return
 }
 
-func (dp DatapathHandle) CreateVport(spec VportSpec) (VportID, error) {
+// Datapaths created by CreateDatapath have per-vport upcall port
+// ids (OVS_DP_F_VPORT_PIDS), so a vport can be given several upcall
+// port ids.  The kernel hashes each flow's upcalls onto one of them.
+// To spread upcall handling across several goroutines, open a
+// NetlinkSocket for each one, and pass their PortIds here or to
+// SetVportUpcallPortIds.  With no upcall port ids, the vport doesn't
+// send upcalls.
+func (dp DatapathHandle) CreateVport(spec VportSpec, upcallPortIds ...uint32) (VportID, error) {
 	dpif := dp.dpif
 
 	req := NewNlMsgBuilder(RequestFlags, dpif.families[VPORT].id)
 	req.PutGenlMsghdr(OVS_VPORT_CMD_NEW, OVS_VPORT_VERSION)
-	req.putOvsHeader(dp.ifindex)
+	req.PutOvsHeader(dp.ifindex)
 	req.PutStringAttr(OVS_VPORT_ATTR_NAME, spec.Name())
 	req.PutUint32Attr(OVS_VPORT_ATTR_TYPE, spec.typeId())
 	req.PutNestedAttrs(OVS_VPORT_ATTR_OPTIONS, func() {
 		spec.optionNlAttrs(req)
 	})
-	req.PutUint32Attr(OVS_VPORT_ATTR_UPCALL_PID, 0)
+	if len(upcallPortIds) == 0 {
+		upcallPortIds = []uint32{0}
+	}
+	putUpcallPortIds(req, upcallPortIds)
 
 	resp, err := dpif.sock.Request(req)
 	if err != nil {
@@ -160,27 +252,76 @@ func (dp DatapathHandle) CreateVport(spec VportSpec) (VportID, error) {
 		return 0, err
 	}
 
-	id, _, err := parseVport(resp)
+	vport, err := parseVport(resp)
 	if err != nil {
 		return 0, err
 	}
 
-	return id, nil
+	return vport.ID, nil
 }
 
 func IsNoSuchVportError(err error) bool {
-	return err == NetlinkError(syscall.ENODEV)
+	return isNetlinkError(err, syscall.ENODEV)
 }
 
 type Vport struct {
-	ID   VportID
-	Spec VportSpec
+	ID    VportID
+	Spec  VportSpec
+	Stats VportStats
+
+	// The datapath the vport was obtained from, for Delete
+	dp DatapathHandle
+}
+
+// Delete the vport from the datapath it was obtained from (by
+// LookupVport, EnumerateVports, a VportEventsConsumer etc.).  The
+// vport is deleted by name, as the port number of a deleted vport may
+// be reused.  If the vport is already gone, the error satisfies
+// IsNoSuchVportError.
+func (v *Vport) Delete() error {
+	if v.dp.dpif == nil {
+		return fmt.Errorf("vport %q was not obtained from a datapath", v.Spec.Name())
+	}
+
+	return v.dp.DeleteVportByName(v.Spec.Name())
+}
+
+type VportStats struct {
+	RxPackets uint64
+	TxPackets uint64
+	RxBytes   uint64
+	TxBytes   uint64
+	RxErrors  uint64
+	TxErrors  uint64
+	RxDropped uint64
+	TxDropped uint64
+}
+
+func parseVportStats(attrs Attrs) (res VportStats, err error) {
+	statsBytes, err := attrs.GetFixedBytes(OVS_VPORT_ATTR_STATS,
+		SizeofOvsVportStats, true)
+	if err != nil || statsBytes == nil {
+		return
+	}
+
+	stats := ovsVportStatsAt(statsBytes, 0)
+	res = VportStats{
+		RxPackets: stats.RxPackets,
+		TxPackets: stats.TxPackets,
+		RxBytes:   stats.RxBytes,
+		TxBytes:   stats.TxBytes,
+		RxErrors:  stats.RxErrors,
+		TxErrors:  stats.TxErrors,
+		RxDropped: stats.RxDropped,
+		TxDropped: stats.TxDropped,
+	}
+	return
 }
 
 func lookupVport(dpif *Dpif, dpifindex int32, name string) (int32, Vport, error) {
 	req := NewNlMsgBuilder(RequestFlags, dpif.families[VPORT].id)
 	req.PutGenlMsghdr(OVS_VPORT_CMD_GET, OVS_VPORT_VERSION)
-	req.putOvsHeader(dpifindex)
+	req.PutOvsHeader(dpifindex)
 	req.PutStringAttr(OVS_VPORT_ATTR_NAME, name)
 
 	resp, err := dpif.sock.Request(req)
@@ -193,12 +334,13 @@ func lookupVport(dpif *Dpif, dpifindex int32, name string) (int32, Vport, error)
 		return 0, Vport{}, err
 	}
 
-	id, s, err := parseVport(resp)
+	vport, err := parseVport(resp)
 	if err != nil {
 		return 0, Vport{}, err
 	}
 
-	return ovshdr.DpIfIndex, Vport{id, s}, nil
+	vport.dp = DatapathHandle{dpif: dpif, ifindex: ovshdr.DpIfIndex}
+	return ovshdr.DpIfIndex, vport, nil
 }
 
 func (dpif *Dpif) LookupVportByName(name string) (DatapathHandle, Vport, error) {
@@ -214,7 +356,7 @@ func (dp DatapathHandle) LookupVportByName(name string) (Vport, error) {
 func (dp DatapathHandle) LookupVport(id VportID) (Vport, error) {
 	req := NewNlMsgBuilder(RequestFlags, dp.dpif.families[VPORT].id)
 	req.PutGenlMsghdr(OVS_VPORT_CMD_GET, OVS_VPORT_VERSION)
-	req.putOvsHeader(dp.ifindex)
+	req.PutOvsHeader(dp.ifindex)
 	req.PutUint32Attr(OVS_VPORT_ATTR_PORT_NO, uint32(id))
 
 	resp, err := dp.dpif.sock.Request(req)
@@ -227,12 +369,9 @@ func (dp DatapathHandle) LookupVport(id VportID) (Vport, error) {
 		return Vport{}, err
 	}
 
-	id, s, err := parseVport(resp)
-	if err != nil {
-		return Vport{}, err
-	}
-
-	return Vport{id, s}, nil
+	vport, err := parseVport(resp)
+	vport.dp = dp
+	return vport, err
 }
 
 func (dp DatapathHandle) LookupVportName(id VportID) (string, error) {
@@ -253,7 +392,7 @@ func (dp DatapathHandle) LookupVportName(id VportID) (string, error) {
 func (dp DatapathHandle) EnumerateVports() ([]Vport, error) {
 	req := NewNlMsgBuilder(DumpFlags, dp.dpif.families[VPORT].id)
 	req.PutGenlMsghdr(OVS_VPORT_CMD_GET, OVS_VPORT_VERSION)
-	req.putOvsHeader(dp.ifindex)
+	req.PutOvsHeader(dp.ifindex)
 
 	var res []Vport
 	consumer := func(resp *NlMsgParser) error {
@@ -262,12 +401,13 @@ func (dp DatapathHandle) EnumerateVports() ([]Vport, error) {
 			return err
 		}
 
-		id, spec, err := parseVport(resp)
+		vport, err := parseVport(resp)
 		if err != nil {
 			return err
 		}
 
-		res = append(res, Vport{id, spec})
+		vport.dp = dp
+		res = append(res, vport)
 		return nil
 	}
 
@@ -280,24 +420,51 @@ func (dp DatapathHandle) EnumerateVports() ([]Vport, error) {
 }
 
 func (dp DatapathHandle) DeleteVport(id VportID) error {
-	req := NewNlMsgBuilder(RequestFlags, dp.dpif.families[VPORT].id)
+	req := NewNlMsgBuilder(AckFlags, dp.dpif.families[VPORT].id)
 	req.PutGenlMsghdr(OVS_VPORT_CMD_DEL, OVS_VPORT_VERSION)
-	req.putOvsHeader(dp.ifindex)
+	req.PutOvsHeader(dp.ifindex)
 	req.PutUint32Attr(OVS_VPORT_ATTR_PORT_NO, uint32(id))
 
-	_, err := dp.dpif.sock.Request(req)
+	err := dp.dpif.sock.RequestAck(req)
 	return err
 }
 
+func (dp DatapathHandle) DeleteVportByName(name string) error {
+	req := NewNlMsgBuilder(AckFlags, dp.dpif.families[VPORT].id)
+	req.PutGenlMsghdr(OVS_VPORT_CMD_DEL, OVS_VPORT_VERSION)
+	req.PutOvsHeader(dp.ifindex)
+	req.PutStringAttr(OVS_VPORT_ATTR_NAME, name)
+
+	return dp.dpif.sock.RequestAck(req)
+}
+
+// The upcall port id attribute is an array of port ids
+func putUpcallPortIds(req *NlMsgBuilder, pids []uint32) {
+	req.PutAttr(OVS_VPORT_ATTR_UPCALL_PID, func() {
+		for _, pid := range pids {
+			pos := req.Grow(4)
+			*uint32At(req.buf, pos) = pid
+		}
+	})
+}
+
 func (dp DatapathHandle) setVportUpcallPortId(id VportID, pid uint32) error {
-	req := NewNlMsgBuilder(RequestFlags, dp.dpif.families[VPORT].id)
+	return dp.SetVportUpcallPortIds(id, []uint32{pid})
+}
+
+// See CreateVport regarding multiple upcall port ids
+func (dp DatapathHandle) SetVportUpcallPortIds(id VportID, pids []uint32) error {
+	if len(pids) == 0 {
+		return fmt.Errorf("no upcall port ids given")
+	}
+
+	req := NewNlMsgBuilder(AckFlags, dp.dpif.families[VPORT].id)
 	req.PutGenlMsghdr(OVS_VPORT_CMD_SET, OVS_VPORT_VERSION)
-	req.putOvsHeader(dp.ifindex)
+	req.PutOvsHeader(dp.ifindex)
 	req.PutUint32Attr(OVS_VPORT_ATTR_PORT_NO, uint32(id))
-	req.PutUint32Attr(OVS_VPORT_ATTR_UPCALL_PID, pid)
+	putUpcallPortIds(req, pids)
 
-	_, err := dp.dpif.sock.Request(req)
-	return err
+	return dp.dpif.sock.RequestAck(req)
 }
 
 type VportEventsConsumer interface {
@@ -311,6 +478,17 @@ func (dpif *Dpif) ConsumeVportEvents(consumer VportEventsConsumer) (Cancelable,
 }
 
 func (dp DatapathHandle) ConsumeVportEvents(consumer VportEventsConsumer) (Cancelable, error) {
+	return dp.ConsumeVportEventsIgnoring(consumer)
+}
+
+// Like ConsumeVportEvents, but dropping events caused by requests
+// from the given netlink port ids (e.g. from Dpif.PortId), so that a
+// controller doesn't react to its own changes.
+func (dpif *Dpif) ConsumeVportEventsIgnoring(consumer VportEventsConsumer, portIds ...uint32) (Cancelable, error) {
+	return DatapathHandle{dpif, -1}.ConsumeVportEventsIgnoring(consumer, portIds...)
+}
+
+func (dp DatapathHandle) ConsumeVportEventsIgnoring(consumer VportEventsConsumer, portIds ...uint32) (Cancelable, error) {
 	mcGroup, err := dp.dpif.getMCGroup(VPORT, "ovs_vport")
 	if err != nil {
 		return nil, err
@@ -321,18 +499,36 @@ func (dp DatapathHandle) ConsumeVportEvents(consumer VportEventsConsumer) (Cance
 		return nil, err
 	}
 
-	err = syscall.SetsockoptInt(consumeDpif.sock.fd, SOL_NETLINK, syscall.NETLINK_ADD_MEMBERSHIP, int(mcGroup))
+	err = consumeDpif.sock.JoinMulticastGroup(mcGroup)
 	if err != nil {
 		consumeDpif.Close()
 		return nil, err
 	}
 
-	go consumeDpif.consumeVportEvents(consumer, dp.ifindex)
+	go consumeDpif.consumeVportEvents(consumer, dp.dpif, dp.ifindex, portIds)
 	return cancelableDpif{consumeDpif}, nil
 }
 
-func (dpif *Dpif) consumeVportEvents(consumer VportEventsConsumer, ifindex int32) {
-	dpif.sock.consume(consumer, func(msg *NlMsgParser) error {
+// Whether a notification was caused by a request from one of the
+// port ids.
+func sentByPortId(msg *NlMsgParser, portIds []uint32) bool {
+	pid := msg.NlMsghdr().Pid
+	for _, id := range portIds {
+		if pid == id {
+			return true
+		}
+	}
+	return false
+}
+
+// The Vports passed to the consumer belong to owner, rather than to
+// the consuming Dpif, which is closed when consuming is cancelled.
+func (dpif *Dpif) consumeVportEvents(consumer VportEventsConsumer, owner *Dpif, ifindex int32, ignorePortIds []uint32) {
+	dpif.sock.consume(consumer, nil, func(msg *NlMsgParser) error {
+		if sentByPortId(msg, ignorePortIds) {
+			return nil
+		}
+
 		genlhdr, ovshdr, err := dpif.checkNlMsgHeaders(msg, VPORT, -1)
 		if err != nil {
 			return err
@@ -343,17 +539,18 @@ func (dpif *Dpif) consumeVportEvents(consumer VportEventsConsumer, ifindex int32
 			return nil
 		}
 
-		id, spec, err := parseVport(msg)
+		vport, err := parseVport(msg)
 		if err != nil {
 			return err
 		}
 
+		vport.dp = DatapathHandle{dpif: owner, ifindex: ovshdr.DpIfIndex}
 		switch genlhdr.Cmd {
 		case OVS_VPORT_CMD_NEW:
-			return consumer.VportCreated(ovshdr.DpIfIndex, Vport{id, spec})
+			return consumer.VportCreated(ovshdr.DpIfIndex, vport)
 
 		case OVS_VPORT_CMD_DEL:
-			return consumer.VportDeleted(ovshdr.DpIfIndex, Vport{id, spec})
+			return consumer.VportDeleted(ovshdr.DpIfIndex, vport)
 
 		default:
 			return nil
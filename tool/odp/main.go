@@ -188,6 +188,16 @@ var commands = subcommands{
 					"Add vxlan vport",
 					addVxlanVport,
 				},
+				"gre": command{
+					"<datapath> <vport>",
+					"Add gre vport",
+					addGreVport,
+				},
+				"geneve": command{
+					"<datapath> <vport>",
+					"Add geneve vport",
+					addGeneveVport,
+				},
 			},
 			"delete": command{
 				"<vport>", "Delete vport",
@@ -216,6 +226,10 @@ var commands = subcommands{
 			"<datapath> <options>...", "Clear flow stats",
 			clearFlow,
 		},
+		"flush": command{
+			"<datapath>", "Delete all flows",
+			flushFlows,
+		},
 		"list": command{
 			"<datapath>", "List flows",
 			listFlows,
@@ -471,6 +485,24 @@ func addVxlanVport(f Flags) bool {
 	return addVport(args[0], odp.NewVxlanVportSpec(args[1], uint16(port)))
 }
 
+func addGeneveVport(f Flags) bool {
+	var port uint
+	// 6081 is the IANA assigned port number for Geneve
+	f.UintVar(&port, "port", 6081, "UDP port number")
+	args := f.Parse(2, 2)
+
+	if port > 65535 {
+		return printErr("port number too large")
+	}
+
+	return addVport(args[0], odp.NewGeneveVportSpec(args[1], uint16(port)))
+}
+
+func addGreVport(f Flags) bool {
+	args := f.Parse(2, 2)
+	return addVport(args[0], odp.NewGreVportSpec(args[1]))
+}
+
 func addVport(dpname string, spec odp.VportSpec) bool {
 	dpif, err := odp.NewDpif()
 	if err != nil {
@@ -618,6 +650,10 @@ func printVport(prefix string, dpname string, vport odp.Vport) {
 	case odp.VxlanVportSpec:
 		fmt.Printf(" --port=%d", spec.Port)
 		break
+
+	case odp.GeneveVportSpec:
+		fmt.Printf(" --port=%d", spec.Port)
+		break
 	}
 
 	fmt.Printf("\n")
@@ -855,6 +891,15 @@ func flagsToFlowSpec(f Flags, dpif *odp.Dpif) (dp odp.DatapathHandle, flow odp.F
 	f.StringVar(&ethSrc, "eth-src", "", "key: ethernet source MAC")
 	f.StringVar(&ethDst, "eth-dst", "", "key: ethernet destination MAC")
 
+	var ethType string
+	f.StringVar(&ethType, "eth-type", "", "key: ethernet type")
+
+	var ipv4Src, ipv4Dst string
+	var ipv4Proto int
+	f.StringVar(&ipv4Src, "ipv4-src", "", "key: ipv4 source address")
+	f.StringVar(&ipv4Dst, "ipv4-dst", "", "key: ipv4 destination address")
+	f.IntVar(&ipv4Proto, "ipv4-proto", -1, "key: ipv4 protocol")
+
 	var tun tunnelFlags
 	addTunnelFlags(f, &tun, "tunnel-", "tunnel ")
 
@@ -886,6 +931,34 @@ func flagsToFlowSpec(f Flags, dpif *odp.Dpif) (dp odp.DatapathHandle, flow odp.F
 		return
 	}
 
+	ipv4FlowKey, err := handleIpv4FlowKeyOptions(ipv4Src, ipv4Dst, ipv4Proto)
+	if err != nil {
+		printErr("%s", err)
+		return
+	}
+
+	if ipv4FlowKey != nil {
+		flow.AddKey(*ipv4FlowKey)
+
+		// The kernel insists on the ethertype when matching
+		// on the IPv4 header
+		if ethType == "" {
+			ethType = "0x0800"
+		}
+	}
+
+	if ethType != "" {
+		t, err := strconv.ParseUint(ethType, 0, 16)
+		if err != nil {
+			printErr("invalid ethernet type \"%s\"", ethType)
+			return
+		}
+
+		fk := odp.NewEtherTypeFlowKey()
+		fk.SetEtherType(uint16(t))
+		flow.AddKey(fk)
+	}
+
 	flowKey, err := parseTunnelFlags(&tun)
 	if err != nil {
 		printErr("%s", err)
@@ -946,6 +1019,56 @@ func handleEthernetFlowKeyOptions(flow odp.FlowSpec, src string, dst string) err
 
 const ETH_ALEN = odp.ETH_ALEN
 
+func handleIpv4FlowKeyOptions(src string, dst string, proto int) (*odp.IPv4FlowKey, error) {
+	if src == "" && dst == "" && proto < 0 {
+		return nil, nil
+	}
+
+	fk := odp.NewIPv4FlowKey()
+
+	if src != "" {
+		addr, mask, err := handleIpv4AddrOption(src)
+		if err != nil {
+			return nil, err
+		}
+		fk.SetMaskedSrc(addr, mask)
+	}
+
+	if dst != "" {
+		addr, mask, err := handleIpv4AddrOption(dst)
+		if err != nil {
+			return nil, err
+		}
+		fk.SetMaskedDst(addr, mask)
+	}
+
+	if proto >= 0 {
+		if proto > 255 {
+			return nil, fmt.Errorf("ipv4 protocol too large")
+		}
+		fk.SetProto(uint8(proto))
+	}
+
+	return &fk, nil
+}
+
+func handleIpv4AddrOption(opt string) (addr [4]byte, mask [4]byte, err error) {
+	k := opt
+	m := "255.255.255.255"
+	if i := strings.Index(opt, "&"); i > 0 {
+		k = opt[:i]
+		m = opt[i+1:]
+	}
+
+	addr, err = parseIpv4(k)
+	if err != nil {
+		return
+	}
+
+	mask, err = parseIpv4(m)
+	return
+}
+
 func handleEthernetAddrOption(opt string) (key [ETH_ALEN]byte, mask [ETH_ALEN]byte, err error) {
 	if opt != "" {
 		var k, m string
@@ -1013,6 +1136,28 @@ func deleteFlow(f Flags) bool {
 	return true
 }
 
+func flushFlows(f Flags) bool {
+	args := f.Parse(1, 1)
+
+	dpif, err := odp.NewDpif()
+	if err != nil {
+		return printErr("%s", err)
+	}
+	defer dpif.Close()
+
+	dp, _ := lookupDatapath(dpif, args[0])
+	if dp == nil {
+		return false
+	}
+
+	err = dp.FlushFlows()
+	if err != nil {
+		return printErr("%s", err)
+	}
+
+	return true
+}
+
 func clearFlow(f Flags) bool {
 	dpif, err := odp.NewDpif()
 	if err != nil {
@@ -1074,6 +1219,9 @@ func listFlows(f Flags) bool {
 		if showStats {
 			fmt.Printf(": %d packets, %d bytes, used %d",
 				flow.Packets, flow.Bytes, flow.Used)
+			if flow.TcpFlags != 0 {
+				fmt.Printf(", tcp flags 0x%02x", flow.TcpFlags)
+			}
 		}
 
 		os.Stdout.WriteString("\n")
@@ -1128,6 +1276,22 @@ func printFlowKeys(fks odp.FlowKeys, dp odp.DatapathHandle) error {
 			printEthAddrOption("eth-dst", k.EthDst[:], m.EthDst[:])
 			break
 
+		case odp.EtherTypeFlowKey:
+			if fk.EtherTypeMask() == 0xffff {
+				fmt.Printf(" --eth-type=0x%04x", fk.EtherType())
+			} else {
+				fmt.Printf(" %v", fk)
+			}
+			break
+
+		case odp.IPv4FlowKey:
+			k := fk.Key()
+			m := fk.Mask()
+			printBytesOption("ipv4-src", k.Src[:], m.Src[:], ipv4ToString)
+			printBytesOption("ipv4-dst", k.Dst[:], m.Dst[:], ipv4ToString)
+			printIntOption("ipv4-proto", uint(k.Proto), uint(m.Proto), 0xff)
+			break
+
 		case odp.TunnelFlowKey:
 			printTunnelOptions(fk, "tunnel-")
 			break